@@ -14,6 +14,9 @@ import (
 
 var help = flag.Bool("help", false, "show help info")
 var version = flag.Bool("version", false, "show version info")
+var settle = flag.String("settle", "", "print the settlement report of the day, such as 2023-10-01, and exit")
+var settleProvider = flag.String("settle-provider", "", "the provider of the settlement report, the default provider if empty")
+var settleFormat = flag.String("settle-format", "json", "the format of the settlement report, json or csv")
 
 func main() {
 	flag.Parse()
@@ -23,6 +26,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *settle != "" {
+		if err := api.Settle(*settle, *settleProvider, *settleFormat, os.Stdout); err != nil {
+			logging.Errf("settlement %s failed: %v", *settle, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	app := api.NewApp()
 	host := "http://" + conf.Config.Server.Addr
 	logging.Infof("%s@%s start on %s %s", conf.AppName, conf.AppVersion, conf.Config.Env, host)
@@ -30,7 +30,7 @@ func NewApp() *gear.App {
 	app.Set(gear.SetEnv, conf.Config.Env)
 
 	app.UseHandler(logging.AccessLogger)
-	err := util.DigInvoke(func(blls *bll.Blls, routers []*gear.Router) error {
+	err := util.DigInvoke(func(blls *bll.Blls, apis *APIs, routers []*gear.Router) error {
 		for _, router := range routers {
 			app.UseHandler(router)
 		}
@@ -45,6 +45,8 @@ func NewApp() *gear.App {
 		if err := blls.Walletbase.InitApp(ctx, app); err != nil {
 			return err
 		}
+
+		apis.Reconciler.Start()
 		return nil
 	})
 
@@ -1,31 +1,33 @@
 package api
 
 import (
-	"encoding/json"
-	"io"
+	"fmt"
 	"strings"
 
-	"github.com/fxamacker/cbor/v2"
-	"github.com/stripe/stripe-go/v75"
-	"github.com/stripe/stripe-go/v75/checkout/session"
-	"github.com/stripe/stripe-go/v75/price"
-	"github.com/stripe/stripe-go/v75/webhook"
 	"github.com/teambition/gear"
 
 	"github.com/yiwen-ai/wallet-api/src/bll"
 	"github.com/yiwen-ai/wallet-api/src/conf"
 	"github.com/yiwen-ai/wallet-api/src/logging"
 	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/service"
 	"github.com/yiwen-ai/wallet-api/src/util"
 )
 
-func init() {
-	stripe.Key = conf.Config.Stripe.SecretKey
+type Checkout struct {
+	blls      *bll.Blls
+	redis     *service.Redis
+	providers *provider.Providers
+	packages  []conf.Package
 }
 
-type Checkout struct {
-	blls *bll.Blls
-	cfg  conf.Stripe
+// provider returns the provider of the name, or the default provider.
+func (a *Checkout) provider(name string) (provider.Provider, error) {
+	if name == "" {
+		name = a.providers.Default
+	}
+	return a.providers.Get(name)
 }
 
 type CheckoutConfig struct {
@@ -36,19 +38,22 @@ type CheckoutConfig struct {
 }
 
 func (a *Checkout) GetConfig(ctx *gear.Context) error {
-	p, err := price.Get(
-		a.cfg.PriceID,
-		nil,
-	)
+	p, err := a.provider(ctx.Query("provider"))
+	if err != nil {
+		return err
+	}
+
+	cfg := p.Config()
+	price, err := getPrice(ctx, a.redis, p, cfg.PriceID)
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
 	}
 
 	return ctx.OkJSON(bll.SuccessResponse[CheckoutConfig]{Result: CheckoutConfig{
-		Provider:   "stripe",
-		PublicKey:  a.cfg.PubKey,
-		UnitAmount: p.UnitAmount,
-		Currency:   string(p.Currency),
+		Provider:   p.Name(),
+		PublicKey:  cfg.PublicKey,
+		UnitAmount: price.UnitAmount,
+		Currency:   price.Currency,
 	}})
 }
 
@@ -67,9 +72,53 @@ func (a *Checkout) Get(ctx *gear.Context) error {
 	return ctx.OkSend(bll.SuccessResponse[*bll.ChargeOutput]{Result: output})
 }
 
+type CheckoutPackage struct {
+	ID       string `json:"id" cbor:"id"`
+	Quantity uint   `json:"quantity" cbor:"quantity"`
+	Bonus    uint   `json:"bonus" cbor:"bonus"`
+	Amount   int64  `json:"amount" cbor:"amount"`
+	Currency string `json:"currency" cbor:"currency"`
+}
+
+// ListPackages lists the credit packages available with the provider.
+func (a *Checkout) ListPackages(ctx *gear.Context) error {
+	p, err := a.provider(ctx.Query("provider"))
+	if err != nil {
+		return err
+	}
+
+	output := make([]CheckoutPackage, 0, len(a.packages))
+	for _, pkg := range a.packages {
+		id, ok := pkg.Prices[p.Name()]
+		if !ok {
+			continue
+		}
+
+		price, err := getPrice(ctx, a.redis, p, id)
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		output = append(output, CheckoutPackage{
+			ID:       pkg.ID,
+			Quantity: pkg.Quantity,
+			Bonus:    pkg.Bonus,
+			Amount:   price.UnitAmount,
+			Currency: price.Currency,
+		})
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[[]CheckoutPackage]{Result: output})
+}
+
 type CheckoutInput struct {
-	Quantity uint    `json:"quantity" cbor:"quantity" validate:"gte=50,lte=1000000"`
+	Quantity uint    `json:"quantity" cbor:"quantity" validate:"required_without=Package,omitempty,gte=50,lte=1000000"`
+	Package  *string `json:"package,omitempty" cbor:"package,omitempty"` // the quantity is ignored if set
+	Coupon   *string `json:"coupon,omitempty" cbor:"coupon,omitempty" validate:"omitempty,alphanum,gte=3,lte=32"`
 	Currency *string `json:"currency" cbor:"currency"`
+	Provider *string `json:"provider,omitempty" cbor:"provider,omitempty"` // the default provider if not set
+	// gift mode, the credits are credited to the recipient
+	Recipient *util.ID `json:"recipient,omitempty" cbor:"recipient,omitempty"`
+	Message   *string  `json:"message,omitempty" cbor:"message,omitempty" validate:"omitempty,gte=1,lte=280"`
 }
 
 func (i *CheckoutInput) Validate() error {
@@ -77,6 +126,9 @@ func (i *CheckoutInput) Validate() error {
 		return gear.ErrBadRequest.From(err)
 	}
 
+	if i.Message != nil && i.Recipient == nil {
+		return gear.ErrBadRequest.WithMsg("message is only for gifts")
+	}
 	return nil
 }
 
@@ -98,73 +150,149 @@ func (a *Checkout) Create(ctx *gear.Context) error {
 		}
 	}
 
+	name := ""
+	if input.Provider != nil {
+		name = *input.Provider
+	}
+	p, err := a.provider(name)
+	if err != nil {
+		return err
+	}
+
 	sess := gear.CtxValue[middleware.Session](ctx)
-	output, err := a.blls.Walletbase.CreateCharge(ctx, &bll.ChargeInput{
+	chargeInput := &bll.ChargeInput{
 		UID:      sess.UserID,
-		Provider: "stripe",
+		Provider: p.Name(),
 		Quantity: input.Quantity,
-	})
+	}
+	if input.Recipient != nil {
+		if err := a.checkRecipient(ctx, sess.UserID, *input.Recipient); err != nil {
+			return err
+		}
+		logging.SetTo(ctx, "recipient", input.Recipient.String())
+		chargeInput.Recipient = input.Recipient
+		chargeInput.GiftMessage = input.Message
+	}
+	sessionInput := &provider.SessionInput{
+		UID:      sess.UserID,
+		Currency: input.Currency,
+		PriceID:  p.Config().PriceID,
+		Quantity: input.Quantity,
+	}
+
+	if input.Package != nil {
+		pkg, err := a.getPackage(*input.Package)
+		if err != nil {
+			return err
+		}
+		priceID, ok := pkg.Prices[p.Name()]
+		if !ok {
+			return gear.ErrBadRequest.WithMsgf("package %s not available with %s", pkg.ID, p.Name())
+		}
+
+		logging.SetTo(ctx, "package", pkg.ID)
+		chargeInput.Quantity = pkg.Quantity
+		if pkg.Bonus > 0 {
+			chargeInput.Award = util.Ptr(pkg.Bonus)
+		}
+		// the package is priced as one unit
+		sessionInput.PriceID = priceID
+		sessionInput.Quantity = 1
+	}
+
+	if input.Coupon != nil {
+		if sessionInput.Coupon, err = a.blls.Coupons.Redeem(ctx, *input.Coupon, sess.UserID, p.Name()); err != nil {
+			return err
+		}
+		chargeInput.Coupon = util.Ptr(strings.ToUpper(*input.Coupon))
+		logging.SetTo(ctx, "coupon", *chargeInput.Coupon)
+	}
+
+	output, err := a.blls.Walletbase.CreateCharge(ctx, chargeInput)
 	if err != nil {
+		a.releaseCoupon(ctx, sess.UserID, chargeInput.Coupon)
 		return gear.ErrInternalServerError.From(err)
 	}
 
 	logging.SetTo(ctx, "chargeId", output.ID.String())
-	err = a.createSession(ctx, output.ID, &stripe.CheckoutSessionParams{
-		SuccessURL:       util.Ptr(a.cfg.SuccessUrl),
-		Mode:             util.Ptr(string(stripe.CheckoutSessionModePayment)),
-		Currency:         input.Currency,
-		CustomerCreation: util.Ptr("always"),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Quantity: util.Ptr(int64(input.Quantity)),
-				Price:    util.Ptr(a.cfg.PriceID),
-			},
-		},
-		Metadata: map[string]string{
-			"uid": sess.UserID.String(),
-			"cid": output.ID.String(),
-		},
-	})
+	sessionInput.ChargeID = output.ID
+	err = a.createSession(ctx, p, sessionInput)
 
 	if err != nil {
 		logging.SetTo(ctx, "createSessionError", err.Error())
+		a.releaseCoupon(ctx, sess.UserID, chargeInput.Coupon)
 	}
 	return err
 }
 
-func (a *Checkout) createSession(ctx *gear.Context, chargeID util.ID, params *stripe.CheckoutSessionParams) error {
-	sess := gear.CtxValue[middleware.Session](ctx)
-	if customer, _ := a.blls.Walletbase.GetCustomer(ctx, sess.UserID, "stripe", util.Ptr("customer")); customer != nil {
-		params.Customer = stripe.String(customer.Customer)
-		params.CustomerCreation = nil
+// checkRecipient checks that the recipient of a gift is an active user other than the buyer.
+func (a *Checkout) checkRecipient(ctx *gear.Context, buyer, recipient util.ID) error {
+	if recipient == buyer {
+		return gear.ErrBadRequest.WithMsg("can not gift to yourself")
 	}
-	cs, err := session.New(params)
+
+	user, err := a.blls.Userbase.Get(ctx, recipient)
 	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return gear.ErrBadRequest.WithMsgf("recipient %s not found", recipient.String())
+		}
 		return gear.ErrInternalServerError.From(err)
 	}
+	if user.Status < 0 {
+		return gear.ErrBadRequest.WithMsgf("recipient %s is not active", recipient.String())
+	}
+	return nil
+}
 
-	logging.SetTo(ctx, "checkoutId", cs.ID)
-	payload, err := cbor.Marshal(cs)
+// releaseCoupon gives back the coupon redemption of a checkout that will never be paid.
+func (a *Checkout) releaseCoupon(ctx *gear.Context, uid util.ID, coupon *string) {
+	if coupon == nil {
+		return
+	}
+	if err := a.blls.Coupons.Release(ctx, *coupon, uid); err != nil {
+		logging.SetTo(ctx, "releaseCouponError", err.Error())
+	}
+}
+
+func (a *Checkout) getPackage(id string) (*conf.Package, error) {
+	for i := range a.packages {
+		if a.packages[i].ID == id {
+			return &a.packages[i], nil
+		}
+	}
+	return nil, gear.ErrNotFound.WithMsgf("package %s not found", id)
+}
+
+func (a *Checkout) createSession(ctx *gear.Context, p provider.Provider, input *provider.SessionInput) error {
+	if customer, _ := a.blls.Walletbase.GetCustomer(ctx, input.UID, p.Name(), util.Ptr("customer")); customer != nil {
+		input.Customer = customer.Customer
+	}
+	cs, err := p.CreateSession(ctx, input)
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
 	}
 
-	_, err = a.blls.Walletbase.UpdateCharge(ctx, &bll.UpdateChargeInput{
-		UID:           sess.UserID,
-		ID:            chargeID,
-		CurrentStatus: 0,
-		Status:        1,
-		Currency:      util.Ptr(string(cs.Currency)),
+	logging.SetTo(ctx, "checkoutId", cs.ID)
+	a.cacheSession(ctx, cs)
+	update := &bll.UpdateChargeInput{
+		UID:           input.UID,
+		ID:            input.ChargeID,
+		CurrentStatus: bll.ChargeStatusCreated,
+		Status:        bll.ChargeStatusPending,
+		Currency:      util.Ptr(cs.Currency),
 		Amount:        util.Ptr(uint(cs.AmountTotal)),
 		ChargeID:      util.Ptr(cs.ID),
-		ChargePayload: util.Ptr(util.Bytes(payload)),
-	})
-	if err != nil {
+		ChargePayload: util.Ptr(cs.Payload),
+	}
+	if cs.AmountDiscount > 0 {
+		update.AmountDiscount = util.Ptr(uint(cs.AmountDiscount))
+	}
+	if _, err = a.blls.Walletbase.UpdateCharge(ctx, update); err != nil {
 		return gear.ErrInternalServerError.From(err)
 	}
 
 	return ctx.OkSend(bll.SuccessResponse[CheckoutOutput]{Result: CheckoutOutput{
-		ID:         chargeID,
+		ID:         input.ChargeID,
 		PaymentURL: cs.URL,
 	}})
 }
@@ -183,9 +311,11 @@ func (a *Checkout) ListCharges(ctx *gear.Context) error {
 	}
 
 	for i := range output {
-		if output[i].Status == 1 && output[i].ChargeID != nil {
-			if cs, err := session.Get(*(output[i].ChargeID), nil); err == nil {
-				output[i].PaymentURL = util.Ptr(cs.URL)
+		if output[i].Status == bll.ChargeStatusPending && output[i].ChargeID != nil {
+			if p, err := a.providers.Get(output[i].Provider); err == nil {
+				if url := a.paymentURL(ctx, p, *(output[i].ChargeID)); url != "" {
+					output[i].PaymentURL = util.Ptr(url)
+				}
 			}
 		}
 		output[i].ChargeID = nil
@@ -195,145 +325,147 @@ func (a *Checkout) ListCharges(ctx *gear.Context) error {
 	return ctx.OkSend(bll.SuccessResponse[[]bll.ChargeOutput]{Result: output})
 }
 
-// checkout.session.async_payment_failed
-// checkout.session.async_payment_succeeded
-// checkout.session.completed
-// checkout.session.expired
-func (a *Checkout) StripeWebhook(ctx *gear.Context) error {
-	b, err := io.ReadAll(ctx.Req.Body)
-	if err != nil {
-		return gear.ErrBadRequest.WithMsgf("read body failed: %v", err)
+// ListGifts lists the gift top-ups received by the user, the prices paid by the buyers are hidden.
+func (a *Checkout) ListGifts(ctx *gear.Context) error {
+	input := &bll.UIDPagination{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
 	}
+	sess := gear.CtxValue[middleware.Session](ctx)
+	input.UID = &sess.UserID
 
-	event, err := webhook.ConstructEvent(b, ctx.Req.Header.Get("Stripe-Signature"), a.cfg.WebhookKey)
+	output, err := a.blls.Walletbase.ListGifts(ctx, input)
 	if err != nil {
-		return gear.ErrBadRequest.WithMsgf("webhook.ConstructEvent failed: %v", err)
+		return gear.ErrInternalServerError.From(err)
 	}
 
-	logging.SetTo(ctx, "eventType", event.Type)
-	logging.SetTo(ctx, "eventId", event.ID)
-
-	var obj map[string]interface{}
-	if event.Data != nil && len(event.Data.Object) > 0 {
-		obj = event.Data.Object
+	ids := make([]util.ID, 0, len(output.Result))
+	for _, v := range output.Result {
+		ids = append(ids, v.UID)
 	}
-
-	logging.SetTo(ctx, "objectType", obj["object"])
-	logging.SetTo(ctx, "objectId", obj["id"])
-
-	switch event.Type {
-	case "checkout.session.completed":
-		if err = a.completeSession(ctx, event.Data.Raw); err != nil {
-			logging.SetTo(ctx, "error", err.Error())
-			return ctx.Error(err)
-		}
-	case "checkout.session.expired":
-		if err = a.expireSession(ctx, event.Data.Raw); err != nil {
-			logging.SetTo(ctx, "error", err.Error())
-			return ctx.Error(err)
-		}
-	default:
-		logging.SetTo(ctx, "msg", "unknown event type")
+	users := make(map[util.ID]*bll.UserInfo, len(ids))
+	infos := a.blls.Userbase.LoadUserInfo(ctx, ids...)
+	for i := range infos {
+		users[*infos[i].ID] = &infos[i]
+		infos[i].ID = nil
+	}
+	for i := range output.Result {
+		gift := &output.Result[i]
+		gift.UIDInfo = users[gift.UID]
+		gift.Currency = nil
+		gift.Amount = nil
+		gift.AmountDiscount = nil
+		gift.AmountRefunded = nil
+		gift.AmountTax = nil
+		gift.TaxJurisdiction = nil
+		gift.Coupon = nil
+		gift.ChargeID = nil
+		gift.ChargePayload = nil
 	}
 
-	return ctx.OkJSON(bll.SuccessResponse[bool]{Result: true})
+	return ctx.OkSend(output)
 }
 
-func (a *Checkout) completeSession(ctx *gear.Context, data []byte) error {
-	cs := &stripe.CheckoutSession{}
-	if err := json.Unmarshal(data, cs); err != nil {
-		return gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
-	}
+type RefundInput struct {
+	ID       util.ID `json:"id" cbor:"id"`
+	Quantity *uint   `json:"quantity,omitempty" cbor:"quantity,omitempty" validate:"omitempty,gte=1,lte=1000000"` // full refund if not set
+}
 
-	uid, err := util.ParseID(cs.Metadata["uid"])
-	if err != nil {
-		return gear.ErrBadRequest.WithMsgf("parse uid failed: %v", err)
-	}
-	logging.SetTo(ctx, "uid", uid)
-	cid, err := util.ParseID(cs.Metadata["cid"])
-	if err != nil {
-		return gear.ErrBadRequest.WithMsgf("parse uid failed: %v", err)
+func (i *RefundInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
 	}
-	logging.SetTo(ctx, "chargeId", cid)
 
-	h := util.HeaderFromCtx(ctx)
-	h.Set("x-auth-user", uid.String())
-	h.Set("x-auth-app", util.JARVIS.String())
+	return nil
+}
 
-	charge, err := a.blls.Walletbase.CompleteCharge(ctx, &bll.CompleteChargeInput{
-		UID:           uid,
-		ID:            cid,
-		Currency:      string(cs.Currency),
-		Amount:        uint(cs.AmountTotal),
-		ChargeID:      cs.ID,
-		ChargePayload: util.Bytes(data),
-	})
+func (a *Checkout) Refund(ctx *gear.Context) error {
+	input := &RefundInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
 
+	sess := gear.CtxValue[middleware.Session](ctx)
+	logging.SetTo(ctx, "chargeId", input.ID.String())
+	charge, err := a.blls.Walletbase.GetCharge(ctx, sess.UserID, input.ID, nil)
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
 	}
 
-	if cs.Customer != nil && cs.CustomerDetails != nil {
-		data, err := cbor.Marshal(cs.CustomerDetails)
-		if err == nil {
-			_, err = a.blls.Walletbase.UpsertCustomer(ctx, &bll.CustomerInput{
-				UID:      uid,
-				Provider: "stripe",
-				Customer: cs.Customer.ID,
-				Payload:  util.Bytes(data),
-			})
-		}
-		if err != nil {
-			logging.SetTo(ctx, "upsertCustomerError", err.Error())
-		} else {
-			logging.SetTo(ctx, "customer", cs.Customer.ID)
-		}
+	// the gifted credits are in the wallet of the recipient
+	if charge.Recipient != nil {
+		return gear.ErrBadRequest.WithMsg("gift top-ups can not be refunded")
 	}
 
-	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserTopup, 1, uid, &bll.Payload{
-		Kind:   "charge",
-		ID:     charge.ID,
-		Amount: int64(charge.Quantity),
-	}); err != nil {
-		logging.SetTo(ctx, "writeLogError", err.Error())
+	quantity, amount, err := charge.RefundAmount(input.Quantity)
+	if err != nil {
+		return err
 	}
-
-	return nil
-}
-
-func (a *Checkout) expireSession(ctx *gear.Context, data []byte) error {
-	cs := &stripe.CheckoutSession{}
-	if err := json.Unmarshal(data, cs); err != nil {
-		return gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+	// such as the credits bought with a 100% coupon, or a few credits of a sub-cent unit price
+	if amount == 0 {
+		return gear.ErrBadRequest.WithMsgf("the refund amount of %d credits is 0", quantity)
 	}
-
-	uid, err := util.ParseID(cs.Metadata["uid"])
-	if err != nil {
-		return gear.ErrBadRequest.WithMsgf("parse uid failed: %v", err)
+	if charge.ChargeID == nil {
+		return gear.ErrInternalServerError.WithMsg("payment session not found")
 	}
-	logging.SetTo(ctx, "uid", uid)
-	cid, err := util.ParseID(cs.Metadata["cid"])
+
+	p, err := a.providers.Get(charge.Provider)
 	if err != nil {
-		return gear.ErrBadRequest.WithMsgf("parse uid failed: %v", err)
+		return err
 	}
-	logging.SetTo(ctx, "chargeId", cid)
 
-	h := util.HeaderFromCtx(ctx)
-	h.Set("x-auth-user", uid.String())
-	h.Set("x-auth-app", util.JARVIS.String())
+	// the refunded credits and their award should not have been spent or held,
+	// no hold is created for them until the refund is recorded
+	award := charge.RefundAward(quantity)
+	var output *bll.ChargeOutput
+	err = a.blls.Holds.Spend(ctx, sess.UserID, int64(quantity), func(wallet *bll.WalletOutput) error {
+		if wallet.Award < int64(award) {
+			return gear.ErrBadRequest.WithMsgf("insufficient awarded credits, expected %d, got %d", award, wallet.Award)
+		}
+
+		// a retry of the same refund should not refund twice
+		refunded := uint(0)
+		if charge.AmountRefunded != nil {
+			refunded = *charge.AmountRefunded
+		}
+		rf, err := p.Refund(ctx, &provider.RefundInput{
+			UID:            sess.UserID,
+			ChargeID:       charge.ID,
+			SessionID:      *charge.ChargeID,
+			Amount:         int64(amount),
+			IdempotencyKey: fmt.Sprintf("refund:%s:%d:%d", charge.ID.String(), refunded, amount),
+		})
+		if err != nil {
+			logging.SetTo(ctx, "createRefundError", err.Error())
+			return err
+		}
 
-	_, err = a.blls.Walletbase.UpdateCharge(ctx, &bll.UpdateChargeInput{
-		UID:           uid,
-		ID:            cid,
-		CurrentStatus: 1,
-		Status:        -2,
-		FailureCode:   util.Ptr("checkout.expired"),
-		FailureMsg:    util.Ptr("checkout.expired"),
+		logging.SetTo(ctx, "refundId", rf.ID)
+		output, err = a.blls.Walletbase.RefundCharge(ctx, &bll.RefundChargeInput{
+			UID:           sess.UserID,
+			ID:            charge.ID,
+			Quantity:      quantity,
+			Award:         award,
+			Amount:        amount,
+			RefundID:      rf.ID,
+			RefundPayload: rf.Payload,
+		})
+		return err
 	})
-
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
 	}
 
-	return nil
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserRefund, 1, sess.UserID, &bll.Payload{
+		Kind:   "charge",
+		ID:     charge.ID,
+		Payer:  sess.UserID,
+		Amount: int64(quantity),
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	output.ChargeID = nil
+	output.ChargePayload = nil
+	return ctx.OkSend(bll.SuccessResponse[*bll.ChargeOutput]{Result: output})
 }
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/service"
+)
+
+// the prices rarely change, they are cached for 10 minutes.
+const priceCacheTTL = 600
+
+// the payment URLs of the sessions without expiry, such as alipay QR codes, are cached for 1 hour.
+const sessionCacheTTL = 3600
+
+type cachedPrice struct {
+	ID         string `cbor:"id"`
+	UnitAmount int64  `cbor:"unit_amount"`
+	Currency   string `cbor:"currency"`
+}
+
+type cachedSession struct {
+	URL string `cbor:"url"` // empty if the session can not be paid
+}
+
+func priceCacheKey(name, id string) string {
+	return "price:" + name + ":" + id
+}
+
+func sessionCacheKey(id string) string {
+	return "session_url:" + id
+}
+
+// getPrice returns the price from the cache, or from the provider.
+// The cache is best-effort, the provider is called if Redis fails.
+func getPrice(ctx context.Context, redis *service.Redis, p provider.Provider, id string) (*provider.Price, error) {
+	key := priceCacheKey(p.Name(), id)
+	cached := &cachedPrice{}
+	if err := redis.GetCBOR(ctx, key, cached); err == nil {
+		return &provider.Price{ID: cached.ID, UnitAmount: cached.UnitAmount, Currency: cached.Currency}, nil
+	}
+
+	price, err := p.GetPrice(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	_ = redis.SetCBOR(ctx, key, &cachedPrice{
+		ID:         price.ID,
+		UnitAmount: price.UnitAmount,
+		Currency:   price.Currency,
+	}, priceCacheTTL)
+	return price, nil
+}
+
+// paymentURL returns the payment URL of the session from the cache, or from the provider.
+// It returns an empty string if the session can not be paid.
+func (a *Checkout) paymentURL(ctx context.Context, p provider.Provider, id string) string {
+	cached := &cachedSession{}
+	if err := a.redis.GetCBOR(ctx, sessionCacheKey(id), cached); err == nil {
+		return cached.URL
+	}
+
+	cs, err := p.GetSession(ctx, id)
+	if err != nil {
+		return ""
+	}
+	a.cacheSession(ctx, cs)
+	if cs.Paid || cs.Closed {
+		return ""
+	}
+	return cs.URL
+}
+
+// cacheSession caches the payment URL of the session until it expires.
+func (a *Checkout) cacheSession(ctx context.Context, cs *provider.Session) {
+	ttl := int64(sessionCacheTTL)
+	if cs.ExpiresAt > 0 {
+		ttl = cs.ExpiresAt - time.Now().Unix()
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	cached := &cachedSession{}
+	if !cs.Paid && !cs.Closed {
+		cached.URL = cs.URL
+	}
+	_ = a.redis.SetCBOR(ctx, sessionCacheKey(cs.ID), cached, uint(ttl))
+}
+
+// invalidateSession removes the cached payment URL when a webhook changes the charge.
+func (a *Checkout) invalidateSession(ctx context.Context, id string) {
+	_ = a.redis.Delete(ctx, sessionCacheKey(id))
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// customerManager returns the provider of the name that manages customers,
+// and the saved customer of the user with the provider.
+func (a *Checkout) customerManager(ctx *gear.Context, name string) (provider.CustomerManager, string, error) {
+	p, err := a.provider(name)
+	if err != nil {
+		return nil, "", err
+	}
+	cm, ok := p.(provider.CustomerManager)
+	if !ok {
+		return nil, "", gear.ErrBadRequest.WithMsgf("provider %s does not support customers", p.Name())
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	customer, err := a.blls.Walletbase.GetCustomer(ctx, sess.UserID, p.Name(), util.Ptr("customer"))
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, "", gear.ErrNotFound.WithMsg("no saved customer, please top up first")
+		}
+		return nil, "", gear.ErrInternalServerError.From(err)
+	}
+	logging.SetTo(ctx, "customer", customer.Customer)
+	return cm, customer.Customer, nil
+}
+
+type PortalInput struct {
+	Provider *string `json:"provider,omitempty" cbor:"provider,omitempty"` // the default provider if not set
+}
+
+func (i *PortalInput) Validate() error {
+	return nil
+}
+
+type PortalOutput struct {
+	URL string `json:"url" cbor:"url"`
+}
+
+// CreatePortal creates a session of the billing portal for the user,
+// where the user manages the saved payment methods and views the invoices.
+func (a *Checkout) CreatePortal(ctx *gear.Context) error {
+	input := &PortalInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	name := ""
+	if input.Provider != nil {
+		name = *input.Provider
+	}
+	cm, customer, err := a.customerManager(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	ps, err := cm.CreatePortalSession(ctx, customer)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "portalId", ps.ID)
+	return ctx.OkSend(bll.SuccessResponse[PortalOutput]{Result: PortalOutput{URL: ps.URL}})
+}
+
+type PaymentMethodOutput struct {
+	ID       string `json:"id" cbor:"id"`
+	Type     string `json:"type" cbor:"type"`
+	Brand    string `json:"brand,omitempty" cbor:"brand,omitempty"`
+	Last4    string `json:"last4,omitempty" cbor:"last4,omitempty"`
+	ExpMonth int64  `json:"exp_month,omitempty" cbor:"exp_month,omitempty"`
+	ExpYear  int64  `json:"exp_year,omitempty" cbor:"exp_year,omitempty"`
+}
+
+// ListPaymentMethods lists the payment methods saved by the previous top ups,
+// the checkout of a returning user offers them.
+func (a *Checkout) ListPaymentMethods(ctx *gear.Context) error {
+	cm, customer, err := a.customerManager(ctx, ctx.Query("provider"))
+	if err != nil {
+		return err
+	}
+
+	methods, err := cm.ListPaymentMethods(ctx, customer)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	output := make([]PaymentMethodOutput, 0, len(methods))
+	for _, m := range methods {
+		output = append(output, PaymentMethodOutput{
+			ID:       m.ID,
+			Type:     m.Type,
+			Brand:    m.Brand,
+			Last4:    m.Last4,
+			ExpMonth: m.ExpMonth,
+			ExpYear:  m.ExpYear,
+		})
+	}
+	return ctx.OkSend(bll.SuccessResponse[[]PaymentMethodOutput]{Result: output})
+}
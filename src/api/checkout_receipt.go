@@ -0,0 +1,343 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Receipt is the receipt of a completed top up.
+type Receipt struct {
+	Number        string
+	Date          string // the paid date in UTC
+	ChargeID      string
+	Provider      string
+	Issuer        string
+	IssuerAddress []string
+	BilledTo      []string
+	Items         []ReceiptLine
+	Totals        []ReceiptLine
+}
+
+type ReceiptLine struct {
+	Label string
+	Value string
+}
+
+// receipt builds the receipt of the completed charge, with the billing details
+// in the stored payload of the payment session.
+func (a *Checkout) receipt(ctx context.Context, charge *bll.ChargeOutput) (*Receipt, error) {
+	n, err := a.blls.Receipts.Number(ctx, charge.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := conf.Config.Receipt
+	r := &Receipt{
+		Number:        fmt.Sprintf("%s-%06d", cfg.Prefix, n),
+		Date:          time.UnixMilli(charge.Txn.UnixMs()).UTC().Format(time.DateOnly),
+		ChargeID:      charge.ID.String(),
+		Provider:      charge.Provider,
+		Issuer:        cfg.Issuer,
+		IssuerAddress: cfg.Address,
+	}
+
+	details := &provider.ReceiptDetails{}
+	if p, err := a.providers.Get(charge.Provider); err == nil && charge.ChargePayload != nil {
+		if rd, ok := p.(provider.ReceiptDetailer); ok {
+			if details, err = rd.ReceiptDetails(*charge.ChargePayload); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, s := range []string{details.Name, details.Email} {
+		if s != "" {
+			r.BilledTo = append(r.BilledTo, s)
+		}
+	}
+	r.BilledTo = append(r.BilledTo, details.Address...)
+	if details.TaxID != "" {
+		r.BilledTo = append(r.BilledTo, "Tax ID: "+details.TaxID)
+	}
+
+	item := fmt.Sprintf("%d credits", charge.Quantity)
+	if charge.Award != nil && *charge.Award > 0 {
+		item += fmt.Sprintf(" (+%d bonus)", *charge.Award)
+	}
+	currency := ""
+	if charge.Currency != nil {
+		currency = *charge.Currency
+	}
+	total, discount := int64(0), int64(0)
+	if charge.Amount != nil {
+		total = int64(*charge.Amount)
+	}
+	if charge.AmountDiscount != nil {
+		discount = int64(*charge.AmountDiscount)
+	}
+	tax, taxLabel := details.AmountTax, "Tax"
+	if charge.AmountTax != nil {
+		tax = int64(*charge.AmountTax)
+		if charge.TaxJurisdiction != nil && *charge.TaxJurisdiction != "" {
+			taxLabel += " (" + *charge.TaxJurisdiction + ")"
+		}
+	}
+	subtotal := details.AmountSubtotal
+	if subtotal == 0 {
+		subtotal = total + discount - tax
+	}
+
+	r.Items = []ReceiptLine{{Label: item, Value: a.formatAmount(currency, subtotal)}}
+	r.Totals = append(r.Totals, ReceiptLine{Label: "Subtotal", Value: a.formatAmount(currency, subtotal)})
+	if discount > 0 {
+		label := "Discount"
+		if charge.Coupon != nil {
+			label += " (" + *charge.Coupon + ")"
+		}
+		r.Totals = append(r.Totals, ReceiptLine{Label: label, Value: "-" + a.formatAmount(currency, discount)})
+	}
+	if tax > 0 {
+		r.Totals = append(r.Totals, ReceiptLine{Label: taxLabel, Value: a.formatAmount(currency, tax)})
+	}
+	r.Totals = append(r.Totals, ReceiptLine{Label: "Amount paid", Value: a.formatAmount(currency, total)})
+	if charge.AmountRefunded != nil && *charge.AmountRefunded > 0 {
+		r.Totals = append(r.Totals, ReceiptLine{Label: "Refunded", Value: "-" + a.formatAmount(currency, int64(*charge.AmountRefunded))})
+	}
+	return r, nil
+}
+
+// formatAmount formats the amount in the smallest currency unit, such as "USD 45.00".
+func (a *Checkout) formatAmount(currency string, amount int64) string {
+	decimals := 2
+	if c := a.blls.Walletbase.Currencies.Get(currency); c != nil {
+		decimals = int(c.Decimals)
+	}
+
+	s := strconv.FormatInt(amount, 10)
+	if decimals > 0 {
+		if len(s) <= decimals {
+			s = strings.Repeat("0", decimals-len(s)+1) + s
+		}
+		s = s[:len(s)-decimals] + "." + s[len(s)-decimals:]
+	}
+	return strings.ToUpper(currency) + " " + s
+}
+
+var receiptTemplate = template.Must(template.New("receipt").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Receipt {{.Number}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; max-width: 640px; margin: 40px auto; color: #222; }
+table { width: 100%; border-collapse: collapse; margin: 16px 0; }
+td { padding: 6px 0; }
+td.value { text-align: right; }
+tr.total td { border-top: 1px solid #ccc; font-weight: bold; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>Receipt</h1>
+<table>
+<tr><td class="muted">Receipt number</td><td class="value">{{.Number}}</td></tr>
+<tr><td class="muted">Date paid</td><td class="value">{{.Date}}</td></tr>
+<tr><td class="muted">Charge ID</td><td class="value">{{.ChargeID}}</td></tr>
+<tr><td class="muted">Payment provider</td><td class="value">{{.Provider}}</td></tr>
+</table>
+<table>
+<tr>
+<td valign="top"><strong>{{.Issuer}}</strong>{{range .IssuerAddress}}<br>{{.}}{{end}}</td>
+<td valign="top" class="value">{{if .BilledTo}}<strong>Billed to</strong>{{range .BilledTo}}<br>{{.}}{{end}}{{end}}</td>
+</tr>
+</table>
+<table>
+{{range .Items}}<tr><td>{{.Label}}</td><td class="value">{{.Value}}</td></tr>
+{{end}}{{range .Totals}}<tr class="total"><td>{{.Label}}</td><td class="value">{{.Value}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes the receipt as a HTML page.
+func (r *Receipt) WriteHTML(w io.Writer) error {
+	return receiptTemplate.Execute(w, r)
+}
+
+// WritePDF writes the receipt as a single page A4 PDF with the standard Helvetica fonts,
+// the characters out of Latin-1 are replaced with "?".
+func (r *Receipt) WritePDF(w io.Writer) error {
+	c := &pdfContent{y: 780}
+	c.text(50, 24, true, "Receipt")
+	c.y -= 16
+	for _, l := range []ReceiptLine{
+		{Label: "Receipt number", Value: r.Number},
+		{Label: "Date paid", Value: r.Date},
+		{Label: "Charge ID", Value: r.ChargeID},
+		{Label: "Payment provider", Value: r.Provider},
+	} {
+		c.row(l, false)
+	}
+
+	c.y -= 16
+	top := c.y
+	c.text(50, 16, true, r.Issuer)
+	for _, s := range r.IssuerAddress {
+		c.text(50, 14, false, s)
+	}
+	if len(r.BilledTo) > 0 {
+		bottom := c.y
+		c.y = top
+		c.text(320, 16, true, "Billed to")
+		for _, s := range r.BilledTo {
+			c.text(320, 14, false, s)
+		}
+		c.y = min(c.y, bottom)
+	}
+
+	c.y -= 16
+	for _, l := range r.Items {
+		c.row(l, false)
+	}
+	for _, l := range r.Totals {
+		c.row(l, true)
+	}
+	return c.writeTo(w)
+}
+
+// pdfContent is the content stream of a PDF page, the lines are laid out from the top.
+type pdfContent struct {
+	buf bytes.Buffer
+	y   int
+}
+
+func (c *pdfContent) text(x, height int, bold bool, s string) {
+	c.y -= height
+	font, size := "F1", 10
+	if bold {
+		font = "F2"
+	}
+	if height > 20 {
+		size = 18
+	}
+	fmt.Fprintf(&c.buf, "BT /%s %d Tf %d %d Td (%s) Tj ET\n", font, size, x, c.y, pdfEscape(s))
+}
+
+func (c *pdfContent) row(l ReceiptLine, bold bool) {
+	c.text(50, 16, bold, l.Label)
+	c.y += 16
+	c.text(400, 16, bold, l.Value)
+}
+
+func (c *pdfContent) writeTo(w io.Writer) error {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", c.buf.Len(), c.buf.String()),
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// pdfEscape escapes the string for a PDF literal string in the WinAnsi encoding.
+func pdfEscape(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b = append(b, '\\', byte(r))
+		case r < 0x20:
+			b = append(b, ' ')
+		case r < 0x7f || (r >= 0xa0 && r <= 0xff):
+			b = append(b, byte(r))
+		default:
+			b = append(b, '?')
+		}
+	}
+	return string(b)
+}
+
+type ReceiptInput struct {
+	ID     util.ID `json:"id" cbor:"id" query:"id"`
+	Format string  `json:"format" cbor:"format" query:"format" validate:"omitempty,oneof=html pdf"`
+}
+
+func (i *ReceiptInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+// Receipt returns the receipt of the completed charge, as a HTML page or a PDF file.
+func (a *Checkout) Receipt(ctx *gear.Context) error {
+	input := &ReceiptInput{}
+	if err := ctx.ParseURL(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	logging.SetTo(ctx, "chargeId", input.ID.String())
+	charge, err := a.blls.Walletbase.GetCharge(ctx, sess.UserID, input.ID, nil)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	// the charges refunded or disputed later were paid, they have receipts too
+	if charge.Txn == nil {
+		return gear.ErrBadRequest.WithMsgf("charge %s is not completed", input.ID.String())
+	}
+
+	receipt, err := a.receipt(ctx, charge)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "receipt", receipt.Number)
+	buf := &bytes.Buffer{}
+	if input.Format == "pdf" {
+		if err = receipt.WritePDF(buf); err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		ctx.Type("application/pdf")
+		ctx.SetHeader(gear.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="receipt-%s.pdf"`, receipt.Number))
+		return ctx.End(200, buf.Bytes())
+	}
+
+	if err = receipt.WriteHTML(buf); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	ctx.Type("text/html; charset=utf-8")
+	return ctx.End(200, buf.Bytes())
+}
@@ -0,0 +1,778 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+type checkoutTestEnv struct {
+	base     *fakeBase
+	provider *fakeProvider
+	blls     *bll.Blls
+	redis    *service.Redis
+	srv      *httptest.Server
+}
+
+func newCheckoutTestEnv(t *testing.T) *checkoutTestEnv {
+	env := &checkoutTestEnv{base: newFakeBase(), provider: newFakeProvider()}
+	t.Cleanup(env.base.Close)
+	t.Cleanup(env.provider.Close)
+
+	cfg := conf.Config.Base
+	t.Cleanup(func() { conf.Config.Base = cfg })
+	conf.Config.Base = conf.Base{
+		Userbase:    env.base.srv.URL,
+		Logbase:     env.base.srv.URL,
+		Taskbase:    env.base.srv.URL,
+		Walletbase:  env.base.srv.URL,
+		Writingbase: env.base.srv.URL,
+	}
+
+	redis := service.NewRedis()
+	env.redis = redis
+	env.blls = bll.NewBlls(redis)
+	if err := env.blls.Walletbase.InitApp(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	providers, err := provider.NewProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers.Register(env.provider)
+	providers.Default = env.provider.Name()
+
+	apis := newAPIs(env.blls, redis, providers)
+	apis.Checkout.packages = []conf.Package{
+		{ID: "p500", Quantity: 500, Bonus: 50, Prices: map[string]string{"fake": "price_p500"}},
+		{ID: "p1000", Quantity: 1000, Bonus: 150, Prices: map[string]string{"alipay": "63000"}},
+	}
+	apis.Subscription.plans = []conf.Plan{
+		{ID: "m1000", Quantity: 1000, Prices: map[string]string{"fake": "price_m1000"}},
+		{ID: "y12000", Quantity: 12000, Prices: map[string]string{"alipay": "756000"}},
+	}
+	apis.Wallet.billables = []conf.Billable{
+		{Kind: "translation", UnitSize: 1000, UnitPrice: 2},
+		{Kind: "rendering", UnitSize: 1, UnitPrice: 1 << 40},
+	}
+	apis.Payout.cfg.Provider = env.provider.Name()
+	// sweeps all the pending charges
+	apis.Reconciler.cfg = conf.Reconciler{}
+	routers := newRouters(apis)
+	routers[0].Post("/v1/webhook/fake", apis.Checkout.Webhook("fake"))
+
+	app := gear.New()
+	app.Set(gear.SetBodyParser, &bodyParser{gear.DefaultBodyParser(2 << 18)})
+	app.Set(gear.SetSender, &sendObject{})
+	app.UseHandler(logging.AccessLogger)
+	for _, router := range routers {
+		app.UseHandler(router)
+	}
+
+	env.srv = httptest.NewServer(app)
+	t.Cleanup(env.srv.Close)
+	env.provider.webhookURL = env.srv.URL + "/v1/webhook/fake"
+	return env
+}
+
+// userCtx returns a context with the auth headers of the user, as the gateway does.
+func userCtx(uid util.ID) context.Context {
+	h := http.Header{}
+	h.Set("x-auth-user", uid.String())
+	h.Set("x-auth-app", util.JARVIS.String())
+	h.Set("x-auth-user-status", "0")
+	h.Set("x-auth-user-rating", "0")
+	h.Set("x-auth-user-kind", "0")
+	h.Set("x-auth-app-scope", scopeRead+","+scopeWrite)
+	return gear.CtxWith[util.CtxHeader](context.Background(), util.Ptr(util.CtxHeader(h)))
+}
+
+func (env *checkoutTestEnv) request(ctx context.Context, method, api string, input, output any) error {
+	return util.RequestJSON(ctx, http.DefaultClient, method, env.srv.URL+api, input, output)
+}
+
+func (env *checkoutTestEnv) checkout(t *testing.T, ctx context.Context, quantity uint) CheckoutOutput {
+	output := bll.SuccessResponse[CheckoutOutput]{}
+	err := env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Quantity: quantity}, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output.Result
+}
+
+func (env *checkoutTestEnv) getCharge(t *testing.T, ctx context.Context, id util.ID) *bll.ChargeOutput {
+	output := bll.SuccessResponse[*bll.ChargeOutput]{}
+	if err := env.request(ctx, http.MethodGet, "/v1/checkout?id="+id.String(), nil, &output); err != nil {
+		t.Fatal(err)
+	}
+	return output.Result
+}
+
+// get sends a GET request with the auth headers, and returns the raw response.
+func (env *checkoutTestEnv) get(t *testing.T, ctx context.Context, api string) (*http.Response, []byte) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, env.srv.URL+api, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CopyHeader(req.Header, util.HeaderFromCtx(ctx))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, body
+}
+
+func TestCheckout(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+
+	t.Run("create and complete", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		cfg := bll.SuccessResponse[CheckoutConfig]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/checkout/config", nil, &cfg))
+		assert.Equal("fake", cfg.Result.Provider)
+		assert.Equal(int64(fakeUnitAmount), cfg.Result.UnitAmount)
+
+		co := env.checkout(t, ctx, 100)
+		assert.Contains(co.PaymentURL, env.provider.srv.URL)
+
+		charge := env.getCharge(t, ctx, co.ID)
+		assert.Equal("fake", charge.Provider)
+		assert.Equal(bll.ChargeStatusPending, charge.Status)
+		assert.Equal(uint(100*fakeUnitAmount), *charge.Amount)
+		assert.Nil(charge.ChargePayload)
+
+		list := bll.SuccessResponse[[]bll.ChargeOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout/list", &bll.Pagination{}, &list))
+		assert.Equal(1, len(list.Result))
+		assert.Equal(co.PaymentURL, *list.Result[0].PaymentURL)
+		assert.Nil(list.Result[0].ChargeID)
+
+		// the user pays, the provider delivers the signed webhook
+		res, err := http.Post(co.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		eventID := res.Header.Get("x-event-id")
+
+		charge = env.getCharge(t, ctx, co.ID)
+		assert.Equal(bll.ChargeStatusCompleted, charge.Status)
+		assert.NotNil(charge.Txn)
+		assert.Equal(int64(100), env.base.Wallet(uid).Topup)
+		assert.Equal(1, env.base.Calls("POST /v1/customer"))
+
+		logs := env.base.Logs()
+		assert.Equal(bll.LogActionUserTopup, logs[len(logs)-1].Action)
+		assert.Equal(uid, logs[len(logs)-1].UID)
+
+		ev, err := env.blls.WebhookEvents.Get(context.Background(), "fake", eventID)
+		assert.NoError(err)
+		assert.Equal("fake", ev.Provider)
+		assert.Equal(bll.WebhookEventSucceeded, ev.Status)
+
+		// a redelivered event is acknowledged without crediting again
+		res, err = env.provider.Send(ev.Payload, time.Now())
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(1, env.base.Calls("POST /v1/charge/complete"))
+		assert.Equal(int64(100), env.base.Wallet(uid).Topup)
+
+		// a stale signature is rejected
+		res, err = env.provider.Send(ev.Payload, time.Now().Add(-time.Hour))
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+		// a replayed event is looked up within its provider
+		admin := util.NewID()
+		admins := conf.Config.Admin.UIDs
+		conf.Config.Admin.UIDs = []string{admin.String()}
+		defer func() { conf.Config.Admin.UIDs = admins }()
+		actx := userCtx(admin)
+		replay := bll.SuccessResponse[*bll.WebhookEvent]{}
+		assert.NoError(env.request(actx, http.MethodPost, "/v1/admin/webhook/replay", &ReplayEventInput{Provider: "fake", ID: eventID}, &replay))
+		assert.Equal(bll.WebhookEventSucceeded, replay.Result.Status)
+		assert.ErrorContains(env.request(actx, http.MethodPost, "/v1/admin/webhook/replay", &ReplayEventInput{Provider: "stripe", ID: eventID}, &replay), "code: 404")
+		assert.ErrorContains(env.request(actx, http.MethodPost, "/v1/admin/webhook/replay", &ReplayEventInput{Provider: "fake", ID: "evt_missing"}, &replay), "code: 404")
+		assert.Equal(1, env.base.Calls("POST /v1/charge/complete"))
+
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout/list", &bll.Pagination{}, &list))
+		assert.Equal(1, len(list.Result))
+		assert.Equal(bll.ChargeStatusCompleted, list.Result[0].Status)
+		assert.Nil(list.Result[0].PaymentURL)
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		cfg := bll.SuccessResponse[CheckoutConfig]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/checkout/config", nil, &cfg))
+		n := env.provider.Calls("GetPrice")
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/checkout/config", nil, &cfg))
+		assert.Equal(int64(fakeUnitAmount), cfg.Result.UnitAmount)
+		assert.Equal(n, env.provider.Calls("GetPrice"))
+
+		co := env.checkout(t, ctx, 100)
+		n = env.provider.Calls("GetSession")
+		list := bll.SuccessResponse[[]bll.ChargeOutput]{}
+		for i := 0; i < 3; i++ {
+			assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout/list", &bll.Pagination{}, &list))
+			assert.Equal(co.PaymentURL, *list.Result[0].PaymentURL)
+		}
+		assert.Equal(n, env.provider.Calls("GetSession"))
+
+		// the webhook invalidates the cached session
+		charge := env.getCharge(t, ctx, co.ID)
+		ok, err := env.redis.Exists(ctx, sessionCacheKey(*charge.ChargeID))
+		assert.NoError(err)
+		assert.True(ok)
+		res, err := http.Post(co.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		ok, err = env.redis.Exists(ctx, sessionCacheKey(*charge.ChargeID))
+		assert.NoError(err)
+		assert.False(ok)
+	})
+
+	t.Run("receipt", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		co := env.checkout(t, ctx, 1000)
+		res, _ := env.get(t, ctx, "/v1/checkout/receipt?id="+co.ID.String())
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+		res, err := http.Post(co.PaymentURL+"?country=DE", "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+
+		res, body := env.get(t, ctx, "/v1/checkout/receipt?id="+co.ID.String())
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Contains(res.Header.Get(gear.HeaderContentType), "text/html")
+		html := string(body)
+		assert.Contains(html, "tester@yiwen.ai")
+		assert.Contains(html, "1 Main St")
+		assert.Contains(html, "USD 100.00") // subtotal
+		assert.Contains(html, "Tax (DE)")
+		assert.Contains(html, "USD 20.00")  // tax
+		assert.Contains(html, "USD 120.00") // paid
+
+		n, err := env.blls.Receipts.Number(ctx, co.ID)
+		assert.NoError(err)
+		number := fmt.Sprintf("YW-%06d", n)
+		assert.Contains(html, number)
+
+		// the number is kept, the next receipt gets the next number
+		res, body = env.get(t, ctx, "/v1/checkout/receipt?id="+co.ID.String()+"&format=pdf")
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal("application/pdf", res.Header.Get(gear.HeaderContentType))
+		assert.Contains(res.Header.Get(gear.HeaderContentDisposition), number)
+		assert.True(strings.HasPrefix(string(body), "%PDF-1.4"))
+		assert.True(strings.HasSuffix(string(body), "%%EOF\n"))
+		assert.Contains(string(body), "("+number+")")
+		assert.Contains(string(body), "(USD 120.00)")
+
+		co2 := env.checkout(t, ctx, 100)
+		res, err = http.Post(co2.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		res, body = env.get(t, ctx, "/v1/checkout/receipt?id="+co2.ID.String())
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Contains(string(body), fmt.Sprintf("YW-%06d", n+1))
+
+		// the charges of others have no receipts
+		res, _ = env.get(t, userCtx(util.NewID()), "/v1/checkout/receipt?id="+co.ID.String())
+		assert.NotEqual(http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("gift", func(t *testing.T) {
+		assert := assert.New(t)
+		buyer, recipient := util.NewID(), util.NewID()
+		ctx := userCtx(buyer)
+
+		output := bll.SuccessResponse[CheckoutOutput]{}
+		input := &CheckoutInput{Quantity: 100, Recipient: util.Ptr(buyer)}
+		assert.Error(env.request(ctx, http.MethodPost, "/v1/checkout", input, &output))
+		input = &CheckoutInput{Quantity: 100, Message: util.Ptr("enjoy")}
+		assert.Error(env.request(ctx, http.MethodPost, "/v1/checkout", input, &output))
+		missing := util.NewID()
+		env.base.SetUser(missing, nil)
+		input = &CheckoutInput{Quantity: 100, Recipient: util.Ptr(missing)}
+		assert.Error(env.request(ctx, http.MethodPost, "/v1/checkout", input, &output))
+		disabled := util.NewID()
+		env.base.SetUser(disabled, &bll.UserInfo{ID: util.Ptr(disabled), Status: -1})
+		input = &CheckoutInput{Quantity: 100, Recipient: util.Ptr(disabled)}
+		assert.Error(env.request(ctx, http.MethodPost, "/v1/checkout", input, &output))
+
+		input = &CheckoutInput{Quantity: 100, Recipient: util.Ptr(recipient), Message: util.Ptr("enjoy")}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout", input, &output))
+		res, err := http.Post(output.Result.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+
+		// the recipient is credited, the buyer owns the charge
+		assert.Equal(int64(100), env.base.Wallet(recipient).Topup)
+		assert.Equal(int64(0), env.base.Wallet(buyer).Topup)
+		charge := env.getCharge(t, ctx, output.Result.ID)
+		assert.Equal(bll.ChargeStatusCompleted, charge.Status)
+		assert.Equal(recipient, *charge.Recipient)
+		assert.Equal("enjoy", *charge.GiftMessage)
+
+		gifts := bll.SuccessResponse[[]bll.GiftOutput]{}
+		assert.NoError(env.request(userCtx(recipient), http.MethodPost, "/v1/checkout/gift/list", &bll.Pagination{}, &gifts))
+		assert.Equal(1, len(gifts.Result))
+		assert.Equal(buyer, gifts.Result[0].UID)
+		assert.Equal("Tester", gifts.Result[0].UIDInfo.Name)
+		assert.Equal(output.Result.ID, gifts.Result[0].ID)
+		assert.Equal("enjoy", *gifts.Result[0].GiftMessage)
+		assert.Nil(gifts.Result[0].Amount)
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout/gift/list", &bll.Pagination{}, &gifts))
+		assert.Equal(0, len(gifts.Result))
+
+		logs := env.base.Logs()
+		log := logs[len(logs)-1]
+		assert.Equal(bll.LogActionUserGift, log.Action)
+		assert.Equal(buyer, log.UID)
+		assert.Equal(recipient, log.GID)
+		payload := &bll.Payload{}
+		assert.NoError(cbor.Unmarshal(log.Payload, payload))
+		assert.Equal(buyer, payload.Payer)
+		assert.Equal(recipient, *payload.Payee)
+		assert.Equal("enjoy", payload.Message)
+
+		refund := bll.SuccessResponse[*bll.ChargeOutput]{}
+		assert.Error(env.request(ctx, http.MethodPost, "/v1/checkout/refund", &RefundInput{ID: output.Result.ID}, &refund))
+	})
+
+	t.Run("provider", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx := userCtx(util.NewID())
+
+		output := bll.SuccessResponse[CheckoutOutput]{}
+		err := env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Quantity: 100, Provider: util.Ptr("unknown")}, &output)
+		assert.Equal(http.StatusBadRequest, gear.Err.From(err).Code)
+
+		err = env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Quantity: 100, Provider: util.Ptr("fake")}, &output)
+		assert.NoError(err)
+		assert.Contains(output.Result.PaymentURL, env.provider.srv.URL)
+	})
+
+	t.Run("customer", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		portal := bll.SuccessResponse[PortalOutput]{}
+		err := env.request(ctx, http.MethodPost, "/v1/checkout/portal", &PortalInput{}, &portal)
+		assert.Equal(http.StatusNotFound, gear.Err.From(err).Code)
+
+		co := env.checkout(t, ctx, 100)
+		res, err := http.Post(co.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout/portal", &PortalInput{}, &portal))
+		assert.Equal(env.provider.srv.URL+"/portal/cus_"+uid.String(), portal.Result.URL)
+
+		methods := bll.SuccessResponse[[]PaymentMethodOutput]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/checkout/payment_methods", nil, &methods))
+		assert.Equal(1, len(methods.Result))
+		assert.Equal("card", methods.Result[0].Type)
+		assert.Equal("4242", methods.Result[0].Last4)
+
+		// the returning user checks out with the saved customer
+		co = env.checkout(t, ctx, 100)
+		charge := env.getCharge(t, ctx, co.ID)
+		cs, err := env.provider.GetSession(ctx, *charge.ChargeID)
+		assert.NoError(err)
+		assert.Equal("cus_"+uid.String(), cs.Customer)
+	})
+
+	t.Run("package", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		pkgs := bll.SuccessResponse[[]CheckoutPackage]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/checkout/packages", nil, &pkgs))
+		assert.Equal([]CheckoutPackage{{ID: "p500", Quantity: 500, Bonus: 50, Amount: 4500, Currency: "usd"}}, pkgs.Result)
+
+		output := bll.SuccessResponse[CheckoutOutput]{}
+		err := env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Package: util.Ptr("p1000")}, &output)
+		assert.Equal(http.StatusBadRequest, gear.Err.From(err).Code)
+		err = env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Package: util.Ptr("p0")}, &output)
+		assert.Equal(http.StatusNotFound, gear.Err.From(err).Code)
+		err = env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{}, &output)
+		assert.Equal(http.StatusBadRequest, gear.Err.From(err).Code)
+
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Package: util.Ptr("p500")}, &output))
+		charge := env.getCharge(t, ctx, output.Result.ID)
+		assert.Equal(uint(500), charge.Quantity)
+		assert.Equal(uint(50), *charge.Award)
+		assert.Equal(uint(4500), *charge.Amount)
+
+		res, err := http.Post(output.Result.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+
+		wallet := env.base.Wallet(uid)
+		assert.Equal(int64(500), wallet.Topup)
+		assert.Equal(int64(50), wallet.Award)
+
+		// the bonus is clawed back in proportion to the refunded credits
+		refund := bll.SuccessResponse[*bll.ChargeOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout/refund", &RefundInput{ID: output.Result.ID, Quantity: util.Ptr(uint(100))}, &refund))
+		assert.Equal(uint(900), *refund.Result.AmountRefunded)
+		wallet = env.base.Wallet(uid)
+		assert.Equal(int64(400), wallet.Topup)
+		assert.Equal(int64(40), wallet.Award)
+
+		// the spent bonus can not be refunded
+		env.base.AddAward(uid, -35)
+		err = env.request(ctx, http.MethodPost, "/v1/checkout/refund", &RefundInput{ID: output.Result.ID}, &refund)
+		assert.ErrorContains(err, "code: 400")
+		assert.Equal(int64(400), env.base.Wallet(uid).Topup)
+
+		env.base.AddAward(uid, 35)
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout/refund", &RefundInput{ID: output.Result.ID}, &refund))
+		assert.Equal(bll.ChargeStatusRefunded, refund.Result.Status)
+		wallet = env.base.Wallet(uid)
+		assert.Equal(int64(0), wallet.Topup)
+		assert.Equal(int64(0), wallet.Award)
+	})
+
+	t.Run("coupon", func(t *testing.T) {
+		assert := assert.New(t)
+		admin := util.NewID()
+		admins := conf.Config.Admin.UIDs
+		conf.Config.Admin.UIDs = []string{admin.String()}
+		defer func() { conf.Config.Admin.UIDs = admins }()
+
+		uid1, uid2, uid3 := util.NewID(), util.NewID(), util.NewID()
+		ctx1, ctx2, ctx3 := userCtx(uid1), userCtx(uid2), userCtx(uid3)
+		coupon := &bll.Coupon{
+			Code:           "t" + uid1.String(),
+			Discounts:      map[string]string{"fake": "coupon_10"},
+			MaxRedemptions: 2,
+			PerUser:        1,
+			ExpiresAt:      time.Now().Add(time.Hour).Unix(),
+		}
+		output := bll.SuccessResponse[*bll.Coupon]{}
+		err := env.request(ctx1, http.MethodPost, "/v1/admin/coupon", coupon, &output)
+		assert.Equal(http.StatusForbidden, gear.Err.From(err).Code)
+		assert.NoError(env.request(userCtx(admin), http.MethodPost, "/v1/admin/coupon", coupon, &output))
+		code := output.Result.Code
+		assert.Equal(strings.ToUpper(coupon.Code), code)
+
+		checkout := func(ctx context.Context) (CheckoutOutput, error) {
+			output := bll.SuccessResponse[CheckoutOutput]{}
+			err := env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Quantity: 100, Coupon: &coupon.Code}, &output)
+			return output.Result, err
+		}
+
+		co, err := checkout(ctx1)
+		assert.NoError(err)
+		charge := env.getCharge(t, ctx1, co.ID)
+		assert.Equal(code, *charge.Coupon)
+		assert.Equal(uint(100), *charge.AmountDiscount)
+		assert.Equal(uint(900), *charge.Amount)
+
+		_, err = checkout(ctx1)
+		assert.Equal(http.StatusBadRequest, gear.Err.From(err).Code)
+
+		// the redemption is given back when the checkout expires
+		res, err := http.Post(env.provider.srv.URL+"/expire/"+*charge.ChargeID, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		co, err = checkout(ctx1)
+		assert.NoError(err)
+
+		_, err = checkout(ctx2)
+		assert.NoError(err)
+		_, err = checkout(ctx3)
+		assert.Equal(http.StatusBadRequest, gear.Err.From(err).Code)
+		assert.NoError(env.request(userCtx(admin), http.MethodGet, "/v1/admin/coupon?code="+code, nil, &output))
+		assert.Equal(uint(2), output.Result.Redeemed)
+
+		res, err = http.Post(co.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(int64(100), env.base.Wallet(uid1).Topup)
+		logs := env.base.Logs()
+		payload := &bll.Payload{}
+		assert.NoError(cbor.Unmarshal(logs[len(logs)-1].Payload, payload))
+		assert.Equal(code, payload.Coupon)
+		assert.Equal(int64(100), payload.Discount)
+
+		// expired
+		coupon.ExpiresAt = time.Now().Add(-time.Second).Unix()
+		coupon.MaxRedemptions = 0
+		assert.NoError(env.request(userCtx(admin), http.MethodPost, "/v1/admin/coupon", coupon, &output))
+		_, err = checkout(ctx3)
+		assert.Equal(http.StatusBadRequest, gear.Err.From(err).Code)
+	})
+
+	t.Run("delayed payment", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		co := env.checkout(t, ctx, 50)
+		res, err := http.Post(co.PaymentURL+"?delayed=1", "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+
+		charge := env.getCharge(t, ctx, co.ID)
+		assert.Equal(bll.ChargeStatusProcessing, charge.Status)
+		assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+
+		// the payment settles
+		res, err = http.Post(co.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+
+		charge = env.getCharge(t, ctx, co.ID)
+		assert.Equal(bll.ChargeStatusCompleted, charge.Status)
+		assert.Equal(int64(50), env.base.Wallet(uid).Topup)
+	})
+
+	t.Run("delayed payment failed", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		co := env.checkout(t, ctx, 50)
+		res, err := http.Post(co.PaymentURL+"?delayed=1", "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		charge := env.getCharge(t, ctx, co.ID)
+		assert.Equal(bll.ChargeStatusProcessing, charge.Status)
+
+		res, err = http.Post(env.provider.srv.URL+"/fail/"+*charge.ChargeID, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		charge = env.getCharge(t, ctx, co.ID)
+		assert.Equal(bll.ChargeStatusFailed, charge.Status)
+		assert.Equal("checkout.async_payment_failed", *charge.FailureCode)
+		assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+
+		// the unpaid completed event arriving late does not revive the charge
+		res, err = http.Post(co.PaymentURL+"?delayed=1", "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(bll.ChargeStatusFailed, env.getCharge(t, ctx, co.ID).Status)
+	})
+
+	t.Run("delayed payment out of order", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		co := env.checkout(t, ctx, 50)
+		res, err := http.Post(co.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		charge := env.getCharge(t, ctx, co.ID)
+		assert.Equal(bll.ChargeStatusCompleted, charge.Status)
+
+		// the unpaid completed event arrives after the payment succeeded
+		res, err = http.Post(co.PaymentURL+"?delayed=1", "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+
+		// so does a failed event, neither downgrades the charge
+		res, err = http.Post(env.provider.srv.URL+"/fail/"+*charge.ChargeID, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+
+		charge = env.getCharge(t, ctx, co.ID)
+		assert.Equal(bll.ChargeStatusCompleted, charge.Status)
+		assert.Equal(int64(50), env.base.Wallet(uid).Topup)
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		co := env.checkout(t, ctx, 60)
+		charge := env.getCharge(t, ctx, co.ID)
+		res, err := http.Post(env.provider.srv.URL+"/expire/"+*charge.ChargeID, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+
+		charge = env.getCharge(t, ctx, co.ID)
+		assert.Equal(bll.ChargeStatusFailed, charge.Status)
+		assert.Equal("checkout.expired", *charge.FailureCode)
+		assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+
+		// paying an expired session does not credit the wallet
+		res, err = http.Post(co.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusConflict, res.StatusCode)
+		assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+	})
+
+	t.Run("refund webhook", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		co := env.checkout(t, ctx, 100)
+		res, err := http.Post(co.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		charge := env.getCharge(t, ctx, co.ID)
+		env.base.AddTopup(uid, -80)
+
+		refund := func(amount int) {
+			res, err := http.Post(fmt.Sprintf("%s/refund/%s?amount=%d", env.provider.srv.URL, *charge.ChargeID, amount), "", nil)
+			assert.NoError(err)
+			res.Body.Close()
+			assert.Equal(http.StatusOK, res.StatusCode)
+		}
+
+		// 50 credits are refunded, 20 are debited and the wallet is frozen for the rest
+		refund(500)
+		assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+		assert.Equal(int64(30), env.base.Frozen(uid))
+		got := env.getCharge(t, ctx, co.ID)
+		assert.Equal(uint(500), *got.AmountRefunded)
+		assert.Equal("wallet.frozen", *got.FailureCode)
+
+		// the redelivered refund does not freeze the wallet again
+		refund(0)
+		assert.Equal(int64(30), env.base.Frozen(uid))
+		assert.Equal(uint(500), *env.getCharge(t, ctx, co.ID).AmountRefunded)
+
+		// the later refund freezes the wallet for its own credits
+		refund(200)
+		assert.Equal(int64(50), env.base.Frozen(uid))
+		got = env.getCharge(t, ctx, co.ID)
+		assert.Equal(uint(700), *got.AmountRefunded)
+		assert.Equal(bll.ChargeStatusCompleted, got.Status)
+	})
+
+	t.Run("refund gift", func(t *testing.T) {
+		assert := assert.New(t)
+		buyer, recipient := util.NewID(), util.NewID()
+		ctx := userCtx(buyer)
+
+		output := bll.SuccessResponse[CheckoutOutput]{}
+		input := &CheckoutInput{Quantity: 100, Recipient: util.Ptr(recipient)}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout", input, &output))
+		res, err := http.Post(output.Result.PaymentURL, "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		charge := env.getCharge(t, ctx, output.Result.ID)
+		env.base.AddTopup(buyer, 100)
+		env.base.AddTopup(recipient, -40)
+
+		// the credits are clawed back from the recipient, who is frozen for the spent credits
+		res, err = http.Post(fmt.Sprintf("%s/refund/%s?amount=1000", env.provider.srv.URL, *charge.ChargeID), "", nil)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(int64(0), env.base.Wallet(recipient).Topup)
+		assert.Equal(int64(40), env.base.Frozen(recipient))
+		assert.Equal(int64(100), env.base.Wallet(buyer).Topup)
+		assert.Equal(int64(0), env.base.Frozen(buyer))
+		assert.Equal(bll.ChargeStatusRefunded, env.getCharge(t, ctx, output.Result.ID).Status)
+
+		logs := env.base.Logs()
+		for _, log := range logs[len(logs)-2:] {
+			assert.Equal(buyer, log.UID)
+			assert.Equal(recipient, log.GID)
+			payload := &bll.Payload{}
+			assert.NoError(cbor.Unmarshal(log.Payload, payload))
+			assert.Equal(buyer, payload.Payer)
+			assert.Equal(recipient, *payload.Payee)
+		}
+		assert.Equal(bll.LogActionSysFreezeWallet, logs[len(logs)-2].Action)
+		assert.Equal(bll.LogActionSysRefundCharge, logs[len(logs)-1].Action)
+	})
+
+	t.Run("dispute webhook", func(t *testing.T) {
+		assert := assert.New(t)
+
+		dispute := func(sid, status string) {
+			res, err := http.Post(fmt.Sprintf("%s/dispute/%s?status=%s", env.provider.srv.URL, sid, status), "", nil)
+			assert.NoError(err)
+			res.Body.Close()
+			assert.Equal(http.StatusOK, res.StatusCode)
+		}
+
+		for _, outcome := range []string{"won", "lost"} {
+			uid := util.NewID()
+			ctx := userCtx(uid)
+
+			co := env.checkout(t, ctx, 100)
+			res, err := http.Post(co.PaymentURL, "", nil)
+			assert.NoError(err)
+			res.Body.Close()
+			charge := env.getCharge(t, ctx, co.ID)
+			env.base.AddTopup(uid, -80)
+
+			// the disputed credits are clawed back, 20 are debited and the wallet is frozen for the rest
+			dispute(*charge.ChargeID, "needs_response")
+			assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+			assert.Equal(int64(80), env.base.Frozen(uid))
+			got := env.getCharge(t, ctx, co.ID)
+			assert.Equal(bll.ChargeStatusDisputed, got.Status)
+			assert.Equal("dispute.fraudulent", *got.FailureCode)
+			assert.Equal("needs_response", *got.FailureMsg)
+			logs := env.base.Logs()
+			assert.Equal(bll.LogActionSysDisputeCharge, logs[len(logs)-1].Action)
+
+			// the redelivered dispute does not claw back again
+			dispute(*charge.ChargeID, "needs_response")
+			assert.Equal(int64(80), env.base.Frozen(uid))
+
+			// the outcome is recorded, the credits clawed back are left for manual review
+			dispute(*charge.ChargeID, outcome)
+			got = env.getCharge(t, ctx, co.ID)
+			assert.Equal(bll.ChargeStatusDisputed, got.Status)
+			assert.Equal("dispute.fraudulent", *got.FailureCode)
+			assert.Equal(outcome, *got.FailureMsg)
+			assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+			assert.Equal(int64(80), env.base.Frozen(uid))
+		}
+	})
+}
@@ -0,0 +1,743 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Webhook returns the webhook handler of the payment provider.
+// The provider events are normalized to provider.EventKind, see the provider for the event types.
+func (a *Checkout) Webhook(name string) gear.Middleware {
+	return func(ctx *gear.Context) error {
+		p, err := a.providers.Get(name)
+		if err != nil {
+			return err
+		}
+
+		b, err := io.ReadAll(ctx.Req.Body)
+		if err != nil {
+			return gear.ErrBadRequest.WithMsgf("read body failed: %v", err)
+		}
+
+		event, err := p.VerifyWebhook(ctx, b, ctx.Req.Header)
+		if err != nil {
+			logging.SetTo(ctx, "error", err.Error())
+			return ctx.Error(err)
+		}
+
+		logEvent(ctx, event)
+		if err = a.processEvent(ctx, p, event, b); err != nil {
+			logging.SetTo(ctx, "error", err.Error())
+			return ctx.Error(err)
+		}
+		if acker, ok := p.(provider.WebhookAcker); ok {
+			ctx.Type(gear.MIMETextPlainCharsetUTF8)
+			return ctx.End(http.StatusOK, []byte(acker.WebhookAck()))
+		}
+		return ctx.OkJSON(bll.SuccessResponse[bool]{Result: true})
+	}
+}
+
+// processEvent journals and handles a verified event. Providers may deliver an event
+// more than once, or concurrently, a succeeded event will not be handled again.
+func (a *Checkout) processEvent(ctx *gear.Context, p provider.Provider, event *provider.Event, payload []byte) error {
+	key := p.Name() + "_event:" + event.ID
+	if err := a.lockEvent(ctx, key); err != nil {
+		return err
+	}
+	defer a.redis.Unlock(middleware.WithGlobalCtx(ctx), key)
+
+	ev, err := a.blls.WebhookEvents.Get(ctx, p.Name(), event.ID)
+	switch {
+	case util.IsNotFoundErr(err):
+		ev = &bll.WebhookEvent{
+			ID:        event.ID,
+			Provider:  p.Name(),
+			Type:      event.Type,
+			CreatedAt: time.Now().Unix(),
+			Payload:   util.Bytes(payload),
+		}
+	case err != nil:
+		return err
+	case ev.Status == bll.WebhookEventSucceeded:
+		logging.SetTo(ctx, "msg", "duplicate event")
+		return nil
+	}
+
+	ev.Status = bll.WebhookEventProcessing
+	ev.Attempts += 1
+	ev.UpdatedAt = time.Now().Unix()
+	if err = a.blls.WebhookEvents.Save(ctx, ev); err != nil {
+		return err
+	}
+
+	err = a.handleEvent(ctx, p, event)
+	ev.UpdatedAt = time.Now().Unix()
+	ev.Status = bll.WebhookEventSucceeded
+	ev.Error = ""
+	if err != nil {
+		ev.Status = bll.WebhookEventFailed
+		ev.Error = err.Error()
+	}
+	if er := a.blls.WebhookEvents.Save(middleware.WithGlobalCtx(ctx), ev); er != nil {
+		logging.SetTo(ctx, "saveEventError", er.Error())
+	}
+	return err
+}
+
+func (a *Checkout) handleEvent(ctx *gear.Context, p provider.Provider, event *provider.Event) error {
+	if event.Kind == provider.EventUnknown {
+		logging.SetTo(ctx, "msg", "unknown event type")
+		return nil
+	}
+
+	logging.SetTo(ctx, "uid", event.UID)
+	logging.SetTo(ctx, "chargeId", event.ChargeID)
+	if event.SubscriptionID != util.ZeroID {
+		logging.SetTo(ctx, "subscriptionId", event.SubscriptionID)
+	}
+	if event.PayoutID != util.ZeroID {
+		logging.SetTo(ctx, "payoutId", event.PayoutID)
+	}
+	withSystemSession(ctx, event.UID)
+	if event.Session != nil {
+		a.invalidateSession(ctx, event.Session.ID)
+	}
+
+	switch event.Kind {
+	case provider.EventSessionCompleted:
+		return a.completeSession(ctx, event)
+	case provider.EventSessionFailed:
+		return a.failSession(ctx, event)
+	case provider.EventSessionExpired:
+		return a.expireSession(ctx, event)
+	case provider.EventChargeRefunded:
+		return a.refundCharge(ctx, event)
+	case provider.EventDisputeCreated:
+		return a.disputeCharge(ctx, event)
+	case provider.EventDisputeClosed:
+		return a.closeDispute(ctx, event)
+	case provider.EventSubscriptionCreated:
+		return a.activateSubscription(ctx, event)
+	case provider.EventInvoicePaid:
+		return a.renewSubscription(ctx, event)
+	case provider.EventSubscriptionDeleted:
+		return a.deleteSubscription(ctx, event)
+	case provider.EventPayoutPaid:
+		return a.completePayout(ctx, event)
+	case provider.EventPayoutFailed:
+		return a.failPayout(ctx, p, event)
+	}
+	return nil
+}
+
+// lockEvent waits for the lock of the event, so that concurrent deliveries
+// of the same event are processed one by one.
+func (a *Checkout) lockEvent(ctx *gear.Context, key string) error {
+	for i := 0; i < 50; i++ {
+		ok, err := a.redis.Lock(ctx, key, 60)
+		if err != nil || ok {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	return gear.ErrConflict.WithMsgf("event %s is being processed", key)
+}
+
+func (a *Checkout) ListFailedEvents(ctx *gear.Context) error {
+	input := &bll.Pagination{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	output, err := a.blls.WebhookEvents.ListFailed(ctx, input)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	return ctx.OkSend(output)
+}
+
+type ReplayEventInput struct {
+	Provider string `json:"provider" cbor:"provider" validate:"required"`
+	ID       string `json:"id" cbor:"id" validate:"required"`
+}
+
+func (i *ReplayEventInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+// ReplayEvent handles a journaled event again, it is a no-op for succeeded events.
+func (a *Checkout) ReplayEvent(ctx *gear.Context) error {
+	input := &ReplayEventInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	ev, err := a.blls.WebhookEvents.Get(ctx, input.Provider, input.ID)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return gear.ErrNotFound.WithMsgf("event %s of %s not found", input.ID, input.Provider)
+		}
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	p, err := a.providers.Get(ev.Provider)
+	if err != nil {
+		return err
+	}
+
+	event, err := p.ParseEvent(ctx, ev.Payload)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logEvent(ctx, event)
+	logging.SetTo(ctx, "replay", true)
+	if err = a.processEvent(ctx, p, event, ev.Payload); err != nil {
+		logging.SetTo(ctx, "error", err.Error())
+		return ctx.Error(err)
+	}
+
+	if ev, err = a.blls.WebhookEvents.Get(ctx, input.Provider, input.ID); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return ctx.OkSend(bll.SuccessResponse[*bll.WebhookEvent]{Result: ev})
+}
+
+func (a *Checkout) completeSession(ctx *gear.Context, event *provider.Event) error {
+	cs := event.Session
+	logging.SetTo(ctx, "paid", cs.Paid)
+	if !cs.Paid {
+		charge, err := a.blls.Walletbase.GetCharge(ctx, event.UID, event.ChargeID, nil)
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		// the event arrived after the payment succeeded or failed, it is out of date
+		if charge.Status != bll.ChargeStatusPending {
+			logging.SetTo(ctx, "chargeStatus", charge.Status)
+			logging.SetTo(ctx, "msg", "event out of date")
+			return nil
+		}
+
+		// delayed payment methods, such as bank debits, will be completed or failed later
+		_, err = a.blls.Walletbase.UpdateCharge(ctx, &bll.UpdateChargeInput{
+			UID:           event.UID,
+			ID:            event.ChargeID,
+			CurrentStatus: bll.ChargeStatusPending,
+			Status:        bll.ChargeStatusProcessing,
+			ChargePayload: util.Ptr(cs.Payload),
+		})
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		return nil
+	}
+
+	input := &bll.CompleteChargeInput{
+		UID:           event.UID,
+		ID:            event.ChargeID,
+		Currency:      cs.Currency,
+		Amount:        uint(cs.AmountTotal),
+		ChargeID:      cs.ID,
+		ChargePayload: cs.Payload,
+	}
+	if cs.AmountTax > 0 {
+		input.AmountTax = util.Ptr(uint(cs.AmountTax))
+		input.TaxJurisdiction = util.Ptr(cs.TaxJurisdiction)
+		logging.SetTo(ctx, "taxJurisdiction", cs.TaxJurisdiction)
+	}
+	charge, err := a.blls.Walletbase.CompleteCharge(ctx, input)
+
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if cs.Customer != "" && cs.CustomerDetails != nil {
+		_, err = a.blls.Walletbase.UpsertCustomer(ctx, &bll.CustomerInput{
+			UID:      event.UID,
+			Provider: charge.Provider,
+			Customer: cs.Customer,
+			Payload:  cs.CustomerDetails,
+		})
+		if err != nil {
+			logging.SetTo(ctx, "upsertCustomerError", err.Error())
+		} else {
+			logging.SetTo(ctx, "customer", cs.Customer)
+		}
+	}
+
+	payload := &bll.Payload{
+		Kind:   "charge",
+		ID:     charge.ID,
+		Amount: int64(charge.Quantity),
+	}
+	if charge.Coupon != nil {
+		payload.Coupon = *charge.Coupon
+	}
+	if charge.AmountDiscount != nil {
+		payload.Discount = int64(*charge.AmountDiscount)
+	}
+	action, gid := bll.LogActionUserTopup, event.UID
+	if charge.Recipient != nil {
+		// the log of a gift links the buyer and the recipient
+		action, gid = bll.LogActionUserGift, *charge.Recipient
+		payload.Payer = event.UID
+		payload.Payee = charge.Recipient
+		if charge.GiftMessage != nil {
+			payload.Message = *charge.GiftMessage
+		}
+	}
+	if _, err = a.blls.Logbase.Log(ctx, action, 1, gid, payload); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	return nil
+}
+
+func (a *Checkout) expireSession(ctx *gear.Context, event *provider.Event) error {
+	charge, err := a.blls.Walletbase.UpdateCharge(ctx, &bll.UpdateChargeInput{
+		UID:           event.UID,
+		ID:            event.ChargeID,
+		CurrentStatus: bll.ChargeStatusPending,
+		Status:        bll.ChargeStatusFailed,
+		FailureCode:   util.Ptr("checkout.expired"),
+		FailureMsg:    util.Ptr("checkout.expired"),
+	})
+
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.releaseCoupon(ctx, event.UID, charge.Coupon)
+	return nil
+}
+
+func (a *Checkout) failSession(ctx *gear.Context, event *provider.Event) error {
+	charge, err := a.blls.Walletbase.GetCharge(ctx, event.UID, event.ChargeID, nil)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	// the failed event may arrive before the completed one, but never fails a settled charge
+	if charge.Status != bll.ChargeStatusPending && charge.Status != bll.ChargeStatusProcessing {
+		logging.SetTo(ctx, "chargeStatus", charge.Status)
+		logging.SetTo(ctx, "msg", "event out of date")
+		return nil
+	}
+
+	charge, err = a.blls.Walletbase.UpdateCharge(ctx, &bll.UpdateChargeInput{
+		UID:           event.UID,
+		ID:            event.ChargeID,
+		CurrentStatus: charge.Status,
+		Status:        bll.ChargeStatusFailed,
+		ChargePayload: util.Ptr(event.Session.Payload),
+		FailureCode:   util.Ptr("checkout.async_payment_failed"),
+		FailureMsg:    util.Ptr("checkout.async_payment_failed"),
+	})
+
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.releaseCoupon(ctx, event.UID, charge.Coupon)
+	return nil
+}
+
+func (a *Checkout) refundCharge(ctx *gear.Context, event *provider.Event) error {
+	charge, err := a.blls.Walletbase.GetCharge(ctx, event.UID, event.ChargeID, nil)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	refunded := uint(0)
+	if charge.AmountRefunded != nil {
+		refunded = *charge.AmountRefunded
+	}
+	// refunds created by Checkout.Refund have been recorded
+	if uint(event.Refund.AmountRefunded) <= refunded {
+		logging.SetTo(ctx, "msg", "refund recorded")
+		return nil
+	}
+
+	amount := uint(event.Refund.AmountRefunded) - refunded
+	quantity := charge.RefundQuantity(amount)
+	logging.SetTo(ctx, "refundId", event.Refund.ID)
+
+	output, err := a.clawback(ctx, charge, quantity, amount, event.Refund.ID, event.Payload)
+	if err != nil {
+		return err
+	}
+
+	gid, payload := clawbackLog(output, event.UID, int64(quantity))
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionSysRefundCharge, 1, gid, payload); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	return nil
+}
+
+func (a *Checkout) disputeCharge(ctx *gear.Context, event *provider.Event) error {
+	dp := event.Dispute
+	charge, err := a.blls.Walletbase.GetCharge(ctx, event.UID, event.ChargeID, nil)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if charge.Status == bll.ChargeStatusDisputed {
+		logging.SetTo(ctx, "msg", "dispute recorded")
+		return nil
+	}
+
+	quantity := charge.RefundQuantity(uint(dp.Amount))
+	output, err := a.clawback(ctx, charge, quantity, uint(dp.Amount), dp.ID, dp.Payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.blls.Walletbase.UpdateCharge(ctx, &bll.UpdateChargeInput{
+		UID:           event.UID,
+		ID:            event.ChargeID,
+		CurrentStatus: output.Status,
+		Status:        bll.ChargeStatusDisputed,
+		FailureCode:   util.Ptr("dispute." + dp.Reason),
+		FailureMsg:    util.Ptr(dp.Status),
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	gid, payload := clawbackLog(charge, event.UID, int64(quantity))
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionSysDisputeCharge, 1, gid, payload); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	return nil
+}
+
+func (a *Checkout) closeDispute(ctx *gear.Context, event *provider.Event) error {
+	dp := event.Dispute
+	logging.SetTo(ctx, "disputeStatus", dp.Status)
+
+	// credits clawed back are not reinstated automatically when the dispute is won,
+	// the outcome is recorded for manual review.
+	_, err := a.blls.Walletbase.UpdateCharge(ctx, &bll.UpdateChargeInput{
+		UID:           event.UID,
+		ID:            event.ChargeID,
+		CurrentStatus: bll.ChargeStatusDisputed,
+		Status:        bll.ChargeStatusDisputed,
+		FailureCode:   util.Ptr("dispute." + dp.Reason),
+		FailureMsg:    util.Ptr(dp.Status),
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionSysDisputeCharge, 1, event.UID, &bll.Payload{
+		Kind:  "charge",
+		ID:    event.ChargeID,
+		Payer: event.UID,
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	return nil
+}
+
+// activateSubscription activates the subscription whose subscription session completed,
+// the credits are topped up by the paid invoices.
+func (a *Checkout) activateSubscription(ctx *gear.Context, event *provider.Event) error {
+	update := &bll.UpdateSubscriptionInput{
+		UID:    event.UID,
+		ID:     event.SubscriptionID,
+		Status: util.Ptr(bll.SubscriptionStatusActive),
+	}
+	if event.Subscription.ID != "" {
+		update.SubscriptionID = util.Ptr(event.Subscription.ID)
+	}
+	output, err := a.blls.Walletbase.UpdateSubscription(ctx, update)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserSubscribePlan, 1, event.UID, &bll.Payload{
+		Kind:   "subscription",
+		ID:     output.ID,
+		Amount: int64(output.Quantity),
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+	return nil
+}
+
+// renewSubscription tops up the credits of a paid billing cycle,
+// the first invoice may arrive before the subscription session completed.
+func (a *Checkout) renewSubscription(ctx *gear.Context, event *provider.Event) error {
+	sub := event.Subscription
+	logging.SetTo(ctx, "invoiceId", sub.InvoiceID)
+	update := &bll.UpdateSubscriptionInput{
+		UID:            event.UID,
+		ID:             event.SubscriptionID,
+		Status:         util.Ptr(bll.SubscriptionStatusActive),
+		SubscriptionID: util.Ptr(sub.ID),
+	}
+	if sub.CurrentPeriodEnd > 0 {
+		update.CurrentPeriodEnd = util.Ptr(sub.CurrentPeriodEnd)
+	}
+	if _, err := a.blls.Walletbase.UpdateSubscription(ctx, update); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	input := &bll.CreditSubscriptionInput{
+		UID:           event.UID,
+		ID:            event.SubscriptionID,
+		Currency:      sub.Currency,
+		Amount:        uint(sub.AmountPaid),
+		ChargeID:      sub.InvoiceID,
+		ChargePayload: sub.Payload,
+	}
+	if sub.AmountTax > 0 {
+		input.AmountTax = util.Ptr(uint(sub.AmountTax))
+		input.TaxJurisdiction = util.Ptr(sub.TaxJurisdiction)
+	}
+	charge, err := a.blls.Walletbase.CreditSubscription(ctx, input)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "chargeId", charge.ID)
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionSysRenewPlan, 1, event.UID, &bll.Payload{
+		Kind:   "subscription",
+		ID:     event.SubscriptionID,
+		Amount: int64(charge.Quantity),
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+	return nil
+}
+
+// deleteSubscription cancels the subscription that was canceled with the provider,
+// or whose subscription session expired.
+func (a *Checkout) deleteSubscription(ctx *gear.Context, event *provider.Event) error {
+	output, err := a.blls.Walletbase.GetSubscription(ctx, event.UID, event.SubscriptionID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if output.Status == bll.SubscriptionStatusCanceled {
+		return nil
+	}
+
+	_, err = a.blls.Walletbase.UpdateSubscription(ctx, &bll.UpdateSubscriptionInput{
+		UID:     event.UID,
+		ID:      event.SubscriptionID,
+		Status:  util.Ptr(bll.SubscriptionStatusCanceled),
+		Payload: util.Ptr(event.Subscription.Payload),
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return nil
+}
+
+// completePayout debits the income credits of the paid payout.
+func (a *Checkout) completePayout(ctx *gear.Context, event *provider.Event) error {
+	payout, err := a.blls.Walletbase.GetPayout(ctx, event.UID, event.PayoutID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if payout.Status == bll.PayoutStatusCompleted {
+		logging.SetTo(ctx, "msg", "payout recorded")
+		return nil
+	}
+
+	output, err := a.blls.Walletbase.CompletePayout(ctx, &bll.CompletePayoutInput{
+		UID:     event.UID,
+		ID:      event.PayoutID,
+		Payload: event.Payout.Payload,
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserPayout, 1, event.UID, &bll.Payload{
+		Kind:   "payout",
+		ID:     output.ID,
+		Payer:  event.UID,
+		Amount: output.Amount,
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+	return nil
+}
+
+// failPayout records the failed payout, the income credits were not debited.
+// The funds transferred to the connected account are reversed first,
+// so that they are not paid out again.
+func (a *Checkout) failPayout(ctx *gear.Context, p provider.Provider, event *provider.Event) error {
+	payout, err := a.blls.Walletbase.GetPayout(ctx, event.UID, event.PayoutID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if payout.Status != bll.PayoutStatusProcessing {
+		logging.SetTo(ctx, "msg", "payout not processing")
+		return nil
+	}
+
+	po := event.Payout
+	logging.SetTo(ctx, "payoutStatus", po.Status)
+	if pr, ok := p.(provider.Payouter); ok {
+		if err = pr.ReverseTransfer(ctx, event.PayoutID); err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+	}
+
+	_, err = a.blls.Walletbase.UpdatePayout(ctx, &bll.UpdatePayoutInput{
+		UID:           event.UID,
+		ID:            event.PayoutID,
+		CurrentStatus: bll.PayoutStatusProcessing,
+		Status:        bll.PayoutStatusFailed,
+		Payload:       util.Ptr(po.Payload),
+		FailureCode:   util.Ptr("payout." + po.FailureCode),
+		FailureMsg:    util.Ptr(po.FailureMsg),
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserPayout, -1, event.UID, &bll.Payload{
+		Kind:   "payout",
+		ID:     event.PayoutID,
+		Payer:  event.UID,
+		Amount: payout.Amount,
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+	return nil
+}
+
+// clawback debits the refunded or disputed credits from the wallet,
+// and freezes the wallet for the credits that the balance can not cover.
+// The credits of a gift are clawed back from the recipient.
+func (a *Checkout) clawback(ctx *gear.Context, charge *bll.ChargeOutput, quantity, amount uint, refundID string, payload []byte) (*bll.ChargeOutput, error) {
+	uid := gear.CtxValue[middleware.Session](ctx).UserID
+	holder := uid
+	if charge.Recipient != nil {
+		holder = *charge.Recipient
+	}
+	// the shortfall of the refund has frozen the wallet
+	if charge.FailureCode != nil && *charge.FailureCode == "wallet.frozen" &&
+		charge.FailureMsg != nil && *charge.FailureMsg == refundID {
+		logging.SetTo(ctx, "msg", "clawback recorded")
+		return charge, nil
+	}
+
+	wallet, err := a.blls.Walletbase.Get(ctx, holder)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+
+	// the refund is always recorded on the charge, with the credits that can be debited
+	award := charge.RefundAward(quantity)
+	debit := min(quantity, uint(max(wallet.Topup, 0)))
+	awardDebit := min(award, uint(max(wallet.Award, 0)))
+	output, err := a.blls.Walletbase.RefundCharge(ctx, &bll.RefundChargeInput{
+		UID:           uid,
+		ID:            charge.ID,
+		Recipient:     charge.Recipient,
+		Quantity:      debit,
+		Owed:          quantity - debit,
+		Award:         awardDebit,
+		Amount:        amount,
+		RefundID:      refundID,
+		RefundPayload: util.Bytes(payload),
+	})
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+
+	shortfall := int64(quantity-debit) + int64(award-awardDebit)
+	if shortfall == 0 {
+		return output, nil
+	}
+
+	logging.SetTo(ctx, "freezeWallet", shortfall)
+	if _, err = a.blls.Walletbase.Freeze(ctx, &bll.FreezeWalletInput{
+		UID:    holder,
+		Amount: shortfall,
+		Reason: refundID,
+	}); err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+
+	output, err = a.blls.Walletbase.UpdateCharge(ctx, &bll.UpdateChargeInput{
+		UID:           uid,
+		ID:            charge.ID,
+		CurrentStatus: output.Status,
+		Status:        output.Status,
+		FailureCode:   util.Ptr("wallet.frozen"),
+		FailureMsg:    util.Ptr(refundID),
+	})
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+
+	gid, log := clawbackLog(charge, uid, shortfall)
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionSysFreezeWallet, 1, gid, log); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	return output, nil
+}
+
+// clawbackLog returns the gid and the payload of the log of a clawback,
+// the log of a gift links the buyer and the recipient as the gift does.
+func clawbackLog(charge *bll.ChargeOutput, uid util.ID, amount int64) (util.ID, *bll.Payload) {
+	payload := &bll.Payload{
+		Kind:   "charge",
+		ID:     charge.ID,
+		Payer:  uid,
+		Amount: amount,
+	}
+	if charge.Recipient == nil {
+		return uid, payload
+	}
+
+	payload.Payee = charge.Recipient
+	return *charge.Recipient, payload
+}
+
+func logEvent(ctx *gear.Context, event *provider.Event) {
+	logging.SetTo(ctx, "eventType", event.Type)
+	logging.SetTo(ctx, "eventId", event.ID)
+	logging.SetTo(ctx, "objectType", event.ObjectType)
+	logging.SetTo(ctx, "objectId", event.ObjectID)
+}
+
+// withSystemSession runs the webhook as the system on behalf of the user.
+func withSystemSession(ctx *gear.Context, uid util.ID) {
+	h := util.HeaderFromCtx(ctx)
+	h.Set("x-auth-user", uid.String())
+	h.Set("x-auth-app", util.JARVIS.String())
+
+	ctx.WithContext(gear.CtxWith[middleware.Session](ctx.Context(), &middleware.Session{
+		UserID: uid,
+		AppID:  util.JARVIS,
+	}))
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+type Coupon struct {
+	blls *bll.Blls
+}
+
+func (a *Coupon) Save(ctx *gear.Context) error {
+	input := &bll.Coupon{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	logging.SetTo(ctx, "coupon", input.Code)
+	output, err := a.blls.Coupons.Save(ctx, input)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[*bll.Coupon]{Result: output})
+}
+
+type QueryCoupon struct {
+	Code string `json:"code" cbor:"code" query:"code" validate:"required,alphanum,gte=3,lte=32"`
+}
+
+func (i *QueryCoupon) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+func (a *Coupon) Get(ctx *gear.Context) error {
+	input := &QueryCoupon{}
+	if err := ctx.ParseURL(input); err != nil {
+		return err
+	}
+
+	output, err := a.blls.Coupons.Get(ctx, input.Code)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[*bll.Coupon]{Result: output})
+}
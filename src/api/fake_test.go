@@ -0,0 +1,1542 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// fakeProvider is a local stand-in of a payment provider. It issues payment sessions
+// hosted by a local HTTP server, and signs the webhooks the way Stripe does:
+// "Fake-Signature: t=<timestamp>,v1=<hex hmac-sha256 of timestamp.payload>".
+type fakeProvider struct {
+	srv        *httptest.Server
+	secret     string
+	webhookURL string // set by the test once the app is serving
+
+	mu            sync.Mutex
+	seq           int
+	calls         map[string]int // method => count
+	sessions      map[string]*provider.Session
+	subscriptions map[string]*fakeSubscription        // session id or subscription id => subscription
+	methods       map[string][]provider.PaymentMethod // customer => saved payment methods
+	transactions  []provider.Transaction              // settled payments
+	accounts      map[string]*provider.Account        // connected accounts
+	payouts       map[string]*fakePayout
+	refunded      map[string]int64 // session id => the total amount refunded
+	payoutErr     error            // returned by CreatePayout once
+	transferOK    bool             // the transfer is made before payoutErr
+	transfers     map[util.ID]bool // payout id => whether the transfer was reversed
+	reverseErr    error            // returned by ReverseTransfer once
+}
+
+type fakeEvent struct {
+	ID           string                 `json:"id"`
+	Type         string                 `json:"type"`
+	Data         *provider.Session      `json:"data,omitempty"`
+	UID          util.ID                `json:"uid,omitempty"`
+	SID          util.ID                `json:"sid,omitempty"`
+	Subscription *provider.Subscription `json:"subscription,omitempty"`
+	PID          util.ID                `json:"pid,omitempty"`
+	Payout       *provider.Payout       `json:"payout,omitempty"`
+	CID          util.ID                `json:"cid,omitempty"`
+	Refund       *provider.Refund       `json:"refund,omitempty"`
+	Dispute      *provider.Dispute      `json:"dispute,omitempty"`
+}
+
+type fakePayout struct {
+	UID util.ID
+	PID util.ID
+	provider.Payout
+}
+
+type fakeSubscription struct {
+	UID     util.ID
+	SID     util.ID
+	PriceID string
+	provider.Subscription
+}
+
+// the unit amount of one credit in cents
+const fakeUnitAmount = 10
+
+// price id => unit amount
+var fakePrices = map[string]int64{
+	"price_fake":  fakeUnitAmount,
+	"price_p500":  4500,
+	"price_m1000": 8000, // recurring
+}
+
+// coupon id => percent off
+var fakeCoupons = map[string]int64{
+	"coupon_10": 10,
+}
+
+func newFakeProvider() *fakeProvider {
+	p := &fakeProvider{
+		secret:        "whsec_fake",
+		calls:         make(map[string]int),
+		sessions:      make(map[string]*provider.Session),
+		subscriptions: make(map[string]*fakeSubscription),
+		methods:       make(map[string][]provider.PaymentMethod),
+		accounts:      make(map[string]*provider.Account),
+		payouts:       make(map[string]*fakePayout),
+		transfers:     make(map[util.ID]bool),
+		refunded:      make(map[string]int64),
+	}
+	mux := http.NewServeMux()
+	// POST /pay/<session id> pays the session, "?delayed=1" for delayed payment methods,
+	// "?silent=1" to miss the webhook, "?country=DE" for the billing country taxed 20% on top.
+	mux.HandleFunc("/pay/", func(w http.ResponseWriter, r *http.Request) {
+		cs := p.update(strings.TrimPrefix(r.URL.Path, "/pay/"), func(cs *provider.Session) {
+			cs.Status = "complete"
+			cs.Paid = r.URL.Query().Get("delayed") == ""
+			if country := r.URL.Query().Get("country"); country != "" {
+				cs.AmountTax = cs.AmountTotal * 20 / 100
+				cs.AmountTotal += cs.AmountTax
+				cs.TaxJurisdiction = country
+			}
+			if cs.Paid {
+				p.transactions = append(p.transactions, provider.Transaction{
+					ID:        "txn_" + cs.ID,
+					PaymentID: cs.PaymentID,
+					UID:       cs.UID,
+					ChargeID:  cs.ChargeID,
+					Currency:  cs.Currency,
+					Amount:    cs.AmountTotal,
+					CreatedAt: time.Now().Unix(),
+				})
+			}
+			if len(p.methods[cs.Customer]) == 0 {
+				p.methods[cs.Customer] = append(p.methods[cs.Customer], provider.PaymentMethod{
+					ID: "pm_" + cs.ID, Type: "card", Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030,
+				})
+			}
+		})
+		if cs == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("silent") != "" {
+			return
+		}
+		p.deliver(w, &fakeEvent{Type: string(provider.EventSessionCompleted), Data: cs})
+	})
+	// POST /fail/<session id> fails the delayed payment of the session.
+	mux.HandleFunc("/fail/", func(w http.ResponseWriter, r *http.Request) {
+		cs := p.update(strings.TrimPrefix(r.URL.Path, "/fail/"), func(cs *provider.Session) {
+			cs.Paid = false
+		})
+		if cs == nil {
+			http.NotFound(w, r)
+			return
+		}
+		p.deliver(w, &fakeEvent{Type: string(provider.EventSessionFailed), Data: cs})
+	})
+	// POST /expire/<session id> expires the session, "?silent=1" to miss the webhook.
+	mux.HandleFunc("/expire/", func(w http.ResponseWriter, r *http.Request) {
+		cs := p.update(strings.TrimPrefix(r.URL.Path, "/expire/"), func(cs *provider.Session) {
+			cs.Status = "expired"
+			cs.Closed = true
+		})
+		if cs == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("silent") != "" {
+			return
+		}
+		p.deliver(w, &fakeEvent{Type: string(provider.EventSessionExpired), Data: cs})
+	})
+	// POST /refund/<session id>?amount=N refunds N cents of the paid session in the dashboard,
+	// "?amount=0" redelivers the latest refund as a new event.
+	mux.HandleFunc("/refund/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/refund/")
+		amount, _ := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+		p.mu.Lock()
+		cs, ok := p.sessions[id]
+		if ok {
+			p.refunded[id] += amount
+		}
+		total := p.refunded[id]
+		p.mu.Unlock()
+		if !ok || total == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		rf := &provider.Refund{
+			ID:             fmt.Sprintf("re_fake_%s_%d", id, total),
+			Amount:         amount,
+			AmountRefunded: total,
+			Status:         "succeeded",
+			Payload:        util.Bytes{0xa0}, // replaced by the event payload
+		}
+		p.deliver(w, &fakeEvent{Type: string(provider.EventChargeRefunded), UID: cs.UID, CID: cs.ChargeID, Refund: rf})
+	})
+	// POST /dispute/<session id>?status=S disputes the paid session in full,
+	// "needs_response" opens the dispute, "won" or "lost" closes it.
+	mux.HandleFunc("/dispute/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/dispute/")
+		status := r.URL.Query().Get("status")
+		p.mu.Lock()
+		cs, ok := p.sessions[id]
+		p.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		kind := provider.EventDisputeCreated
+		if status == "won" || status == "lost" {
+			kind = provider.EventDisputeClosed
+		}
+		dp := &provider.Dispute{
+			ID:      "dp_fake_" + id,
+			Amount:  cs.AmountTotal,
+			Reason:  "fraudulent",
+			Status:  status,
+			Payload: util.Bytes{0xa0}, // replaced by the event payload
+		}
+		p.deliver(w, &fakeEvent{Type: string(kind), UID: cs.UID, CID: cs.ChargeID, Dispute: dp})
+	})
+	// POST /subscribe/<session id> completes the subscription session.
+	mux.HandleFunc("/subscribe/", func(w http.ResponseWriter, r *http.Request) {
+		ev := p.subscriptionEvent(strings.TrimPrefix(r.URL.Path, "/subscribe/"), provider.EventSubscriptionCreated, func(sub *fakeSubscription) {
+			p.seq += 1
+			sub.ID = fmt.Sprintf("sub_fake_%d", p.seq)
+			sub.Status = "active"
+			p.subscriptions[sub.ID] = sub
+		})
+		if ev == nil {
+			http.NotFound(w, r)
+			return
+		}
+		p.deliver(w, ev)
+	})
+	// POST /renew/<subscription id> pays the invoice of a billing cycle.
+	mux.HandleFunc("/renew/", func(w http.ResponseWriter, r *http.Request) {
+		ev := p.subscriptionEvent(strings.TrimPrefix(r.URL.Path, "/renew/"), provider.EventInvoicePaid, func(sub *fakeSubscription) {
+			p.seq += 1
+			sub.InvoiceID = fmt.Sprintf("in_fake_%d", p.seq)
+			sub.Currency = "usd"
+			sub.AmountPaid = fakePrices[sub.PriceID]
+			sub.CurrentPeriodEnd = time.Now().AddDate(0, 1, 0).Unix()
+		})
+		if ev == nil {
+			http.NotFound(w, r)
+			return
+		}
+		p.deliver(w, ev)
+	})
+	// POST /delete/<subscription id> cancels the subscription on the provider side.
+	mux.HandleFunc("/delete/", func(w http.ResponseWriter, r *http.Request) {
+		ev := p.subscriptionEvent(strings.TrimPrefix(r.URL.Path, "/delete/"), provider.EventSubscriptionDeleted, func(sub *fakeSubscription) {
+			sub.Status = "canceled"
+		})
+		if ev == nil {
+			http.NotFound(w, r)
+			return
+		}
+		p.deliver(w, ev)
+	})
+	// POST /onboard/<account id> completes the onboarding of the connected account.
+	mux.HandleFunc("/onboard/", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		acct, ok := p.accounts[strings.TrimPrefix(r.URL.Path, "/onboard/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		acct.DetailsSubmitted = true
+		acct.PayoutsEnabled = true
+	})
+	// POST /payout/paid/<payout id> pays out to the bank account, POST /payout/fail/<payout id> fails it.
+	mux.HandleFunc("/payout/", func(w http.ResponseWriter, r *http.Request) {
+		action, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/payout/"), "/")
+		kind := provider.EventPayoutPaid
+		p.mu.Lock()
+		po, ok := p.payouts[id]
+		if ok {
+			po.Status = "paid"
+			if action == "fail" {
+				kind = provider.EventPayoutFailed
+				po.Status = "failed"
+				po.FailureCode = "account_closed"
+				po.FailureMsg = "The bank account has been closed."
+			}
+		}
+		p.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		v := po.Payout
+		v.Payload = util.Bytes{0xa0} // replaced by the event payload
+		p.deliver(w, &fakeEvent{Type: string(kind), UID: po.UID, PID: po.PID, Payout: &v})
+	})
+	p.srv = httptest.NewServer(mux)
+	return p
+}
+
+func (p *fakeProvider) Close() {
+	p.srv.Close()
+}
+
+func (p *fakeProvider) update(id string, fn func(cs *provider.Session)) *provider.Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cs, ok := p.sessions[id]
+	if !ok {
+		return nil
+	}
+	fn(cs)
+	v := *cs
+	return &v
+}
+
+func (p *fakeProvider) subscriptionEvent(id string, kind provider.EventKind, fn func(sub *fakeSubscription)) *fakeEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, ok := p.subscriptions[id]
+	if !ok {
+		return nil
+	}
+	fn(sub)
+	v := sub.Subscription
+	v.Payload = util.Bytes{0xa0} // replaced by the event payload
+	return &fakeEvent{Type: string(kind), UID: sub.UID, SID: sub.SID, Subscription: &v}
+}
+
+// deliver sends the signed event to the webhook, and responds with the webhook status code.
+func (p *fakeProvider) deliver(w http.ResponseWriter, ev *fakeEvent) {
+	p.mu.Lock()
+	p.seq += 1
+	id := fmt.Sprintf("evt_fake_%d_%s", p.seq, util.NewUUID().Base64())
+	p.mu.Unlock()
+
+	ev.ID = id
+	payload, _ := json.Marshal(ev)
+	res, err := p.Send(payload, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	w.Header().Set("x-event-id", id)
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+// Send delivers the payload to the webhook with the signature at the time.
+func (p *fakeProvider) Send(payload []byte, at time.Time) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodPost, p.webhookURL, bytes.NewReader(payload))
+	req.Header.Set(gear.HeaderContentType, gear.MIMEApplicationJSON)
+	req.Header.Set("Fake-Signature", p.sign(payload, at))
+	return http.DefaultClient.Do(req)
+}
+
+func (p *fakeProvider) sign(payload []byte, at time.Time) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(p.secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) Config() provider.Config {
+	return provider.Config{PublicKey: "pk_fake", PriceID: "price_fake"}
+}
+
+func (p *fakeProvider) CreateSession(ctx context.Context, input *provider.SessionInput) (*provider.Session, error) {
+	price, err := p.GetPrice(ctx, input.PriceID)
+	if err != nil {
+		return nil, err
+	}
+
+	amount := int64(input.Quantity) * price.UnitAmount
+	discount := int64(0)
+	if input.Coupon != "" {
+		off, ok := fakeCoupons[input.Coupon]
+		if !ok {
+			return nil, gear.ErrBadRequest.WithMsgf("coupon %s not found", input.Coupon)
+		}
+		discount = amount * off / 100
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq += 1
+	cs := &provider.Session{
+		ID:             fmt.Sprintf("cs_fake_%d", p.seq),
+		Status:         "open",
+		Currency:       "usd",
+		AmountTotal:    amount - discount,
+		AmountDiscount: discount,
+		ExpiresAt:      time.Now().Add(time.Hour).Unix(),
+		Customer:       "cus_" + input.UID.String(),
+		UID:            input.UID,
+		ChargeID:       input.ChargeID,
+	}
+	if input.Currency != nil {
+		cs.Currency = *input.Currency
+	}
+	cs.URL = p.srv.URL + "/pay/" + cs.ID
+	cs.PaymentID = "pi_" + cs.ID
+	cs.CustomerDetails, _ = cbor.Marshal(map[string]string{"email": "tester@yiwen.ai"})
+	cs.Payload, _ = json.Marshal(cs)
+	p.sessions[cs.ID] = cs
+	v := *cs
+	return &v, nil
+}
+
+func (p *fakeProvider) CreateSubscriptionSession(ctx context.Context, input *provider.SubscriptionInput) (*provider.Session, error) {
+	price, err := p.GetPrice(ctx, input.PriceID)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq += 1
+	cs := &provider.Session{
+		ID:          fmt.Sprintf("cs_fake_%d", p.seq),
+		Status:      "open",
+		Currency:    price.Currency,
+		AmountTotal: price.UnitAmount,
+		UID:         input.UID,
+	}
+	cs.URL = p.srv.URL + "/subscribe/" + cs.ID
+	cs.Payload, _ = json.Marshal(cs)
+	p.sessions[cs.ID] = cs
+	p.subscriptions[cs.ID] = &fakeSubscription{UID: input.UID, SID: input.SubscriptionID, PriceID: input.PriceID}
+	v := *cs
+	return &v, nil
+}
+
+func (p *fakeProvider) CancelSubscription(ctx context.Context, id string) (*provider.Subscription, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, ok := p.subscriptions[id]
+	if !ok {
+		return nil, gear.ErrNotFound.WithMsgf("subscription %s not found", id)
+	}
+	sub.Status = "canceled"
+	v := sub.Subscription
+	v.Payload = util.Bytes{0xa0}
+	return &v, nil
+}
+
+func (p *fakeProvider) CreatePortalSession(ctx context.Context, customer string) (*provider.PortalSession, error) {
+	return &provider.PortalSession{ID: "bps_" + customer, URL: p.srv.URL + "/portal/" + customer}, nil
+}
+
+func (p *fakeProvider) ListPaymentMethods(ctx context.Context, customer string) ([]provider.PaymentMethod, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]provider.PaymentMethod{}, p.methods[customer]...), nil
+}
+
+func (p *fakeProvider) ListTransactions(ctx context.Context, from, to int64) ([]provider.Transaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	output := make([]provider.Transaction, 0)
+	for _, tx := range p.transactions {
+		if tx.CreatedAt >= from && tx.CreatedAt < to {
+			output = append(output, tx)
+		}
+	}
+	return output, nil
+}
+
+// ReceiptDetails reads the email from the stored session.
+func (p *fakeProvider) CreateAccount(ctx context.Context, uid util.ID) (*provider.Account, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq += 1
+	acct := &provider.Account{ID: fmt.Sprintf("acct_fake_%d", p.seq), Payload: util.Bytes{0xa0}}
+	p.accounts[acct.ID] = acct
+	v := *acct
+	return &v, nil
+}
+
+func (p *fakeProvider) GetAccount(ctx context.Context, id string) (*provider.Account, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	acct, ok := p.accounts[id]
+	if !ok {
+		return nil, gear.ErrNotFound.WithMsgf("account %s not found", id)
+	}
+	v := *acct
+	return &v, nil
+}
+
+func (p *fakeProvider) CreateAccountLink(ctx context.Context, id string) (string, error) {
+	return p.srv.URL + "/onboard/" + id, nil
+}
+
+func (p *fakeProvider) CreatePayout(ctx context.Context, input *provider.PayoutInput) (*provider.Payout, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls["CreatePayout"] += 1
+	if err := p.payoutErr; err != nil {
+		p.payoutErr = nil
+		if p.transferOK {
+			p.transferOK = false
+			if _, ok := p.transfers[input.PayoutID]; !ok {
+				p.transfers[input.PayoutID] = false
+			}
+		}
+		return nil, err
+	}
+	acct, ok := p.accounts[input.Account]
+	if !ok || !acct.PayoutsEnabled {
+		return nil, gear.ErrBadRequest.WithMsgf("account %s can not be paid out", input.Account)
+	}
+	if _, ok := p.transfers[input.PayoutID]; !ok {
+		p.transfers[input.PayoutID] = false
+	}
+
+	p.seq += 1
+	po := &fakePayout{UID: input.UID, PID: input.PayoutID, Payout: provider.Payout{
+		ID:         fmt.Sprintf("po_fake_%d", p.seq),
+		TransferID: fmt.Sprintf("tr_fake_%d", p.seq),
+		Status:     "pending",
+		Payload:    util.Bytes{0xa0},
+	}}
+	p.payouts[po.ID] = po
+	v := po.Payout
+	return &v, nil
+}
+
+// FailPayout makes the next CreatePayout fail with the error.
+func (p *fakeProvider) FailPayout(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.payoutErr = err
+}
+
+// FailPayoutAfterTransfer makes the next CreatePayout fail with the error after the transfer is made.
+func (p *fakeProvider) FailPayoutAfterTransfer(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.payoutErr = err
+	p.transferOK = true
+}
+
+func (p *fakeProvider) ReverseTransfer(ctx context.Context, payoutID util.ID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls["ReverseTransfer"] += 1
+	if err := p.reverseErr; err != nil {
+		p.reverseErr = nil
+		return err
+	}
+	if _, ok := p.transfers[payoutID]; ok {
+		p.transfers[payoutID] = true
+	}
+	return nil
+}
+
+// FailReverse makes the next ReverseTransfer fail with the error.
+func (p *fakeProvider) FailReverse(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reverseErr = err
+}
+
+// Transfer returns whether the transfer of the payout was made, and whether it was reversed.
+func (p *fakeProvider) Transfer(payoutID util.ID) (made, reversed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reversed, made = p.transfers[payoutID]
+	return made, reversed
+}
+
+func (p *fakeProvider) ReceiptDetails(payload []byte) (*provider.ReceiptDetails, error) {
+	// the payload is the session marshaled without its own payload
+	cs := &struct {
+		CustomerDetails util.Bytes
+	}{}
+	if err := json.Unmarshal(payload, cs); err != nil {
+		return nil, err
+	}
+	details := map[string]string{}
+	if err := cbor.Unmarshal(cs.CustomerDetails, &details); err != nil {
+		return nil, err
+	}
+
+	return &provider.ReceiptDetails{
+		Name:    "Tester",
+		Email:   details["email"],
+		Address: []string{"1 Main St", "Springfield"},
+	}, nil
+}
+
+func (p *fakeProvider) Calls(method string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[method]
+}
+
+func (p *fakeProvider) GetSession(ctx context.Context, id string) (*provider.Session, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls["GetSession"] += 1
+	cs, ok := p.sessions[id]
+	if !ok {
+		return nil, gear.ErrNotFound.WithMsgf("session %s not found", id)
+	}
+	v := *cs
+	return &v, nil
+}
+
+func (p *fakeProvider) VerifyWebhook(ctx context.Context, payload []byte, header http.Header) (*provider.Event, error) {
+	var ts, sig string
+	for _, kv := range strings.Split(header.Get("Fake-Signature"), ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, gear.ErrBadRequest.WithMsg("invalid signature timestamp")
+	}
+	if time.Since(time.Unix(t, 0)) > 5*time.Minute {
+		return nil, gear.ErrBadRequest.WithMsg("signature expired")
+	}
+	expected := p.sign(payload, time.Unix(t, 0))
+	if !hmac.Equal([]byte(expected), []byte("t="+ts+",v1="+sig)) {
+		return nil, gear.ErrBadRequest.WithMsg("invalid signature")
+	}
+
+	return p.ParseEvent(ctx, payload)
+}
+
+func (p *fakeProvider) ParseEvent(ctx context.Context, payload []byte) (*provider.Event, error) {
+	ev := &fakeEvent{}
+	if err := json.Unmarshal(payload, ev); err != nil {
+		return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+	}
+
+	output := &provider.Event{
+		ID:      ev.ID,
+		Type:    ev.Type,
+		Kind:    provider.EventKind(ev.Type),
+		Session: ev.Data,
+		Payload: util.Bytes(payload),
+	}
+	if ev.Data != nil {
+		output.ObjectType = "session"
+		output.ObjectID = ev.Data.ID
+		output.UID = ev.Data.UID
+		output.ChargeID = ev.Data.ChargeID
+	}
+	if ev.Subscription != nil {
+		output.ObjectType = "subscription"
+		output.ObjectID = ev.Subscription.ID
+		output.UID = ev.UID
+		output.SubscriptionID = ev.SID
+		output.Subscription = ev.Subscription
+		output.Subscription.Payload = util.Bytes(payload)
+	}
+	if ev.Payout != nil {
+		output.ObjectType = "payout"
+		output.ObjectID = ev.Payout.ID
+		output.UID = ev.UID
+		output.PayoutID = ev.PID
+		output.Payout = ev.Payout
+		output.Payout.Payload = util.Bytes(payload)
+	}
+	if ev.Refund != nil {
+		output.ObjectType = "charge"
+		output.ObjectID = ev.Refund.ID
+		output.UID = ev.UID
+		output.ChargeID = ev.CID
+		output.Refund = ev.Refund
+		output.Refund.Payload = util.Bytes(payload)
+	}
+	if ev.Dispute != nil {
+		output.ObjectType = "dispute"
+		output.ObjectID = ev.Dispute.ID
+		output.UID = ev.UID
+		output.ChargeID = ev.CID
+		output.Dispute = ev.Dispute
+		output.Dispute.Payload = util.Bytes(payload)
+	}
+	return output, nil
+}
+
+func (p *fakeProvider) Refund(ctx context.Context, input *provider.RefundInput) (*provider.Refund, error) {
+	return &provider.Refund{
+		ID:      "re_" + input.IdempotencyKey,
+		Amount:  input.Amount,
+		Status:  "succeeded",
+		Payload: util.Bytes{0xa0},
+	}, nil
+}
+
+func (p *fakeProvider) GetPrice(ctx context.Context, id string) (*provider.Price, error) {
+	p.mu.Lock()
+	p.calls["GetPrice"] += 1
+	p.mu.Unlock()
+	unit, ok := fakePrices[id]
+	if !ok {
+		return nil, gear.ErrNotFound.WithMsgf("price %s not found", id)
+	}
+	return &provider.Price{ID: id, UnitAmount: unit, Currency: "usd"}, nil
+}
+
+type fakeCharge struct {
+	UID util.ID
+	bll.ChargeOutput
+	refunds []string // the recorded refund ids
+}
+
+type fakeBaseSubscription struct {
+	UID util.ID
+	bll.SubscriptionOutput
+}
+
+type fakeBasePayout struct {
+	UID util.ID
+	bll.PayoutOutput
+}
+
+// fakeBase is a local stand-in of the Walletbase and Logbase services, with in-memory state.
+type fakeBase struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	calls     map[string]int // "METHOD /path" => count
+	wallets   map[util.ID]*bll.WalletOutput
+	charges   map[util.ID]*fakeCharge
+	customers map[string]*bll.CustomerOutput
+	logs      []bll.CreateLogInput
+	users     map[util.ID]*bll.UserInfo // nil for the missing users, others are active
+	groups    map[util.ID]*bll.UserInfo // only the set groups exist
+	broken    map[string]bool           // "METHOD /path" => failing with 503
+	lost      map[string]bool           // "METHOD /path" => the response of the next call is lost
+	expenses  map[util.ID]util.ID       // request id => txn
+
+	subscriptions map[util.ID]*fakeBaseSubscription
+	payouts       map[util.ID]*fakeBasePayout
+	tasks         []bll.CreateTaskInput
+	resolved      []bll.ResolveTaskInput
+	transactions  []bll.TransactionOutput
+	frozen        map[util.ID]int64                  // uid => the credits owed
+	publications  map[util.ID]*bll.PublicationOutput // cid => publication
+}
+
+func newFakeBase() *fakeBase {
+	b := &fakeBase{
+		calls:     make(map[string]int),
+		wallets:   make(map[util.ID]*bll.WalletOutput),
+		charges:   make(map[util.ID]*fakeCharge),
+		customers: make(map[string]*bll.CustomerOutput),
+		users:     make(map[util.ID]*bll.UserInfo),
+		groups:    make(map[util.ID]*bll.UserInfo),
+		broken:    make(map[string]bool),
+		lost:      make(map[string]bool),
+		expenses:  make(map[util.ID]util.ID),
+
+		subscriptions: make(map[util.ID]*fakeBaseSubscription),
+		payouts:       make(map[util.ID]*fakeBasePayout),
+		frozen:        make(map[util.ID]int64),
+		publications:  make(map[util.ID]*bll.PublicationOutput),
+	}
+	b.srv = httptest.NewServer(http.HandlerFunc(b.serve))
+	return b
+}
+
+func (b *fakeBase) Close() {
+	b.srv.Close()
+}
+
+func (b *fakeBase) Calls(api string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[api]
+}
+
+func (b *fakeBase) Wallet(uid util.ID) bll.WalletOutput {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return *b.wallet(uid)
+}
+
+func (b *fakeBase) Logs() []bll.CreateLogInput {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]bll.CreateLogInput{}, b.logs...)
+}
+
+// SetPublication sets the publication of the creation, in any language and version.
+func (b *fakeBase) SetPublication(pub *bll.PublicationOutput) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publications[pub.CID] = pub
+}
+
+// SetUser sets the info of the user, nil for a missing user.
+func (b *fakeBase) SetUser(uid util.ID, info *bll.UserInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.users[uid] = info
+}
+
+// SetGroup sets the info of the group.
+func (b *fakeBase) SetGroup(gid util.ID, info *bll.UserInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups[gid] = info
+}
+
+// Lose makes the next call of the api succeed, but its response is lost with 504, as on a timeout.
+func (b *fakeBase) Lose(api string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lost[api] = true
+}
+
+// Break makes the api fail with 503, as in an outage.
+func (b *fakeBase) Break(api string, broken bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.broken[api] = broken
+}
+
+// AddIncome credits the income of the user, as the sponsorships do.
+func (b *fakeBase) AddIncome(uid util.ID, amount int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.wallet(uid).Income += amount
+}
+
+// AddTopup credits the topup of the user, as the charges do.
+func (b *fakeBase) AddTopup(uid util.ID, amount int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.wallet(uid).Topup += amount
+}
+
+// Frozen returns the credits owed by the user, 0 if the wallet is not frozen.
+func (b *fakeBase) Frozen(uid util.ID) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.frozen[uid]
+}
+
+// AddAward credits the award of the user, as the bonus packages do.
+func (b *fakeBase) AddAward(uid util.ID, amount int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.wallet(uid).Award += amount
+}
+
+func (b *fakeBase) Tasks() []bll.CreateTaskInput {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]bll.CreateTaskInput{}, b.tasks...)
+}
+
+func (b *fakeBase) ResolvedTasks() []bll.ResolveTaskInput {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]bll.ResolveTaskInput{}, b.resolved...)
+}
+
+func (b *fakeBase) wallet(uid util.ID) *bll.WalletOutput {
+	w, ok := b.wallets[uid]
+	if !ok {
+		w = &bll.WalletOutput{}
+		b.wallets[uid] = w
+	}
+	return w
+}
+
+func (b *fakeBase) charge(uid, id util.ID) (*fakeCharge, error) {
+	ch, ok := b.charges[id]
+	if !ok || ch.UID != uid {
+		return nil, gear.ErrNotFound.WithMsgf("charge %s not found", id.String())
+	}
+	return ch, nil
+}
+
+func (b *fakeBase) subscription(uid, id util.ID) (*fakeBaseSubscription, error) {
+	sub, ok := b.subscriptions[id]
+	if !ok || sub.UID != uid {
+		return nil, gear.ErrNotFound.WithMsgf("subscription %s not found", id.String())
+	}
+	return sub, nil
+}
+
+func (b *fakeBase) payout(uid, id util.ID) (*fakeBasePayout, error) {
+	po, ok := b.payouts[id]
+	if !ok || po.UID != uid {
+		return nil, gear.ErrNotFound.WithMsgf("payout %s not found", id.String())
+	}
+	return po, nil
+}
+
+func (b *fakeBase) serve(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	api := r.Method + " " + r.URL.Path
+	b.calls[api] += 1
+	data, _ := io.ReadAll(r.Body)
+	decode := func(v any) error {
+		if err := cbor.Unmarshal(data, v); err != nil {
+			return gear.ErrBadRequest.From(err)
+		}
+		return nil
+	}
+	query := r.URL.Query()
+	uid, _ := util.ParseID(query.Get("uid"))
+
+	var result any
+	var err error
+	if b.broken[api] {
+		api = "broken"
+	}
+	switch api {
+	case "broken":
+		err = gear.ErrServiceUnavailable.WithMsgf("%s %s is down", r.Method, r.URL.Path)
+
+	case "GET /currencies":
+		result = bll.Currencies{{Name: "US Dollar", Alpha: "USD", Decimals: 2, Code: 840, Rate: 10000}}
+
+	case "POST /v1/user/batch_get_info":
+		input := &bll.IDs{}
+		if err = decode(input); err != nil {
+			break
+		}
+		list := []bll.UserInfo{}
+		for _, id := range input.IDs {
+			info, ok := b.users[id]
+			switch {
+			case !ok:
+				list = append(list, bll.UserInfo{ID: util.Ptr(id), CN: "u" + id.String(), Name: "Tester"})
+			case info != nil:
+				list = append(list, *info)
+			}
+		}
+		result = list
+
+	case "GET /v1/publication":
+		gid, _ := util.ParseID(query.Get("gid"))
+		cid, _ := util.ParseID(query.Get("cid"))
+		pub, ok := b.publications[cid]
+		if !ok || pub.GID != gid {
+			err = gear.ErrNotFound.WithMsgf("publication %s not found", cid.String())
+			break
+		}
+		result = pub
+
+	case "POST /v1/group/batch_get_info":
+		input := &bll.IDs{}
+		if err = decode(input); err != nil {
+			break
+		}
+		list := []bll.UserInfo{}
+		for _, id := range input.IDs {
+			if info, ok := b.groups[id]; ok {
+				list = append(list, *info)
+			}
+		}
+		result = list
+
+	case "GET /v1/wallet":
+		result = b.wallet(uid)
+
+	case "POST /v1/wallet/sponsor":
+		input := &bll.ExpendInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		payer := b.wallet(*input.UID)
+		if payer.Topup < input.Amount {
+			err = gear.ErrBadRequest.WithMsgf("insufficient topup credits, expected %d, got %d", input.Amount, payer.Topup)
+			break
+		}
+		// the system takes 10%
+		txn := bll.TransactionOutput{
+			ID:       util.NewID(),
+			Payer:    input.UID,
+			Payee:    &input.Payee,
+			SubPayee: input.SubPayee,
+			Status:   1,
+			Kind:     "sponsor",
+			Amount:   input.Amount,
+			SysFee:   input.Amount / 10,
+		}
+		if input.SubShares != nil {
+			txn.SubShares = *input.SubShares
+			b.wallet(*input.SubPayee).Income += txn.SubShares
+		}
+		b.wallet(input.Payee).Income += txn.Amount - txn.SysFee - txn.SubShares
+		b.transactions = append(b.transactions, txn)
+		payer.Topup -= input.Amount
+		payer.Txn = txn.ID
+		result = payer
+
+	case "POST /v1/wallet/expend":
+		input := &bll.ExpendInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		payer := b.wallet(*input.UID)
+		if input.RequestID != nil {
+			if txn, ok := b.expenses[*input.RequestID]; ok {
+				payer.Txn = txn
+				result = payer
+				break
+			}
+		}
+		if payer.Topup < input.Amount {
+			err = gear.ErrBadRequest.WithMsgf("insufficient topup credits, expected %d, got %d", input.Amount, payer.Topup)
+			break
+		}
+		txn := bll.TransactionOutput{
+			ID:          util.NewID(),
+			Payer:       input.UID,
+			Payee:       &input.Payee,
+			Status:      1,
+			Kind:        input.Kind,
+			Amount:      input.Amount,
+			Description: input.Description,
+		}
+		b.transactions = append(b.transactions, txn)
+		if input.RequestID != nil {
+			b.expenses[*input.RequestID] = txn.ID
+		}
+		payer.Topup -= input.Amount
+		payer.Txn = txn.ID
+		result = payer
+
+	case "POST /v1/wallet/transfer":
+		input := &bll.TransferInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		payer := b.wallet(*input.UID)
+		if payer.Topup < input.Amount {
+			err = gear.ErrBadRequest.WithMsgf("insufficient topup credits, expected %d, got %d", input.Amount, payer.Topup)
+			break
+		}
+		txn := bll.TransactionOutput{
+			ID:          util.NewID(),
+			Payer:       input.UID,
+			Payee:       &input.Payee,
+			Status:      1,
+			Kind:        input.Kind,
+			Amount:      input.Amount,
+			Description: input.Description,
+		}
+		b.transactions = append(b.transactions, txn)
+		b.wallet(input.Payee).Topup += input.Amount
+		payer.Topup -= input.Amount
+		payer.Txn = txn.ID
+		result = payer
+
+	case "POST /v1/transaction/list_income":
+		input := &bll.UIDPagination{}
+		if err = decode(input); err != nil {
+			break
+		}
+		list := []bll.TransactionOutput{}
+		for _, txn := range b.transactions {
+			if input.UID != nil && (*txn.Payee == *input.UID || txn.SubPayee != nil && *txn.SubPayee == *input.UID) {
+				list = append(list, txn)
+			}
+		}
+		result = list
+
+	case "POST /v1/log":
+		input := &bll.CreateLogInput{}
+		if err = decode(input); err == nil {
+			b.logs = append(b.logs, *input)
+			result = bll.LogOutput{UID: input.UID, ID: util.NewID(), Action: input.Action}
+		}
+
+	case "GET /v1/customer":
+		cus, ok := b.customers[uid.String()+query.Get("provider")]
+		if !ok {
+			err = gear.ErrNotFound.WithMsg("customer not found")
+			break
+		}
+		result = cus
+
+	case "POST /v1/customer":
+		input := &bll.CustomerInput{}
+		if err = decode(input); err == nil {
+			cus := &bll.CustomerOutput{UID: input.UID, Provider: input.Provider, Customer: input.Customer}
+			b.customers[input.UID.String()+input.Provider] = cus
+			result = cus
+		}
+
+	case "GET /v1/charge":
+		id, _ := util.ParseID(query.Get("id"))
+		var ch *fakeCharge
+		if ch, err = b.charge(uid, id); err == nil {
+			result = ch.ChargeOutput
+		}
+
+	case "POST /v1/charge":
+		input := &bll.ChargeInput{}
+		if err = decode(input); err == nil {
+			ch := &fakeCharge{UID: input.UID, ChargeOutput: bll.ChargeOutput{
+				ID:       util.NewID(),
+				Provider: input.Provider,
+				Status:   bll.ChargeStatusCreated,
+				Quantity: input.Quantity,
+				Award:    input.Award,
+				Coupon:   input.Coupon,
+
+				Recipient:   input.Recipient,
+				GiftMessage: input.GiftMessage,
+			}}
+			b.charges[ch.ID] = ch
+			result = ch.ChargeOutput
+		}
+
+	case "PATCH /v1/charge":
+		input := &bll.UpdateChargeInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		var ch *fakeCharge
+		if ch, err = b.charge(input.UID, input.ID); err != nil {
+			break
+		}
+		if ch.Status != input.CurrentStatus {
+			err = gear.ErrConflict.WithMsgf("charge status mismatch, expected %d, got %d", input.CurrentStatus, ch.Status)
+			break
+		}
+		ch.Status = input.Status
+		ch.UpdatedAt = util.Ptr(time.Now().UnixMilli())
+		if input.Currency != nil {
+			ch.Currency = input.Currency
+		}
+		if input.Amount != nil {
+			ch.Amount = input.Amount
+		}
+		if input.AmountDiscount != nil {
+			ch.AmountDiscount = input.AmountDiscount
+		}
+		if input.ChargeID != nil {
+			ch.ChargeID = input.ChargeID
+		}
+		if input.ChargePayload != nil {
+			ch.ChargePayload = input.ChargePayload
+		}
+		if input.FailureCode != nil {
+			ch.FailureCode = input.FailureCode
+		}
+		if input.FailureMsg != nil {
+			ch.FailureMsg = input.FailureMsg
+		}
+		result = ch.ChargeOutput
+
+	case "POST /v1/charge/complete":
+		input := &bll.CompleteChargeInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		var ch *fakeCharge
+		if ch, err = b.charge(input.UID, input.ID); err != nil {
+			break
+		}
+		if ch.Status != bll.ChargeStatusPending && ch.Status != bll.ChargeStatusProcessing {
+			err = gear.ErrConflict.WithMsgf("charge status mismatch, got %d", ch.Status)
+			break
+		}
+		ch.Status = bll.ChargeStatusCompleted
+		ch.Currency = &input.Currency
+		ch.Amount = &input.Amount
+		ch.ChargeID = &input.ChargeID
+		ch.ChargePayload = &input.ChargePayload
+		ch.AmountTax = input.AmountTax
+		ch.TaxJurisdiction = input.TaxJurisdiction
+		ch.Txn = util.Ptr(util.NewID())
+		credited := input.UID
+		if ch.Recipient != nil {
+			credited = *ch.Recipient
+		}
+		b.wallet(credited).Topup += int64(ch.Quantity)
+		if ch.Award != nil {
+			b.wallet(credited).Award += int64(*ch.Award)
+		}
+		result = ch.ChargeOutput
+
+	case "POST /v1/charge/refund":
+		input := &bll.RefundChargeInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		var ch *fakeCharge
+		if ch, err = b.charge(input.UID, input.ID); err != nil {
+			break
+		}
+		if slices.Contains(ch.refunds, input.RefundID) {
+			result = ch.ChargeOutput
+			break
+		}
+		holder := input.UID
+		if input.Recipient != nil {
+			holder = *input.Recipient
+		}
+		w := b.wallet(holder)
+		if w.Topup < int64(input.Quantity) || w.Award < int64(input.Award) {
+			err = gear.ErrBadRequest.WithMsgf("insufficient credits, expected %d and %d awarded, got %d and %d awarded",
+				input.Quantity, input.Award, w.Topup, w.Award)
+			break
+		}
+		w.Topup -= int64(input.Quantity)
+		w.Award -= int64(input.Award)
+		ch.refunds = append(ch.refunds, input.RefundID)
+		refunded := input.Amount
+		if ch.AmountRefunded != nil {
+			refunded += *ch.AmountRefunded
+		}
+		ch.AmountRefunded = &refunded
+		credits := input.Quantity + input.Owed
+		if ch.RefundedCredits != nil {
+			credits += *ch.RefundedCredits
+		}
+		ch.RefundedCredits = &credits
+		if ch.Amount != nil && refunded >= *ch.Amount {
+			ch.Status = bll.ChargeStatusRefunded
+		}
+		ch.TxnRefunded = util.Ptr(util.NewID())
+		result = ch.ChargeOutput
+
+	case "POST /v1/wallet/freeze":
+		input := &bll.FreezeWalletInput{}
+		if err = decode(input); err == nil {
+			b.frozen[input.UID] += input.Amount
+			result = b.wallet(input.UID)
+		}
+
+	case "POST /v1/charge/scan":
+		input := &bll.ScanChargesInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		list := []bll.ScanChargeOutput{}
+		for _, ch := range b.charges {
+			updatedAt := ch.ID.UnixMs()
+			if ch.UpdatedAt != nil {
+				updatedAt = *ch.UpdatedAt
+			}
+			switch {
+			case ch.Status != input.Status:
+			case input.Provider != nil && ch.Provider != *input.Provider:
+			case input.UpdatedBefore != nil && updatedAt > *input.UpdatedBefore:
+			case input.CreatedAfter != nil && ch.ID.UnixMs() < *input.CreatedAfter:
+			case input.CreatedBefore != nil && ch.ID.UnixMs() >= *input.CreatedBefore:
+			default:
+				list = append(list, bll.ScanChargeOutput{UID: ch.UID, ChargeOutput: ch.ChargeOutput})
+			}
+		}
+		result = list
+
+	case "POST /v1/charge/list":
+		input := &bll.UIDPagination{}
+		if err = decode(input); err != nil {
+			break
+		}
+		list := []bll.ChargeOutput{}
+		for _, ch := range b.charges {
+			if input.UID != nil && ch.UID == *input.UID {
+				list = append(list, ch.ChargeOutput)
+			}
+		}
+		result = list
+
+	case "POST /v1/charge/list_gifts":
+		input := &bll.UIDPagination{}
+		if err = decode(input); err != nil {
+			break
+		}
+		list := []bll.GiftOutput{}
+		for _, ch := range b.charges {
+			if input.UID != nil && ch.Recipient != nil && *ch.Recipient == *input.UID {
+				list = append(list, bll.GiftOutput{UID: ch.UID, ChargeOutput: ch.ChargeOutput})
+			}
+		}
+		result = list
+
+	case "GET /v1/subscription":
+		id, _ := util.ParseID(query.Get("id"))
+		var sub *fakeBaseSubscription
+		if sub, err = b.subscription(uid, id); err == nil {
+			result = sub.SubscriptionOutput
+		}
+
+	case "POST /v1/subscription":
+		input := &bll.SubscriptionInput{}
+		if err = decode(input); err == nil {
+			sub := &fakeBaseSubscription{UID: input.UID, SubscriptionOutput: bll.SubscriptionOutput{
+				ID:       util.NewID(),
+				Provider: input.Provider,
+				Plan:     input.Plan,
+				Quantity: input.Quantity,
+				Status:   bll.SubscriptionStatusCreated,
+			}}
+			b.subscriptions[sub.ID] = sub
+			result = sub.SubscriptionOutput
+		}
+
+	case "PATCH /v1/subscription":
+		input := &bll.UpdateSubscriptionInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		var sub *fakeBaseSubscription
+		if sub, err = b.subscription(input.UID, input.ID); err != nil {
+			break
+		}
+		if sub.Status == bll.SubscriptionStatusCanceled {
+			err = gear.ErrConflict.WithMsg("subscription canceled")
+			break
+		}
+		if input.Status != nil {
+			sub.Status = *input.Status
+			if sub.Status == bll.SubscriptionStatusCanceled {
+				sub.CanceledAt = util.Ptr(time.Now().UnixMilli())
+			}
+		}
+		if input.CheckoutID != nil {
+			sub.CheckoutID = input.CheckoutID
+		}
+		if input.SubscriptionID != nil {
+			sub.SubscriptionID = input.SubscriptionID
+		}
+		if input.CurrentPeriodEnd != nil {
+			sub.CurrentPeriodEnd = input.CurrentPeriodEnd
+		}
+		if input.Payload != nil {
+			sub.Payload = input.Payload
+		}
+		result = sub.SubscriptionOutput
+
+	case "POST /v1/subscription/list":
+		input := &bll.UIDPagination{}
+		if err = decode(input); err != nil {
+			break
+		}
+		list := []bll.SubscriptionOutput{}
+		for _, sub := range b.subscriptions {
+			if input.UID != nil && sub.UID == *input.UID {
+				list = append(list, sub.SubscriptionOutput)
+			}
+		}
+		result = list
+
+	case "POST /v1/subscription/credit":
+		input := &bll.CreditSubscriptionInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		var sub *fakeBaseSubscription
+		if sub, err = b.subscription(input.UID, input.ID); err != nil {
+			break
+		}
+		if sub.Status != bll.SubscriptionStatusActive {
+			err = gear.ErrConflict.WithMsgf("subscription status mismatch, got %d", sub.Status)
+			break
+		}
+		// an invoice is credited once
+		for _, ch := range b.charges {
+			if ch.UID == input.UID && ch.ChargeID != nil && *ch.ChargeID == input.ChargeID {
+				result = ch.ChargeOutput
+			}
+		}
+		if result != nil {
+			break
+		}
+		ch := &fakeCharge{UID: input.UID, ChargeOutput: bll.ChargeOutput{
+			ID:              util.NewID(),
+			Provider:        sub.Provider,
+			Status:          bll.ChargeStatusCompleted,
+			Quantity:        sub.Quantity,
+			Currency:        &input.Currency,
+			Amount:          &input.Amount,
+			ChargeID:        &input.ChargeID,
+			ChargePayload:   &input.ChargePayload,
+			AmountTax:       input.AmountTax,
+			TaxJurisdiction: input.TaxJurisdiction,
+			Txn:             util.Ptr(util.NewID()),
+		}}
+		b.charges[ch.ID] = ch
+		b.wallet(input.UID).Topup += int64(ch.Quantity)
+		result = ch.ChargeOutput
+
+	case "POST /v1/task":
+		input := &bll.CreateTaskInput{}
+		if err = decode(input); err == nil {
+			b.tasks = append(b.tasks, *input)
+			result = map[string]any{}
+		}
+
+	case "POST /v1/task/resolve":
+		input := &bll.ResolveTaskInput{}
+		if err = decode(input); err == nil {
+			b.resolved = append(b.resolved, *input)
+			result = map[string]any{}
+		}
+
+	case "GET /v1/payout":
+		id, _ := util.ParseID(query.Get("id"))
+		var po *fakeBasePayout
+		if po, err = b.payout(uid, id); err == nil {
+			result = po.PayoutOutput
+		}
+
+	case "POST /v1/payout":
+		input := &bll.PayoutInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		// the income of the pending payouts is not available
+		available := b.wallet(input.UID).Income
+		for _, po := range b.payouts {
+			if po.UID == input.UID && po.Status >= bll.PayoutStatusPending && po.Status < bll.PayoutStatusCompleted {
+				available -= po.Amount
+			}
+		}
+		if available < input.Amount {
+			err = gear.ErrBadRequest.WithMsgf("insufficient income credits, expected %d, got %d", input.Amount, available)
+			break
+		}
+		po := &fakeBasePayout{UID: input.UID, PayoutOutput: bll.PayoutOutput{
+			ID:        util.NewID(),
+			Provider:  input.Provider,
+			Status:    bll.PayoutStatusPending,
+			Amount:    input.Amount,
+			Fee:       input.Fee,
+			Currency:  input.Currency,
+			PayAmount: input.PayAmount,
+			Account:   &input.Account,
+		}}
+		b.payouts[po.ID] = po
+		result = po.PayoutOutput
+
+	case "PATCH /v1/payout":
+		input := &bll.UpdatePayoutInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		var po *fakeBasePayout
+		if po, err = b.payout(input.UID, input.ID); err != nil {
+			break
+		}
+		if po.Status != input.CurrentStatus {
+			err = gear.ErrConflict.WithMsgf("payout status mismatch, expected %d, got %d", input.CurrentStatus, po.Status)
+			break
+		}
+		po.Status = input.Status
+		po.UpdatedAt = util.Ptr(time.Now().UnixMilli())
+		if input.Reviewer != nil {
+			po.Reviewer = input.Reviewer
+		}
+		if input.TransferID != nil {
+			po.TransferID = input.TransferID
+		}
+		if input.ProviderPayoutID != nil {
+			po.ProviderPayoutID = input.ProviderPayoutID
+		}
+		if input.Payload != nil {
+			po.Payload = input.Payload
+		}
+		if input.FailureCode != nil {
+			po.FailureCode = input.FailureCode
+		}
+		if input.FailureMsg != nil {
+			po.FailureMsg = input.FailureMsg
+		}
+		result = po.PayoutOutput
+
+	case "POST /v1/payout/complete":
+		input := &bll.CompletePayoutInput{}
+		if err = decode(input); err != nil {
+			break
+		}
+		var po *fakeBasePayout
+		if po, err = b.payout(input.UID, input.ID); err != nil {
+			break
+		}
+		if po.Status != bll.PayoutStatusProcessing {
+			err = gear.ErrConflict.WithMsgf("payout status mismatch, got %d", po.Status)
+			break
+		}
+		po.Status = bll.PayoutStatusCompleted
+		po.Payload = &input.Payload
+		po.Txn = util.Ptr(util.NewID())
+		b.wallet(input.UID).Income -= po.Amount
+		result = po.PayoutOutput
+
+	case "POST /v1/payout/list":
+		input := &bll.UIDPagination{}
+		if err = decode(input); err != nil {
+			break
+		}
+		list := []bll.PayoutOutput{}
+		for _, po := range b.payouts {
+			if input.UID != nil && po.UID == *input.UID {
+				list = append(list, po.PayoutOutput)
+			}
+		}
+		result = list
+
+	default:
+		err = gear.ErrNotFound.WithMsgf("%s not found", api)
+	}
+
+	if err == nil && b.lost[api] {
+		b.lost[api] = false
+		err = gear.ErrGatewayTimeout.WithMsgf("%s %s timed out", r.Method, r.URL.Path)
+	}
+	if err != nil {
+		er := gear.Err.From(err)
+		w.WriteHeader(er.Code)
+		w.Write([]byte(er.Msg))
+		return
+	}
+
+	res, _ := cbor.Marshal(bll.SuccessResponse[any]{Result: result})
+	w.Header().Set(gear.HeaderContentType, gear.MIMEApplicationCBOR)
+	w.Write(res)
+}
@@ -10,7 +10,8 @@ import (
 
 // Healthz ..
 type Healthz struct {
-	blls *bll.Blls
+	blls       *bll.Blls
+	reconciler *Reconciler
 }
 
 // Get ..
@@ -21,6 +22,7 @@ func (a *Healthz) Get(ctx *gear.Context) error {
 	}
 
 	logging.SetTo(ctx, "stats", stats)
+	logging.SetTo(ctx, "reconciler", a.reconciler.Stats())
 	return ctx.OkJSON(bll.SuccessResponse[map[string]string]{Result: GetVersion()})
 }
 
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Hold reserves the credits of the user before a long job, such as an AI task,
+// and settles the actual cost by capturing the hold after the job.
+type Hold struct {
+	blls *bll.Blls
+	cfg  conf.Hold
+}
+
+type VoidHoldInput struct {
+	ID util.ID `json:"id" cbor:"id" validate:"required"`
+}
+
+func (i *VoidHoldInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+func (a *Hold) Get(ctx *gear.Context) error {
+	input := &bll.QueryId{}
+	if err := ctx.ParseURL(input); err != nil {
+		return err
+	}
+	sess := gear.CtxValue[middleware.Session](ctx)
+
+	output, err := a.blls.Holds.Get(ctx, sess.UserID, input.ID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return ctx.OkSend(bll.SuccessResponse[*bll.HoldOutput]{Result: output})
+}
+
+// Create holds the credits of the user, the hold expires after the TTL if not captured or voided.
+func (a *Hold) Create(ctx *gear.Context) error {
+	input := &bll.HoldInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	ttl := input.TTL
+	if ttl == 0 {
+		ttl = a.cfg.TTL
+	}
+	if a.cfg.MaxTTL > 0 && ttl > a.cfg.MaxTTL {
+		return gear.ErrBadRequest.WithMsgf("ttl should not exceed %d seconds", a.cfg.MaxTTL)
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	input.UID = &sess.UserID
+	output, err := a.blls.Holds.Create(ctx, input, ttl)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "hold", output.ID.String())
+	return ctx.OkSend(bll.SuccessResponse[*bll.HoldOutput]{Result: output})
+}
+
+// Capture spends the credits of the hold, the amount can be less than the held amount.
+func (a *Hold) Capture(ctx *gear.Context) error {
+	input := &bll.CaptureHoldInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	input.UID = &sess.UserID
+	output, err := a.blls.Holds.Capture(ctx, input)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "txn", output.Txn.String())
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserCaptureHold, 1, sess.UserID, &bll.Payload{
+		Kind:    "transaction",
+		ID:      *output.Txn,
+		Payer:   sess.UserID,
+		Amount:  output.Captured,
+		Message: output.Kind,
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[*bll.HoldOutput]{Result: output})
+}
+
+func (a *Hold) Void(ctx *gear.Context) error {
+	input := &VoidHoldInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	output, err := a.blls.Holds.Void(ctx, sess.UserID, input.ID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return ctx.OkSend(bll.SuccessResponse[*bll.HoldOutput]{Result: output})
+}
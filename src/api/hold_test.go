@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func TestHold(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+
+	uid := util.NewID()
+	ctx := userCtx(uid)
+	env.base.AddTopup(uid, 1000)
+
+	hold := func(input *bll.HoldInput) (*bll.HoldOutput, error) {
+		output := bll.SuccessResponse[*bll.HoldOutput]{}
+		err := env.request(ctx, http.MethodPost, "/v1/wallet/hold", input, &output)
+		return output.Result, err
+	}
+	settle := func(action string, input any) (*bll.HoldOutput, error) {
+		output := bll.SuccessResponse[*bll.HoldOutput]{}
+		err := env.request(ctx, http.MethodPost, "/v1/wallet/hold/"+action, input, &output)
+		return output.Result, err
+	}
+	wallet := func(t *testing.T) *bll.WalletOutput {
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		if err := env.request(ctx, http.MethodGet, "/v1/wallet", nil, &output); err != nil {
+			t.Fatal(err)
+		}
+		return output.Result
+	}
+
+	t.Run("hold and capture", func(t *testing.T) {
+		assert := assert.New(t)
+
+		h, err := hold(&bll.HoldInput{Kind: "translation", Amount: 600})
+		assert.NoError(err)
+		assert.Equal(bll.HoldStatusActive, h.Status)
+		assert.Equal(int64(3600), h.ExpiresAt-h.CreatedAt)
+
+		w := wallet(t)
+		assert.Equal(int64(1000), w.Topup)
+		assert.Equal(int64(400), w.Available)
+
+		// the held credits can not be spent
+		_, err = hold(&bll.HoldInput{Kind: "translation", Amount: 500})
+		assert.ErrorContains(err, "code: 400")
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/sponsor", &bll.ExpendInput{Payee: util.NewID(), Amount: 500}, &output), "code: 400")
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", &bll.TransferInput{Payee: util.NewID(), Amount: 500}, &output), "code: 400")
+
+		_, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID, Amount: util.Ptr(int64(601))})
+		assert.ErrorContains(err, "code: 400")
+
+		// partial capture releases the rest
+		captured, err := settle("capture", &bll.CaptureHoldInput{ID: h.ID, Amount: util.Ptr(int64(300))})
+		assert.NoError(err)
+		assert.Equal(bll.HoldStatusCaptured, captured.Status)
+		assert.Equal(int64(300), captured.Captured)
+		assert.NotNil(captured.Txn)
+
+		w = wallet(t)
+		assert.Equal(int64(700), w.Topup)
+		assert.Equal(int64(700), w.Available)
+
+		_, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID})
+		assert.ErrorContains(err, "code: 409")
+		_, err = settle("void", &VoidHoldInput{ID: h.ID})
+		assert.ErrorContains(err, "code: 409")
+
+		logs := env.base.Logs()
+		last := logs[len(logs)-1]
+		assert.Equal(bll.LogActionUserCaptureHold, last.Action)
+
+		got := bll.SuccessResponse[*bll.HoldOutput]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/wallet/hold?id="+h.ID.String(), nil, &got))
+		assert.Equal(*captured.Txn, *got.Result.Txn)
+	})
+
+	t.Run("void", func(t *testing.T) {
+		assert := assert.New(t)
+
+		h, err := hold(&bll.HoldInput{Kind: "translation", Amount: 200})
+		assert.NoError(err)
+		assert.Equal(int64(500), wallet(t).Available)
+
+		voided, err := settle("void", &VoidHoldInput{ID: h.ID})
+		assert.NoError(err)
+		assert.Equal(bll.HoldStatusVoided, voided.Status)
+		assert.Equal(int64(700), wallet(t).Available)
+
+		voided, err = settle("void", &VoidHoldInput{ID: h.ID})
+		assert.NoError(err)
+		assert.Equal(bll.HoldStatusVoided, voided.Status)
+		_, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID})
+		assert.ErrorContains(err, "code: 409")
+		assert.Equal(int64(700), env.base.Wallet(uid).Topup)
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := hold(&bll.HoldInput{Kind: "translation", Amount: 100, TTL: 3600 * 48})
+		assert.ErrorContains(err, "code: 400")
+
+		h, err := hold(&bll.HoldInput{Kind: "translation", Amount: 700, TTL: 1})
+		assert.NoError(err)
+		assert.Equal(int64(0), wallet(t).Available)
+
+		time.Sleep(1100 * time.Millisecond)
+		assert.Equal(int64(700), wallet(t).Available)
+
+		got := bll.SuccessResponse[*bll.HoldOutput]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/wallet/hold?id="+h.ID.String(), nil, &got))
+		assert.Equal(bll.HoldStatusExpired, got.Result.Status)
+		_, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID})
+		assert.ErrorContains(err, "code: 409")
+	})
+
+	t.Run("capture failure", func(t *testing.T) {
+		assert := assert.New(t)
+
+		// the rejected expense leaves the hold active
+		h, err := hold(&bll.HoldInput{Kind: "translation", Amount: 600})
+		assert.NoError(err)
+		env.base.AddTopup(uid, -500)
+		_, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID})
+		assert.ErrorContains(err, "code: 400")
+		got := bll.SuccessResponse[*bll.HoldOutput]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/wallet/hold?id="+h.ID.String(), nil, &got))
+		assert.Equal(bll.HoldStatusActive, got.Result.Status)
+		env.base.AddTopup(uid, 500)
+		assert.Equal(int64(100), wallet(t).Available)
+
+		// the expense may have been made on an outage, the hold is capturing until a retry
+		env.base.Break("POST /v1/wallet/expend", true)
+		_, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID, Amount: util.Ptr(int64(500))})
+		assert.ErrorContains(err, "code: 503")
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/wallet/hold?id="+h.ID.String(), nil, &got))
+		assert.Equal(bll.HoldStatusCapturing, got.Result.Status)
+		assert.Equal(int64(100), wallet(t).Available)
+		_, err = settle("void", &VoidHoldInput{ID: h.ID})
+		assert.ErrorContains(err, "code: 409")
+		env.base.Break("POST /v1/wallet/expend", false)
+		_, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID, Amount: util.Ptr(int64(400))})
+		assert.ErrorContains(err, "code: 409")
+		captured, err := settle("capture", &bll.CaptureHoldInput{ID: h.ID})
+		assert.NoError(err)
+		assert.Equal(bll.HoldStatusCaptured, captured.Status)
+		assert.Equal(int64(500), captured.Captured)
+		assert.Equal(int64(200), env.base.Wallet(uid).Topup)
+		assert.Equal(int64(200), wallet(t).Available)
+
+		// the expense was made but its response was lost, the retry gets the same transaction
+		env.base.AddTopup(uid, 500)
+		h, err = hold(&bll.HoldInput{Kind: "translation", Amount: 300})
+		assert.NoError(err)
+		env.base.Lose("POST /v1/wallet/expend")
+		_, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID})
+		assert.ErrorContains(err, "code: 504")
+		assert.Equal(int64(400), env.base.Wallet(uid).Topup)
+		assert.Equal(int64(100), wallet(t).Available) // the captured credits are held until resolved
+		captured, err = settle("capture", &bll.CaptureHoldInput{ID: h.ID})
+		assert.NoError(err)
+		assert.Equal(bll.HoldStatusCaptured, captured.Status)
+		assert.Equal(int64(400), env.base.Wallet(uid).Topup)
+		assert.Equal(int64(400), wallet(t).Available)
+		env.base.AddTopup(uid, 300)
+	})
+
+	t.Run("spend under the holds lock", func(t *testing.T) {
+		assert := assert.New(t)
+		spender := util.NewID()
+		sctx := userCtx(spender)
+		util.HeaderFromCtx(sctx).Set("x-auth-app-scope", scopeRead+","+scopeSpend)
+
+		// the hold and the expense of the same credits never both succeed
+		for i := 0; i < 5; i++ {
+			env.base.AddTopup(spender, 100)
+			var wg sync.WaitGroup
+			var held, spent error
+			h := bll.SuccessResponse[*bll.HoldOutput]{}
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				held = env.request(userCtx(spender), http.MethodPost, "/v1/wallet/hold", &bll.HoldInput{Kind: "translation", Amount: 100}, &h)
+			}()
+			go func() {
+				defer wg.Done()
+				output := bll.SuccessResponse[*SpendOutput]{}
+				spent = env.request(sctx, http.MethodPost, "/v1/wallet/spend", &SpendInput{Kind: "translation", Quantity: 50000}, &output)
+			}()
+			wg.Wait()
+			assert.False(held == nil && spent == nil)
+			if held == nil {
+				_, err := env.blls.Holds.Void(context.Background(), spender, h.Result.ID)
+				assert.NoError(err)
+				env.base.AddTopup(spender, -100)
+			}
+			assert.Equal(int64(0), env.base.Wallet(spender).Topup)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 5)
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := hold(&bll.HoldInput{Kind: "translation", Amount: 100})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.NoError(err)
+		}
+		assert.Equal(int64(200), wallet(t).Available)
+	})
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Idempotency replays the first response of the requests with the same Idempotency-Key header,
+// so that the clients can retry the money-moving requests safely.
+// It should run after the auth middleware, the keys are scoped to the user and the route.
+type Idempotency struct {
+	redis *service.Redis
+}
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	idempotencyTTL            = 3600 * 24
+	idempotencyMaxBody        = 2 << 18 // the same as the body parser
+)
+
+type idempotentResponse struct {
+	Fingerprint []byte `cbor:"fingerprint"` // sha256 of the request body
+	Status      int    `cbor:"status"`
+	Type        string `cbor:"type"`
+	Body        []byte `cbor:"body"`
+}
+
+// Wrap returns the handler that honors the Idempotency-Key header,
+// the concurrent requests with the same key are rejected until the first one responded.
+func (a *Idempotency) Wrap(next gear.Middleware) gear.Middleware {
+	return func(ctx *gear.Context) error {
+		key := ctx.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			return next(ctx)
+		}
+		if len(key) > 255 {
+			return gear.ErrBadRequest.WithMsgf("%s should not exceed 255 characters", idempotencyKeyHeader)
+		}
+
+		sess := gear.CtxValue[middleware.Session](ctx)
+		if sess == nil {
+			return gear.ErrUnauthorized.WithMsg("invalid session")
+		}
+
+		body, err := io.ReadAll(io.LimitReader(ctx.Req.Body, idempotencyMaxBody+1))
+		if err != nil {
+			return gear.ErrBadRequest.WithMsgf("read body failed: %v", err)
+		}
+		if len(body) > idempotencyMaxBody {
+			return gear.ErrRequestEntityTooLarge.WithMsg("request entity too large")
+		}
+		ctx.Req.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+
+		logging.SetTo(ctx, "idempotencyKey", key)
+		rkey := "idempotency:" + sess.UserID.String() + ":" + ctx.Method + ctx.Path + ":" + key
+		if done, err := a.replay(ctx, rkey, sum[:]); done || err != nil {
+			return err
+		}
+
+		ok, err := a.redis.Lock(ctx, rkey, 60)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return gear.ErrConflict.WithMsgf("a request with the same %s is being processed", idempotencyKeyHeader)
+		}
+		defer a.redis.Unlock(middleware.WithGlobalCtx(ctx), rkey)
+
+		// the first request may have completed before the lock
+		if done, err := a.replay(ctx, rkey, sum[:]); done || err != nil {
+			return err
+		}
+
+		// the "after hooks" run when the handler responded successfully,
+		// the failed requests are not cached, they can be retried with the same key.
+		ctx.After(func() {
+			status := ctx.Res.Status()
+			if status < 200 || status >= 300 {
+				return
+			}
+			if err := a.redis.SetCBOR(middleware.WithGlobalCtx(ctx), rkey, &idempotentResponse{
+				Fingerprint: sum[:],
+				Status:      status,
+				Type:        ctx.Res.Type(),
+				Body:        ctx.Res.Body(),
+			}, idempotencyTTL); err != nil {
+				logging.SetTo(ctx, "idempotencyError", err.Error())
+			}
+		})
+		return next(ctx)
+	}
+}
+
+// replay ends the request with the cached response if exists,
+// the request body should be the same as the first request.
+func (a *Idempotency) replay(ctx *gear.Context, rkey string, fingerprint []byte) (bool, error) {
+	res := &idempotentResponse{}
+	if err := a.redis.GetCBOR(ctx, rkey, res); err != nil {
+		if util.IsNotFoundErr(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if !bytes.Equal(res.Fingerprint, fingerprint) {
+		return false, gear.ErrUnprocessableEntity.WithMsgf("the request does not match the first request with the same %s", idempotencyKeyHeader)
+	}
+
+	logging.SetTo(ctx, "idempotentReplayed", true)
+	ctx.SetHeader(idempotencyReplayedHeader, "true")
+	if res.Type != "" {
+		ctx.SetHeader(gear.HeaderContentType, res.Type)
+	}
+	return true, ctx.End(res.Status, res.Body)
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func TestIdempotency(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+
+	// keyCtx returns the context of the user with the Idempotency-Key header.
+	keyCtx := func(uid util.ID, key string) context.Context {
+		ctx := userCtx(uid)
+		util.HeaderFromCtx(ctx).Set(idempotencyKeyHeader, key)
+		return ctx
+	}
+
+	t.Run("transfer", func(t *testing.T) {
+		assert := assert.New(t)
+		payer, payee := util.NewID(), util.NewID()
+		env.base.AddTopup(payer, 1000)
+		calls := env.base.Calls("POST /v1/wallet/transfer")
+
+		ctx := keyCtx(payer, "k1")
+		input := &bll.TransferInput{Payee: payee, Amount: 100}
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output))
+		first := output.Result
+
+		output = bll.SuccessResponse[*bll.WalletOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output))
+		assert.Equal(first.Txn, output.Result.Txn)
+		assert.Equal(int64(900), output.Result.Topup)
+		assert.Equal(int64(100), env.base.Wallet(payee).Topup)
+		assert.Equal(calls+1, env.base.Calls("POST /v1/wallet/transfer"))
+
+		// the same key with another body
+		input.Amount = 200
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 422")
+
+		// the keys are scoped to the user and the route
+		assert.NoError(env.request(keyCtx(payer, "k2"), http.MethodPost, "/v1/wallet/transfer", input, &output))
+		assert.Equal(int64(700), output.Result.Topup)
+		env.base.AddTopup(payee, 1000)
+		assert.NoError(env.request(keyCtx(payee, "k1"), http.MethodPost, "/v1/wallet/transfer", &bll.TransferInput{Payee: payer, Amount: 100}, &output))
+		assert.Equal(int64(1200), output.Result.Topup)
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/sponsor", &bll.ExpendInput{Payee: payee, Amount: 100}, &output))
+		assert.Equal(int64(700), output.Result.Topup)
+		assert.Equal(calls+3, env.base.Calls("POST /v1/wallet/transfer"))
+	})
+
+	t.Run("failed requests are not cached", func(t *testing.T) {
+		assert := assert.New(t)
+		payer, payee := util.NewID(), util.NewID()
+		ctx := keyCtx(payer, "k1")
+
+		input := &bll.TransferInput{Payee: payee, Amount: 100}
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 400")
+
+		env.base.AddTopup(payer, 100)
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output))
+		assert.Equal(int64(0), output.Result.Topup)
+	})
+
+	t.Run("concurrent requests", func(t *testing.T) {
+		assert := assert.New(t)
+		payer, payee := util.NewID(), util.NewID()
+		env.base.AddTopup(payer, 1000)
+
+		key := "idempotency:" + payer.String() + ":POST/v1/wallet/transfer:k1"
+		ok, err := env.redis.Lock(context.Background(), key, 60)
+		assert.NoError(err)
+		assert.True(ok)
+
+		input := &bll.TransferInput{Payee: payee, Amount: 100}
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		assert.ErrorContains(env.request(keyCtx(payer, "k1"), http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 409")
+
+		assert.NoError(env.redis.Unlock(context.Background(), key))
+		assert.NoError(env.request(keyCtx(payer, "k1"), http.MethodPost, "/v1/wallet/transfer", input, &output))
+		assert.Equal(int64(900), output.Result.Topup)
+	})
+
+	t.Run("checkout", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx := keyCtx(util.NewID(), "k1")
+
+		output := bll.SuccessResponse[CheckoutOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Quantity: 100}, &output))
+		first := output.Result
+
+		output = bll.SuccessResponse[CheckoutOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout", &CheckoutInput{Quantity: 100}, &output))
+		assert.Equal(first.ID, output.Result.ID)
+		assert.Equal(first.PaymentURL, output.Result.PaymentURL)
+	})
+}
@@ -0,0 +1,453 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Payout pays out the income credits of the creators to their connected accounts,
+// the payouts are reviewed by the admins before the transfer.
+type Payout struct {
+	blls      *bll.Blls
+	providers *provider.Providers
+	cfg       conf.Payout
+}
+
+const payoutReviewTask = "payout.review"
+
+func (a *Payout) payouter() (provider.Provider, provider.Payouter, error) {
+	p, err := a.providers.Get(a.cfg.Provider)
+	if err != nil {
+		return nil, nil, err
+	}
+	po, ok := p.(provider.Payouter)
+	if !ok {
+		return nil, nil, gear.ErrBadRequest.WithMsgf("provider %s does not support payouts", p.Name())
+	}
+	return p, po, nil
+}
+
+// accountProvider is the provider name of the connected accounts in Walletbase customers.
+func accountProvider(p provider.Provider) string {
+	return p.Name() + ":connect"
+}
+
+// fee returns the fee in credits of the payout.
+func (a *Payout) fee(amount int64) int64 {
+	return a.cfg.FeeFixed + amount*int64(a.cfg.FeeRate)/10000
+}
+
+type PayoutAccount struct {
+	Provider         string  `json:"provider" cbor:"provider"`
+	Account          string  `json:"account" cbor:"account"`
+	DetailsSubmitted bool    `json:"details_submitted" cbor:"details_submitted"`
+	PayoutsEnabled   bool    `json:"payouts_enabled" cbor:"payouts_enabled"`
+	OnboardingURL    *string `json:"onboarding_url,omitempty" cbor:"onboarding_url,omitempty"`
+}
+
+// getAccount returns the connected account of the user, or nil if not created.
+func (a *Payout) getAccount(ctx *gear.Context, p provider.Provider, po provider.Payouter, uid util.ID) (*PayoutAccount, error) {
+	customer, err := a.blls.Walletbase.GetCustomer(ctx, uid, accountProvider(p), util.Ptr("customer"))
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	acct, err := po.GetAccount(ctx, customer.Customer)
+	if err != nil {
+		return nil, err
+	}
+	return &PayoutAccount{
+		Provider:         p.Name(),
+		Account:          acct.ID,
+		DetailsSubmitted: acct.DetailsSubmitted,
+		PayoutsEnabled:   acct.PayoutsEnabled,
+	}, nil
+}
+
+// GetAccount returns the connected account of the user, the result is null if not created.
+func (a *Payout) GetAccount(ctx *gear.Context) error {
+	p, po, err := a.payouter()
+	if err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	output, err := a.getAccount(ctx, p, po, sess.UserID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return ctx.OkSend(bll.SuccessResponse[*PayoutAccount]{Result: output})
+}
+
+// CreateAccount creates the connected account of the user if not created,
+// and returns the URL of the onboarding.
+func (a *Payout) CreateAccount(ctx *gear.Context) error {
+	p, po, err := a.payouter()
+	if err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	output, err := a.getAccount(ctx, p, po, sess.UserID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if output == nil {
+		acct, err := po.CreateAccount(ctx, sess.UserID)
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		if _, err = a.blls.Walletbase.UpsertCustomer(ctx, &bll.CustomerInput{
+			UID:      sess.UserID,
+			Provider: accountProvider(p),
+			Customer: acct.ID,
+			Payload:  acct.Payload,
+		}); err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+
+		output = &PayoutAccount{
+			Provider:         p.Name(),
+			Account:          acct.ID,
+			DetailsSubmitted: acct.DetailsSubmitted,
+			PayoutsEnabled:   acct.PayoutsEnabled,
+		}
+	}
+
+	logging.SetTo(ctx, "account", output.Account)
+	if !output.DetailsSubmitted || !output.PayoutsEnabled {
+		url, err := po.CreateAccountLink(ctx, output.Account)
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		output.OnboardingURL = util.Ptr(url)
+	}
+	return ctx.OkSend(bll.SuccessResponse[*PayoutAccount]{Result: output})
+}
+
+type PayoutInput struct {
+	Amount int64 `json:"amount" cbor:"amount" validate:"gte=1,lte=100000000"` // income credits to pay out, including the fee
+}
+
+func (i *PayoutInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+// Create requests a payout of the income credits, it will be paid out after the review.
+func (a *Payout) Create(ctx *gear.Context) error {
+	input := &PayoutInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	if input.Amount < a.cfg.MinAmount {
+		return gear.ErrBadRequest.WithMsgf("the minimum payout is %d credits", a.cfg.MinAmount)
+	}
+	fee := a.fee(input.Amount)
+	if fee >= input.Amount {
+		return gear.ErrBadRequest.WithMsgf("the payout fee %d exceeds the amount %d", fee, input.Amount)
+	}
+
+	p, po, err := a.payouter()
+	if err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	acct, err := a.getAccount(ctx, p, po, sess.UserID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if acct == nil || !acct.PayoutsEnabled {
+		return gear.ErrBadRequest.WithMsg("the payout account is not onboarded")
+	}
+
+	wallet, err := a.blls.Walletbase.Get(ctx, sess.UserID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if wallet.Income < input.Amount {
+		return gear.ErrBadRequest.WithMsgf("insufficient income credits, expected %d, got %d", input.Amount, wallet.Income)
+	}
+
+	output, err := a.blls.Walletbase.CreatePayout(ctx, &bll.PayoutInput{
+		UID:       sess.UserID,
+		Provider:  p.Name(),
+		Account:   acct.Account,
+		Amount:    input.Amount,
+		Fee:       fee,
+		Currency:  a.cfg.Currency,
+		PayAmount: (input.Amount - fee) * a.cfg.UnitAmount,
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "payoutId", output.ID.String())
+	a.createReviewTask(ctx, sess.UserID, output)
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserPayout, 0, sess.UserID, &bll.Payload{
+		Kind:   "payout",
+		ID:     output.ID,
+		Payer:  sess.UserID,
+		Amount: output.Amount,
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	output.Payload = nil
+	return ctx.OkSend(bll.SuccessResponse[*bll.PayoutOutput]{Result: output})
+}
+
+// createReviewTask assigns the review of the payout to the admins.
+func (a *Payout) createReviewTask(ctx *gear.Context, uid util.ID, payout *bll.PayoutOutput) {
+	admins := make([]util.ID, 0, len(conf.Config.Admin.UIDs))
+	for _, v := range conf.Config.Admin.UIDs {
+		if id, err := util.ParseID(v); err == nil {
+			admins = append(admins, id)
+		}
+	}
+	if len(admins) == 0 {
+		logging.SetTo(ctx, "createTaskError", "no admin to review")
+		return
+	}
+
+	a.blls.Taskbase.Create(ctx, &bll.CreateTaskInput{
+		UID:       uid,
+		GID:       uid,
+		Kind:      payoutReviewTask,
+		Threshold: 1,
+		Approvers: admins,
+		Assignees: admins,
+		Message:   "payout review",
+		Ref:       &payout.ID,
+	}, &bll.Payload{
+		Kind:   "payout",
+		ID:     payout.ID,
+		Payer:  uid,
+		Amount: payout.Amount,
+	})
+}
+
+// resolveReviewTask resolves the review task of the payout created by createReviewTask.
+func (a *Payout) resolveReviewTask(ctx *gear.Context, uid util.ID, payout *bll.PayoutOutput, status int8) {
+	input := &bll.ResolveTaskInput{
+		GID:      uid,
+		Kind:     payoutReviewTask,
+		Ref:      payout.ID,
+		Resolver: gear.CtxValue[middleware.Session](ctx).UserID,
+		Status:   status,
+	}
+	if payout.FailureMsg != nil {
+		input.Message = *payout.FailureMsg
+	}
+	a.blls.Taskbase.Resolve(middleware.WithGlobalCtx(ctx), input)
+}
+
+func (a *Payout) Get(ctx *gear.Context) error {
+	input := &bll.QueryId{}
+	if err := ctx.ParseURL(input); err != nil {
+		return err
+	}
+	sess := gear.CtxValue[middleware.Session](ctx)
+
+	output, err := a.blls.Walletbase.GetPayout(ctx, sess.UserID, input.ID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	output.Payload = nil
+	return ctx.OkSend(bll.SuccessResponse[*bll.PayoutOutput]{Result: output})
+}
+
+func (a *Payout) List(ctx *gear.Context) error {
+	input := &bll.UIDPagination{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+	sess := gear.CtxValue[middleware.Session](ctx)
+	input.UID = &sess.UserID
+
+	output, err := a.blls.Walletbase.ListPayouts(ctx, input)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	for i := range output.Result {
+		output.Result[i].Payload = nil
+	}
+	return ctx.OkSend(output)
+}
+
+type ReviewPayoutInput struct {
+	UID    util.ID `json:"uid" cbor:"uid" validate:"required"`
+	ID     util.ID `json:"id" cbor:"id" validate:"required"`
+	Reason *string `json:"reason,omitempty" cbor:"reason,omitempty" validate:"omitempty,gte=1,lte=1024"`
+}
+
+func (i *ReviewPayoutInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+// Approve approves the pending payout and transfers it to the connected account of the user,
+// the income credits are debited when the payout is paid. An approved payout whose transfer
+// did not go through, such as on a timeout, can be approved again to retry the transfer.
+func (a *Payout) Approve(ctx *gear.Context) error {
+	input := &ReviewPayoutInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	_, po, err := a.payouter()
+	if err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	logging.SetTo(ctx, "payoutId", input.ID.String())
+	payout, err := a.blls.Walletbase.GetPayout(ctx, input.UID, input.ID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	switch payout.Status {
+	case bll.PayoutStatusPending:
+		payout, err = a.blls.Walletbase.UpdatePayout(ctx, &bll.UpdatePayoutInput{
+			UID:           input.UID,
+			ID:            input.ID,
+			CurrentStatus: bll.PayoutStatusPending,
+			Status:        bll.PayoutStatusApproved,
+			Reviewer:      &sess.UserID,
+		})
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+	case bll.PayoutStatusApproved:
+		logging.SetTo(ctx, "retry", true)
+	default:
+		return gear.ErrConflict.WithMsgf("payout %s can not be approved, status %d", payout.ID.String(), payout.Status)
+	}
+	if payout.Account == nil {
+		return gear.ErrInternalServerError.WithMsg("payout account not found")
+	}
+
+	// the transfer is idempotent by the payout id
+	pout, err := po.CreatePayout(ctx, &provider.PayoutInput{
+		UID:      input.UID,
+		PayoutID: payout.ID,
+		Account:  *payout.Account,
+		Currency: payout.Currency,
+		Amount:   payout.PayAmount,
+	})
+	update := &bll.UpdatePayoutInput{
+		UID:           input.UID,
+		ID:            payout.ID,
+		CurrentStatus: bll.PayoutStatusApproved,
+		Status:        bll.PayoutStatusProcessing,
+	}
+	if err != nil {
+		logging.SetTo(ctx, "createPayoutError", err.Error())
+		// the transfer may have gone through, the payout stays approved to be retried
+		if !payoutRejected(err) {
+			return gear.ErrInternalServerError.From(err)
+		}
+		// the payout may be rejected after the transfer, the transfer is reversed before
+		// the payout fails, otherwise the income credits would be paid out again.
+		if er := po.ReverseTransfer(ctx, payout.ID); er != nil {
+			logging.SetTo(ctx, "reverseTransferError", er.Error())
+			return gear.ErrInternalServerError.From(er)
+		}
+		update.Status = bll.PayoutStatusFailed
+		update.FailureCode = util.Ptr("payout.create_failed")
+		update.FailureMsg = util.Ptr(err.Error())
+	} else {
+		update.TransferID = util.Ptr(pout.TransferID)
+		update.ProviderPayoutID = util.Ptr(pout.ID)
+		update.Payload = util.Ptr(pout.Payload)
+	}
+
+	output, er := a.blls.Walletbase.UpdatePayout(middleware.WithGlobalCtx(ctx), update)
+	if er != nil {
+		return gear.ErrInternalServerError.From(er)
+	}
+	// the review is done, even if the provider rejected the payout
+	a.resolveReviewTask(ctx, input.UID, output, bll.TaskApproved)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionSysPayout, 1, input.UID, &bll.Payload{
+		Kind:   "payout",
+		ID:     output.ID,
+		Payer:  input.UID,
+		Amount: output.Amount,
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	output.Payload = nil
+	return ctx.OkSend(bll.SuccessResponse[*bll.PayoutOutput]{Result: output})
+}
+
+// Reject rejects the pending payout, the income credits are available again.
+func (a *Payout) Reject(ctx *gear.Context) error {
+	input := &ReviewPayoutInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	logging.SetTo(ctx, "payoutId", input.ID.String())
+	update := &bll.UpdatePayoutInput{
+		UID:           input.UID,
+		ID:            input.ID,
+		CurrentStatus: bll.PayoutStatusPending,
+		Status:        bll.PayoutStatusRejected,
+		Reviewer:      &sess.UserID,
+		FailureCode:   util.Ptr("payout.rejected"),
+	}
+	if input.Reason != nil {
+		update.FailureMsg = input.Reason
+	}
+	output, err := a.blls.Walletbase.UpdatePayout(ctx, update)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	a.resolveReviewTask(ctx, input.UID, output, bll.TaskRejected)
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionSysPayout, -1, input.UID, &bll.Payload{
+		Kind:   "payout",
+		ID:     output.ID,
+		Payer:  input.UID,
+		Amount: output.Amount,
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	output.Payload = nil
+	return ctx.OkSend(bll.SuccessResponse[*bll.PayoutOutput]{Result: output})
+}
+
+// payoutRejected reports whether the provider rejected the payout for good. Other errors,
+// such as timeouts and server errors, leave the transfer unknown.
+func payoutRejected(err error) bool {
+	code := gear.Err.From(err).Code
+	return code >= 400 && code < 500 && code != http.StatusConflict && code != http.StatusTooManyRequests
+}
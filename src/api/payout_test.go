@@ -0,0 +1,258 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func TestPayout(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+	admin := util.NewID()
+	admins := conf.Config.Admin.UIDs
+	conf.Config.Admin.UIDs = []string{admin.String()}
+	defer func() { conf.Config.Admin.UIDs = admins }()
+
+	post := func(url string) *http.Response {
+		res, err := http.Post(url, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	request := func(uid util.ID, amount int64) (*bll.PayoutOutput, error) {
+		output := bll.SuccessResponse[*bll.PayoutOutput]{}
+		err := env.request(userCtx(uid), http.MethodPost, "/v1/payout", &PayoutInput{Amount: amount}, &output)
+		return output.Result, err
+	}
+	review := func(action string, uid, id util.ID) (*bll.PayoutOutput, error) {
+		output := bll.SuccessResponse[*bll.PayoutOutput]{}
+		err := env.request(userCtx(admin), http.MethodPost, "/v1/admin/payout/"+action, &ReviewPayoutInput{UID: uid, ID: id}, &output)
+		return output.Result, err
+	}
+	get := func(t *testing.T, uid, id util.ID) *bll.PayoutOutput {
+		output := bll.SuccessResponse[*bll.PayoutOutput]{}
+		if err := env.request(userCtx(uid), http.MethodGet, "/v1/payout?id="+id.String(), nil, &output); err != nil {
+			t.Fatal(err)
+		}
+		return output.Result
+	}
+
+	uid := util.NewID()
+	ctx := userCtx(uid)
+
+	t.Run("onboarding", func(t *testing.T) {
+		assert := assert.New(t)
+		env.base.AddIncome(uid, 10000)
+
+		_, err := request(uid, 6000)
+		assert.ErrorContains(err, "code: 400")
+
+		acct := bll.SuccessResponse[*PayoutAccount]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/payout/account", nil, &acct))
+		assert.Nil(acct.Result)
+
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/payout/account", nil, &acct))
+		assert.Equal("fake", acct.Result.Provider)
+		assert.False(acct.Result.PayoutsEnabled)
+		assert.NotNil(acct.Result.OnboardingURL)
+		account := acct.Result.Account
+
+		// the account is created once
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/payout/account", nil, &acct))
+		assert.Equal(account, acct.Result.Account)
+
+		_, err = request(uid, 6000)
+		assert.ErrorContains(err, "code: 400")
+
+		assert.Equal(http.StatusOK, post(*acct.Result.OnboardingURL).StatusCode)
+		acct = bll.SuccessResponse[*PayoutAccount]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/payout/account", nil, &acct))
+		assert.Equal(account, acct.Result.Account)
+		assert.True(acct.Result.PayoutsEnabled)
+		assert.Nil(acct.Result.OnboardingURL)
+	})
+
+	t.Run("request, approve and pay out", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := request(uid, 4999)
+		assert.ErrorContains(err, "code: 400")
+		_, err = request(uid, 20000)
+		assert.ErrorContains(err, "code: 400")
+
+		payout, err := request(uid, 6000)
+		assert.NoError(err)
+		assert.Equal(bll.PayoutStatusPending, payout.Status)
+		assert.Equal(int64(6000), payout.Amount)
+		assert.Equal(int64(400), payout.Fee) // 100 + 5%
+		assert.Equal(int64(5600), payout.PayAmount)
+		assert.Equal("usd", payout.Currency)
+
+		tasks := env.base.Tasks()
+		assert.Equal(1, len(tasks))
+		assert.Equal(payoutReviewTask, tasks[0].Kind)
+		assert.Equal(uid, tasks[0].UID)
+		assert.Equal([]util.ID{admin}, tasks[0].Approvers)
+
+		// the income of the pending payout is not available
+		_, err = request(uid, 5000)
+		assert.ErrorContains(err, "code: 400")
+
+		output := bll.SuccessResponse[*bll.PayoutOutput]{}
+		err = env.request(ctx, http.MethodPost, "/v1/admin/payout/approve", &ReviewPayoutInput{UID: uid, ID: payout.ID}, &output)
+		assert.ErrorContains(err, "code: 403")
+
+		approved, err := review("approve", uid, payout.ID)
+		assert.NoError(err)
+		assert.Equal(bll.PayoutStatusProcessing, approved.Status)
+		assert.Equal(admin, *approved.Reviewer)
+		assert.NotNil(approved.TransferID)
+		assert.NotNil(approved.ProviderPayoutID)
+		assert.Equal(1, env.provider.Calls("CreatePayout"))
+		assert.Equal(int64(10000), env.base.Wallet(uid).Income)
+
+		_, err = review("approve", uid, payout.ID)
+		assert.ErrorContains(err, "code: 409")
+		assert.Equal(1, env.provider.Calls("CreatePayout"))
+
+		resolved := env.base.ResolvedTasks()
+		assert.Equal(1, len(resolved))
+		assert.Equal(payoutReviewTask, resolved[0].Kind)
+		assert.Equal(payout.ID, resolved[0].Ref)
+		assert.Equal(admin, resolved[0].Resolver)
+		assert.Equal(bll.TaskApproved, resolved[0].Status)
+
+		assert.Equal(http.StatusOK, post(env.provider.srv.URL+"/payout/paid/"+*approved.ProviderPayoutID).StatusCode)
+		payout = get(t, uid, payout.ID)
+		assert.Equal(bll.PayoutStatusCompleted, payout.Status)
+		assert.NotNil(payout.Txn)
+		assert.Nil(payout.Payload)
+		assert.Equal(int64(4000), env.base.Wallet(uid).Income)
+
+		// a redelivered event is recorded once
+		assert.Equal(http.StatusOK, post(env.provider.srv.URL+"/payout/paid/"+*approved.ProviderPayoutID).StatusCode)
+		assert.Equal(int64(4000), env.base.Wallet(uid).Income)
+
+		logs := env.base.Logs()
+		last := logs[len(logs)-1]
+		assert.Equal(bll.LogActionUserPayout, last.Action)
+		assert.Equal(int8(1), last.Status)
+	})
+
+	t.Run("reject and fail", func(t *testing.T) {
+		assert := assert.New(t)
+		env.base.AddIncome(uid, 5000)
+
+		payout, err := request(uid, 5000)
+		assert.NoError(err)
+		rejected, err := review("reject", uid, payout.ID)
+		assert.NoError(err)
+		assert.Equal(bll.PayoutStatusRejected, rejected.Status)
+		_, err = review("approve", uid, payout.ID)
+		assert.ErrorContains(err, "code: 409")
+		resolved := env.base.ResolvedTasks()
+		assert.Equal(payout.ID, resolved[len(resolved)-1].Ref)
+		assert.Equal(bll.TaskRejected, resolved[len(resolved)-1].Status)
+
+		payout, err = request(uid, 9000)
+		assert.NoError(err)
+		approved, err := review("approve", uid, payout.ID)
+		assert.NoError(err)
+
+		assert.Equal(http.StatusOK, post(env.provider.srv.URL+"/payout/fail/"+*approved.ProviderPayoutID).StatusCode)
+		payout = get(t, uid, payout.ID)
+		assert.Equal(bll.PayoutStatusFailed, payout.Status)
+		assert.Equal("payout.account_closed", *payout.FailureCode)
+		assert.Equal(int64(9000), env.base.Wallet(uid).Income)
+		// the funds returned to the connected account are reversed to the platform
+		made, reversed := env.provider.Transfer(payout.ID)
+		assert.True(made)
+		assert.True(reversed)
+
+		list := bll.SuccessResponse[[]bll.PayoutOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/payout/list", &bll.UIDPagination{}, &list))
+		assert.Equal(3, len(list.Result))
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		assert := assert.New(t)
+		env.base.AddIncome(uid, 6000)
+
+		// the transfer may have gone through on a timeout, the payout can be approved again
+		payout, err := request(uid, 6000)
+		assert.NoError(err)
+		env.provider.FailPayout(gear.ErrGatewayTimeout.WithMsg("timeout"))
+		_, err = review("approve", uid, payout.ID)
+		assert.ErrorContains(err, "code: 504")
+		assert.Equal(bll.PayoutStatusApproved, get(t, uid, payout.ID).Status)
+
+		approved, err := review("approve", uid, payout.ID)
+		assert.NoError(err)
+		assert.Equal(bll.PayoutStatusProcessing, approved.Status)
+		assert.Equal(http.StatusOK, post(env.provider.srv.URL+"/payout/paid/"+*approved.ProviderPayoutID).StatusCode)
+
+		// the payout rejected by the provider fails
+		env.base.AddIncome(uid, 6000)
+		payout, err = request(uid, 6000)
+		assert.NoError(err)
+		env.provider.FailPayout(gear.ErrBadRequest.WithMsg("insufficient funds"))
+		_, err = review("approve", uid, payout.ID)
+		assert.ErrorContains(err, "code: 400")
+		payout = get(t, uid, payout.ID)
+		assert.Equal(bll.PayoutStatusFailed, payout.Status)
+		assert.Equal("payout.create_failed", *payout.FailureCode)
+		_, err = review("approve", uid, payout.ID)
+		assert.ErrorContains(err, "code: 409")
+
+		resolved := env.base.ResolvedTasks()
+		assert.Equal(payout.ID, resolved[len(resolved)-1].Ref)
+	})
+
+	t.Run("transfer reversed", func(t *testing.T) {
+		assert := assert.New(t)
+		env.base.AddIncome(uid, 7000)
+		income := env.base.Wallet(uid).Income
+
+		// the payout of the connected account is rejected after the transfer was made,
+		// it stays approved until the transfer is reversed
+		payout, err := request(uid, 7000)
+		assert.NoError(err)
+		env.provider.FailPayoutAfterTransfer(gear.ErrBadRequest.WithMsg("balance_insufficient"))
+		env.provider.FailReverse(gear.ErrServiceUnavailable.WithMsg("unavailable"))
+		_, err = review("approve", uid, payout.ID)
+		assert.ErrorContains(err, "code: 503")
+		assert.Equal(bll.PayoutStatusApproved, get(t, uid, payout.ID).Status)
+		made, reversed := env.provider.Transfer(payout.ID)
+		assert.True(made)
+		assert.False(reversed)
+
+		env.provider.FailPayout(gear.ErrBadRequest.WithMsg("balance_insufficient"))
+		_, err = review("approve", uid, payout.ID)
+		assert.ErrorContains(err, "code: 400")
+		payout = get(t, uid, payout.ID)
+		assert.Equal(bll.PayoutStatusFailed, payout.Status)
+		assert.Equal("payout.create_failed", *payout.FailureCode)
+		made, reversed = env.provider.Transfer(payout.ID)
+		assert.True(made)
+		assert.True(reversed)
+
+		// the income was not debited, the next payout transfers it once
+		assert.Equal(income, env.base.Wallet(uid).Income)
+		payout, err = request(uid, 7000)
+		assert.NoError(err)
+		approved, err := review("approve", uid, payout.ID)
+		assert.NoError(err)
+		assert.Equal(bll.PayoutStatusProcessing, approved.Status)
+		made, reversed = env.provider.Transfer(payout.ID)
+		assert.True(made)
+		assert.False(reversed)
+	})
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// the sessions not found with the provider are expired after the time,
+// such as the alipay QR codes that were never scanned.
+const reconcileNotFoundAfter = 24 * time.Hour
+
+// Reconciler sweeps the pending charges whose webhooks were missed.
+// It fetches the payment sessions from the providers, and completes or expires
+// the charges with the same handlers as the webhooks.
+type Reconciler struct {
+	checkout *Checkout
+	cfg      conf.Reconciler
+	app      *gear.App // for the contexts of the handlers
+
+	running atomic.Bool
+	mu      sync.Mutex
+	stats   ReconcileStats
+}
+
+func newReconciler(checkout *Checkout, cfg conf.Reconciler) *Reconciler {
+	return &Reconciler{checkout: checkout, cfg: cfg, app: gear.New()}
+}
+
+type ReconcileStats struct {
+	Runs      uint  `json:"runs" cbor:"runs"`
+	LastRunAt int64 `json:"last_run_at" cbor:"last_run_at"` // unix timestamp in seconds
+	Scanned   uint  `json:"scanned" cbor:"scanned"`
+	Completed uint  `json:"completed" cbor:"completed"`
+	Expired   uint  `json:"expired" cbor:"expired"`
+	Errors    uint  `json:"errors" cbor:"errors"`
+}
+
+func (s *ReconcileStats) add(o *ReconcileStats) {
+	s.Runs += o.Runs
+	s.LastRunAt = o.LastRunAt
+	s.Scanned += o.Scanned
+	s.Completed += o.Completed
+	s.Expired += o.Expired
+	s.Errors += o.Errors
+}
+
+// Stats returns the accumulated stats since the server started.
+func (r *Reconciler) Stats() ReconcileStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Start sweeps periodically until the global signal.
+func (r *Reconciler) Start() {
+	if r.cfg.Interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(r.cfg.Interval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-conf.Config.GlobalSignal.Done():
+				return
+			case <-ticker.C:
+				stats, err := r.Run(conf.Config.GlobalShutdown)
+				logging.Run(func() logging.Log {
+					log := logging.SrvLog("reconciler swept")
+					log["stats"] = stats
+					if err != nil {
+						log["error"] = err.Error()
+					}
+					return log
+				})
+			}
+		}
+	}()
+}
+
+// Run sweeps the pending charges once, and returns the stats of the run.
+func (r *Reconciler) Run(ctx context.Context) (*ReconcileStats, error) {
+	if !r.running.CompareAndSwap(false, true) {
+		return nil, gear.ErrConflict.WithMsg("reconciler is running")
+	}
+	defer r.running.Store(false)
+
+	conf.Config.ObtainJob()
+	defer conf.Config.ReleaseJob()
+
+	stats := &ReconcileStats{Runs: 1, LastRunAt: time.Now().Unix()}
+	defer func() {
+		r.mu.Lock()
+		r.stats.add(stats)
+		r.mu.Unlock()
+	}()
+
+	input := &bll.ScanChargesInput{
+		Status:        bll.ChargeStatusPending,
+		UpdatedBefore: util.Ptr(time.Now().Add(-time.Duration(r.cfg.StaleAfter) * time.Second).UnixMilli()),
+		PageSize:      util.Ptr(uint16(100)),
+	}
+	for {
+		output, err := r.checkout.blls.Walletbase.ScanCharges(withSystemCtx(ctx, util.JARVIS), input)
+		if err != nil {
+			return stats, err
+		}
+
+		for i := range output.Result {
+			stats.Scanned += 1
+			kind, err := r.reconcile(ctx, &output.Result[i])
+			switch {
+			case err != nil:
+				stats.Errors += 1
+			case kind == provider.EventSessionCompleted:
+				stats.Completed += 1
+			case kind == provider.EventSessionExpired:
+				stats.Expired += 1
+			}
+		}
+
+		if len(output.NextPageToken) == 0 || ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		input.PageToken = util.Ptr(output.NextPageToken)
+	}
+}
+
+// reconcile resolves the charge with the payment session, it returns the kind of the handled event.
+func (r *Reconciler) reconcile(ctx context.Context, charge *bll.ScanChargeOutput) (provider.EventKind, error) {
+	if charge.ChargeID == nil {
+		return provider.EventUnknown, nil
+	}
+
+	gctx := r.newContext(ctx, charge.UID)
+	logging.SetTo(gctx, "chargeId", charge.ID.String())
+	logging.SetTo(gctx, "checkoutId", *charge.ChargeID)
+	kind, err := r.resolve(gctx, charge)
+	if err != nil {
+		logging.SetTo(gctx, "error", err.Error())
+	}
+	if kind != provider.EventUnknown || err != nil {
+		logging.SetTo(gctx, "kind", kind)
+		logging.Run(func() logging.Log { return logging.FromCtx(gctx) })
+	}
+	return kind, err
+}
+
+func (r *Reconciler) resolve(ctx *gear.Context, charge *bll.ScanChargeOutput) (provider.EventKind, error) {
+	p, err := r.checkout.providers.Get(charge.Provider)
+	if err != nil {
+		return provider.EventUnknown, err
+	}
+
+	event := &provider.Event{
+		ID:       "reconcile:" + charge.ID.String(),
+		Type:     "reconcile",
+		UID:      charge.UID,
+		ChargeID: charge.ID,
+	}
+	cs, err := p.GetSession(ctx, *charge.ChargeID)
+	switch {
+	case util.IsNotFoundErr(err):
+		if time.Since(time.UnixMilli(charge.CreatedAt)) < reconcileNotFoundAfter {
+			return provider.EventUnknown, nil
+		}
+		cs = &provider.Session{ID: *charge.ChargeID, Closed: true}
+	case err != nil:
+		return provider.EventUnknown, err
+	}
+
+	switch {
+	case cs.Paid:
+		event.Kind = provider.EventSessionCompleted
+	case cs.Closed:
+		event.Kind = provider.EventSessionExpired
+	default:
+		// still open, or delayed payment methods that will be notified later
+		return provider.EventUnknown, nil
+	}
+
+	cs.UID = charge.UID
+	cs.ChargeID = charge.ID
+	event.Session = cs
+	return event.Kind, r.checkout.handleEvent(ctx, p, event)
+}
+
+// newContext returns a gear context for the handlers, the access log is written by the reconciler.
+func (r *Reconciler) newContext(ctx context.Context, uid util.ID) *gear.Context {
+	req, _ := http.NewRequestWithContext(withSystemCtx(ctx, uid), http.MethodPost, "/reconcile", nil)
+	req.RemoteAddr = "127.0.0.1:0"
+	gctx := gear.NewContext(r.app, &discardResponse{header: http.Header{}}, req)
+	withSystemSession(gctx, uid)
+	return gctx
+}
+
+// withSystemCtx returns a context with the auth headers of the system acting as the user.
+func withSystemCtx(ctx context.Context, uid util.ID) context.Context {
+	h := http.Header{}
+	h.Set("x-auth-user", uid.String())
+	h.Set("x-auth-app", util.JARVIS.String())
+	return gear.CtxWith[util.CtxHeader](ctx, util.Ptr(util.CtxHeader(h)))
+}
+
+type discardResponse struct {
+	header http.Header
+}
+
+func (w *discardResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponse) WriteHeader(int) {}
+
+// GetStats returns the stats of the reconciler.
+func (r *Reconciler) GetStats(ctx *gear.Context) error {
+	return ctx.OkSend(bll.SuccessResponse[ReconcileStats]{Result: r.Stats()})
+}
+
+// Sweep runs the reconciler immediately.
+func (r *Reconciler) Sweep(ctx *gear.Context) error {
+	stats, err := r.Run(ctx.Context())
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return ctx.OkSend(bll.SuccessResponse[*ReconcileStats]{Result: stats})
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func TestReconciler(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+	admin := util.NewID()
+	admins := conf.Config.Admin.UIDs
+	conf.Config.Admin.UIDs = []string{admin.String()}
+	defer func() { conf.Config.Admin.UIDs = admins }()
+
+	assert := assert.New(t)
+	post := func(url string) {
+		res, err := http.Post(url, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// the webhooks are missed
+	paid := util.NewID()
+	co := env.checkout(t, userCtx(paid), 100)
+	post(co.PaymentURL + "?silent=1")
+
+	expired := util.NewID()
+	co2 := env.checkout(t, userCtx(expired), 60)
+	charge := env.getCharge(t, userCtx(expired), co2.ID)
+	post(env.provider.srv.URL + "/expire/" + *charge.ChargeID + "?silent=1")
+
+	open := util.NewID()
+	co3 := env.checkout(t, userCtx(open), 80)
+
+	assert.Equal(bll.ChargeStatusPending, env.getCharge(t, userCtx(paid), co.ID).Status)
+	assert.Equal(int64(0), env.base.Wallet(paid).Topup)
+
+	output := bll.SuccessResponse[*ReconcileStats]{}
+	err := env.request(userCtx(paid), http.MethodPost, "/v1/admin/reconciler/sweep", nil, &output)
+	assert.Error(err)
+
+	assert.NoError(env.request(userCtx(admin), http.MethodPost, "/v1/admin/reconciler/sweep", nil, &output))
+	assert.Equal(uint(3), output.Result.Scanned)
+	assert.Equal(uint(1), output.Result.Completed)
+	assert.Equal(uint(1), output.Result.Expired)
+	assert.Equal(uint(0), output.Result.Errors)
+
+	assert.Equal(bll.ChargeStatusCompleted, env.getCharge(t, userCtx(paid), co.ID).Status)
+	assert.Equal(int64(100), env.base.Wallet(paid).Topup)
+	charge = env.getCharge(t, userCtx(expired), co2.ID)
+	assert.Equal(bll.ChargeStatusFailed, charge.Status)
+	assert.Equal("checkout.expired", *charge.FailureCode)
+	assert.Equal(bll.ChargeStatusPending, env.getCharge(t, userCtx(open), co3.ID).Status)
+
+	topups := 0
+	for _, log := range env.base.Logs() {
+		if log.UID == paid && log.Action == bll.LogActionUserTopup {
+			topups += 1
+		}
+	}
+	assert.Equal(1, topups)
+
+	// the late webhook is a no-op
+	res, err := http.Post(co.PaymentURL, "", nil)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(int64(100), env.base.Wallet(paid).Topup)
+
+	assert.NoError(env.request(userCtx(admin), http.MethodPost, "/v1/admin/reconciler/sweep", nil, &output))
+	assert.Equal(uint(1), output.Result.Scanned)
+	assert.Equal(uint(0), output.Result.Completed)
+
+	stats := bll.SuccessResponse[ReconcileStats]{}
+	assert.NoError(env.request(userCtx(admin), http.MethodGet, "/v1/admin/reconciler", nil, &stats))
+	assert.Equal(uint(2), stats.Result.Runs)
+	assert.Equal(uint(4), stats.Result.Scanned)
+	assert.Equal(uint(1), stats.Result.Completed)
+	assert.Equal(uint(1), stats.Result.Expired)
+}
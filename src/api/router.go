@@ -8,6 +8,8 @@ import (
 	"github.com/yiwen-ai/wallet-api/src/bll"
 	"github.com/yiwen-ai/wallet-api/src/conf"
 	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/service"
 	"github.com/yiwen-ai/wallet-api/src/util"
 )
 
@@ -18,22 +20,51 @@ func init() {
 
 // APIs ..
 type APIs struct {
-	Checkout    *Checkout
-	Healthz     *Healthz
-	Transaction *Transaction
-	Wallet      *Wallet
+	Checkout     *Checkout
+	Coupon       *Coupon
+	Healthz      *Healthz
+	Hold         *Hold
+	Idempotency  *Idempotency
+	Payout       *Payout
+	Reconciler   *Reconciler
+	Settlement   *Settlement
+	Subscription *Subscription
+	Transaction  *Transaction
+	Wallet       *Wallet
 }
 
-func newAPIs(blls *bll.Blls) *APIs {
+func newAPIs(blls *bll.Blls, redis *service.Redis, providers *provider.Providers) *APIs {
+	checkout := &Checkout{blls: blls, redis: redis, providers: providers, packages: conf.Config.Packages}
+	reconciler := newReconciler(checkout, conf.Config.Reconciler)
 	return &APIs{
-		Checkout:    &Checkout{blls: blls, cfg: conf.Config.Stripe},
-		Healthz:     &Healthz{blls},
-		Transaction: &Transaction{blls},
-		Wallet:      &Wallet{blls},
+		Checkout:     checkout,
+		Coupon:       &Coupon{blls},
+		Healthz:      &Healthz{blls: blls, reconciler: reconciler},
+		Hold:         &Hold{blls: blls, cfg: conf.Config.Hold},
+		Idempotency:  &Idempotency{redis: redis},
+		Payout:       &Payout{blls: blls, providers: providers, cfg: conf.Config.Payout},
+		Reconciler:   reconciler,
+		Settlement:   &Settlement{blls: blls, providers: providers},
+		Subscription: &Subscription{blls: blls, redis: redis, providers: providers, plans: conf.Config.Plans},
+		Transaction:  &Transaction{blls},
+		Wallet:       &Wallet{blls: blls, cfg: conf.Config.Sponsor, transfer: conf.Config.Transfer, billables: conf.Config.Billables},
 	}
 }
 
+// the scopes of the access tokens
+const (
+	scopeRead  = "wallet:read"  // the queries
+	scopeWrite = "wallet:write" // the changes, such as sponsoring and checkouts
+	scopeSpend = "wallet:spend" // the usage billed by other services
+)
+
 func newRouters(apis *APIs) []*gear.Router {
+	// the money-moving routes honor the Idempotency-Key header
+	idempotent := apis.Idempotency.Wrap
+	// every access_token route requires one of the scopes
+	read := middleware.RequireScope(scopeRead)
+	write := middleware.RequireScope(scopeWrite)
+	spend := middleware.RequireScope(scopeSpend)
 
 	router := gear.NewRouter()
 	router.Use(func(ctx *gear.Context) error {
@@ -54,19 +85,56 @@ func newRouters(apis *APIs) []*gear.Router {
 	router.Get("/currencies", middleware.AuthAllowAnon.Auth, apis.Wallet.ListCurrencies)
 
 	// access_token 访问
-	router.Get("/v1/wallet", middleware.AuthToken.Auth, apis.Wallet.Get)
-	router.Post("/v1/wallet/sponsor", middleware.AuthToken.Auth, middleware.CheckUserStatus(0), apis.Wallet.Sponsor)
-	router.Post("/v1/wallet/list_credits", middleware.AuthToken.Auth, apis.Wallet.ListCredits)
-
-	router.Post("/v1/transaction/list_outgo", middleware.AuthToken.Auth, apis.Transaction.ListOutgo)
-	router.Post("/v1/transaction/list_income", middleware.AuthToken.Auth, apis.Transaction.ListIncome)
-
-	router.Get("/v1/checkout/config", middleware.AuthToken.Auth, apis.Checkout.GetConfig)
-	router.Get("/v1/checkout", middleware.AuthToken.Auth, apis.Checkout.Get)
-	router.Post("/v1/checkout", middleware.AuthToken.Auth, middleware.CheckUserStatus(0), apis.Checkout.Create)
-	router.Post("/v1/checkout/list", middleware.AuthToken.Auth, apis.Checkout.ListCharges)
-
-	router.Post("/v1/webhook/stripe", apis.Checkout.StripeWebhook)
+	router.Get("/v1/wallet", middleware.AuthToken.Auth, read, apis.Wallet.Get)
+	router.Post("/v1/wallet/sponsor", middleware.AuthToken.Auth, write, middleware.CheckUserStatus(0), idempotent(apis.Wallet.Sponsor))
+	router.Post("/v1/wallet/transfer", middleware.AuthToken.Auth, write, middleware.CheckUserStatus(0), idempotent(apis.Wallet.Transfer))
+	router.Post("/v1/wallet/list_credits", middleware.AuthToken.Auth, read, apis.Wallet.ListCredits)
+	// 服务间调用
+	router.Post("/v1/wallet/spend", middleware.AuthToken.Auth, spend, idempotent(apis.Wallet.Spend))
+
+	router.Get("/v1/wallet/hold", middleware.AuthToken.Auth, read, apis.Hold.Get)
+	router.Post("/v1/wallet/hold", middleware.AuthToken.Auth, write, middleware.CheckUserStatus(0), idempotent(apis.Hold.Create))
+	router.Post("/v1/wallet/hold/capture", middleware.AuthToken.Auth, write, idempotent(apis.Hold.Capture))
+	router.Post("/v1/wallet/hold/void", middleware.AuthToken.Auth, write, apis.Hold.Void)
+
+	router.Post("/v1/transaction/list_outgo", middleware.AuthToken.Auth, read, apis.Transaction.ListOutgo)
+	router.Post("/v1/transaction/list_income", middleware.AuthToken.Auth, read, apis.Transaction.ListIncome)
+
+	router.Get("/v1/checkout/config", middleware.AuthToken.Auth, read, apis.Checkout.GetConfig)
+	router.Get("/v1/checkout/packages", middleware.AuthToken.Auth, read, apis.Checkout.ListPackages)
+	router.Get("/v1/checkout", middleware.AuthToken.Auth, read, apis.Checkout.Get)
+	router.Post("/v1/checkout", middleware.AuthToken.Auth, write, middleware.CheckUserStatus(0), idempotent(apis.Checkout.Create))
+	router.Post("/v1/checkout/list", middleware.AuthToken.Auth, read, apis.Checkout.ListCharges)
+	router.Post("/v1/checkout/gift/list", middleware.AuthToken.Auth, read, apis.Checkout.ListGifts)
+	router.Post("/v1/checkout/refund", middleware.AuthToken.Auth, write, middleware.CheckUserStatus(0), idempotent(apis.Checkout.Refund))
+	router.Post("/v1/checkout/portal", middleware.AuthToken.Auth, write, apis.Checkout.CreatePortal)
+	router.Get("/v1/checkout/payment_methods", middleware.AuthToken.Auth, read, apis.Checkout.ListPaymentMethods)
+	router.Get("/v1/checkout/receipt", middleware.AuthToken.Auth, read, apis.Checkout.Receipt)
+
+	router.Get("/v1/subscription/plans", middleware.AuthToken.Auth, read, apis.Subscription.ListPlans)
+	router.Get("/v1/subscription", middleware.AuthToken.Auth, read, apis.Subscription.Get)
+	router.Post("/v1/subscription", middleware.AuthToken.Auth, write, middleware.CheckUserStatus(0), idempotent(apis.Subscription.Create))
+	router.Post("/v1/subscription/cancel", middleware.AuthToken.Auth, write, apis.Subscription.Cancel)
+	router.Post("/v1/subscription/list", middleware.AuthToken.Auth, read, apis.Subscription.List)
+
+	router.Get("/v1/payout/account", middleware.AuthToken.Auth, read, apis.Payout.GetAccount)
+	router.Post("/v1/payout/account", middleware.AuthToken.Auth, write, middleware.CheckUserStatus(0), apis.Payout.CreateAccount)
+	router.Get("/v1/payout", middleware.AuthToken.Auth, read, apis.Payout.Get)
+	router.Post("/v1/payout", middleware.AuthToken.Auth, write, middleware.CheckUserStatus(0), idempotent(apis.Payout.Create))
+	router.Post("/v1/payout/list", middleware.AuthToken.Auth, read, apis.Payout.List)
+
+	router.Post("/v1/webhook/stripe", apis.Checkout.Webhook("stripe"))
+	router.Post("/v1/webhook/alipay", apis.Checkout.Webhook("alipay"))
+
+	router.Post("/v1/admin/webhook/list_failed", middleware.AuthToken.Auth, read, middleware.CheckAdmin, apis.Checkout.ListFailedEvents)
+	router.Post("/v1/admin/webhook/replay", middleware.AuthToken.Auth, write, middleware.CheckAdmin, apis.Checkout.ReplayEvent)
+	router.Get("/v1/admin/reconciler", middleware.AuthToken.Auth, read, middleware.CheckAdmin, apis.Reconciler.GetStats)
+	router.Post("/v1/admin/reconciler/sweep", middleware.AuthToken.Auth, write, middleware.CheckAdmin, apis.Reconciler.Sweep)
+	router.Get("/v1/admin/settlement", middleware.AuthToken.Auth, read, middleware.CheckAdmin, apis.Settlement.Get)
+	router.Post("/v1/admin/payout/approve", middleware.AuthToken.Auth, write, middleware.CheckAdmin, apis.Payout.Approve)
+	router.Post("/v1/admin/payout/reject", middleware.AuthToken.Auth, write, middleware.CheckAdmin, apis.Payout.Reject)
+	router.Get("/v1/admin/coupon", middleware.AuthToken.Auth, read, middleware.CheckAdmin, apis.Coupon.Get)
+	router.Post("/v1/admin/coupon", middleware.AuthToken.Auth, write, middleware.CheckAdmin, apis.Coupon.Save)
 
 	return []*gear.Router{router}
 }
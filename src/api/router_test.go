@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func TestScopes(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+
+	routes := []struct {
+		method string
+		path   string
+		scope  string
+	}{
+		{http.MethodGet, "/v1/wallet", scopeRead},
+		{http.MethodPost, "/v1/wallet/sponsor", scopeWrite},
+		{http.MethodPost, "/v1/wallet/transfer", scopeWrite},
+		{http.MethodPost, "/v1/wallet/list_credits", scopeRead},
+		{http.MethodPost, "/v1/wallet/spend", scopeSpend},
+		{http.MethodGet, "/v1/wallet/hold", scopeRead},
+		{http.MethodPost, "/v1/wallet/hold", scopeWrite},
+		{http.MethodPost, "/v1/wallet/hold/capture", scopeWrite},
+		{http.MethodPost, "/v1/wallet/hold/void", scopeWrite},
+		{http.MethodPost, "/v1/transaction/list_outgo", scopeRead},
+		{http.MethodPost, "/v1/transaction/list_income", scopeRead},
+		{http.MethodGet, "/v1/checkout/config", scopeRead},
+		{http.MethodGet, "/v1/checkout/packages", scopeRead},
+		{http.MethodGet, "/v1/checkout", scopeRead},
+		{http.MethodPost, "/v1/checkout", scopeWrite},
+		{http.MethodPost, "/v1/checkout/list", scopeRead},
+		{http.MethodPost, "/v1/checkout/gift/list", scopeRead},
+		{http.MethodPost, "/v1/checkout/refund", scopeWrite},
+		{http.MethodPost, "/v1/checkout/portal", scopeWrite},
+		{http.MethodGet, "/v1/checkout/payment_methods", scopeRead},
+		{http.MethodGet, "/v1/checkout/receipt", scopeRead},
+		{http.MethodGet, "/v1/subscription/plans", scopeRead},
+		{http.MethodGet, "/v1/subscription", scopeRead},
+		{http.MethodPost, "/v1/subscription", scopeWrite},
+		{http.MethodPost, "/v1/subscription/cancel", scopeWrite},
+		{http.MethodPost, "/v1/subscription/list", scopeRead},
+		{http.MethodGet, "/v1/payout/account", scopeRead},
+		{http.MethodPost, "/v1/payout/account", scopeWrite},
+		{http.MethodGet, "/v1/payout", scopeRead},
+		{http.MethodPost, "/v1/payout", scopeWrite},
+		{http.MethodPost, "/v1/payout/list", scopeRead},
+		{http.MethodPost, "/v1/admin/webhook/list_failed", scopeRead},
+		{http.MethodPost, "/v1/admin/webhook/replay", scopeWrite},
+		{http.MethodGet, "/v1/admin/reconciler", scopeRead},
+		{http.MethodPost, "/v1/admin/reconciler/sweep", scopeWrite},
+		{http.MethodGet, "/v1/admin/settlement", scopeRead},
+		{http.MethodPost, "/v1/admin/payout/approve", scopeWrite},
+		{http.MethodPost, "/v1/admin/payout/reject", scopeWrite},
+		{http.MethodGet, "/v1/admin/coupon", scopeRead},
+		{http.MethodPost, "/v1/admin/coupon", scopeWrite},
+	}
+
+	t.Run("denied without the scope", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		env.base.AddTopup(uid, 1000)
+
+		for _, r := range routes {
+			for _, scope := range []string{"", scopeRead, scopeWrite, scopeSpend} {
+				if scope == r.scope {
+					continue
+				}
+				ctx := userCtx(uid)
+				util.HeaderFromCtx(ctx).Set("x-auth-app-scope", scope)
+				var input any
+				if r.method == http.MethodPost {
+					input = map[string]any{}
+				}
+				output := bll.SuccessResponse[any]{}
+				assert.ErrorContains(env.request(ctx, r.method, r.path, input, &output), "code: 403", "%s %s with scope %q", r.method, r.path, scope)
+			}
+		}
+		assert.Equal(int64(1000), env.base.Wallet(uid).Topup)
+	})
+
+	t.Run("granted with the scope", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+		util.HeaderFromCtx(ctx).Set("x-auth-app-scope", scopeRead)
+
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/wallet", nil, &output))
+
+		// the write scope does not imply the read scope
+		util.HeaderFromCtx(ctx).Set("x-auth-app-scope", scopeWrite)
+		assert.ErrorContains(env.request(ctx, http.MethodGet, "/v1/wallet", nil, &output), "code: 403")
+		util.HeaderFromCtx(ctx).Set("x-auth-app-scope", scopeWrite+","+scopeRead)
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/wallet", nil, &output))
+	})
+}
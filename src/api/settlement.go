@@ -0,0 +1,347 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// the charges credited in the day may be created days before, such as with bank debits.
+const settlementLookback = 7 * 24 * time.Hour
+
+// the kinds of settlement mismatches
+const (
+	MismatchPaidNotCredited = "paid_not_credited"
+	MismatchCreditedNotPaid = "credited_not_paid"
+	MismatchAmount          = "amount_mismatch"
+)
+
+// Settlement matches the payments settled by the providers against the charges credited in Walletbase.
+type Settlement struct {
+	blls      *bll.Blls
+	providers *provider.Providers
+}
+
+type SettlementReport struct {
+	Date         string               `json:"date" cbor:"date"`
+	Provider     string               `json:"provider" cbor:"provider"`
+	Transactions int                  `json:"transactions" cbor:"transactions"` // payments settled in the day
+	Charges      int                  `json:"charges" cbor:"charges"`           // charges credited in the day
+	Mismatches   []SettlementMismatch `json:"mismatches" cbor:"mismatches"`
+	Taxes        []SettlementTax      `json:"taxes" cbor:"taxes"` // the taxes of the charges credited in the day
+}
+
+type SettlementTax struct {
+	Jurisdiction string `json:"jurisdiction" cbor:"jurisdiction"`
+	Currency     string `json:"currency" cbor:"currency"`
+	Charges      int    `json:"charges" cbor:"charges"`
+	Amount       int64  `json:"amount" cbor:"amount"` // the amounts paid, including the taxes
+	Tax          int64  `json:"tax" cbor:"tax"`
+}
+
+type SettlementMismatch struct {
+	Kind           string `json:"kind" cbor:"kind"`
+	TransactionID  string `json:"transaction_id" cbor:"transaction_id"`
+	PaymentID      string `json:"payment_id" cbor:"payment_id"`
+	UID            string `json:"uid" cbor:"uid"`
+	ChargeID       string `json:"charge_id" cbor:"charge_id"`
+	Currency       string `json:"currency" cbor:"currency"`
+	PaidAmount     int64  `json:"paid_amount" cbor:"paid_amount"`
+	CreditedAmount int64  `json:"credited_amount" cbor:"credited_amount"`
+}
+
+// Report builds the settlement report of the provider for the day in UTC.
+func (a *Settlement) Report(ctx context.Context, name string, day time.Time) (*SettlementReport, error) {
+	p, err := a.providers.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	settler, ok := p.(provider.Settler)
+	if !ok {
+		return nil, gear.ErrBadRequest.WithMsgf("provider %s does not support settlements", p.Name())
+	}
+
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	txs, err := settler.ListTransactions(ctx, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	charges, err := a.creditedCharges(ctx, p.Name(), from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[util.ID]*bll.ScanChargeOutput, len(charges))
+	byPayment := make(map[string]*bll.ScanChargeOutput, len(charges))
+	for i := range charges {
+		byID[charges[i].ID] = &charges[i]
+		if charges[i].ChargeID != nil {
+			byPayment[*charges[i].ChargeID] = &charges[i]
+		}
+	}
+
+	report := &SettlementReport{
+		Date:         from.Format(time.DateOnly),
+		Provider:     p.Name(),
+		Transactions: len(txs),
+		Charges:      len(charges),
+		Mismatches:   make([]SettlementMismatch, 0),
+	}
+	matched := make(map[util.ID]bool, len(charges))
+	for _, tx := range txs {
+		mismatch := SettlementMismatch{
+			TransactionID: tx.ID,
+			PaymentID:     tx.PaymentID,
+			Currency:      tx.Currency,
+			PaidAmount:    tx.Amount,
+		}
+		if tx.UID != util.ZeroID {
+			mismatch.UID = tx.UID.String()
+		}
+		if tx.ChargeID != util.ZeroID {
+			mismatch.ChargeID = tx.ChargeID.String()
+		}
+
+		charge, err := a.findCharge(ctx, &tx, byID, byPayment)
+		if err != nil {
+			return nil, err
+		}
+		if charge == nil || charge.Txn == nil {
+			mismatch.Kind = MismatchPaidNotCredited
+			report.Mismatches = append(report.Mismatches, mismatch)
+			continue
+		}
+
+		matched[charge.ID] = true
+		mismatch.UID = charge.UID.String()
+		mismatch.ChargeID = charge.ID.String()
+		if charge.Amount != nil {
+			mismatch.CreditedAmount = int64(*charge.Amount)
+		}
+		if charge.Currency == nil || *charge.Currency != tx.Currency || mismatch.CreditedAmount != tx.Amount {
+			mismatch.Kind = MismatchAmount
+			report.Mismatches = append(report.Mismatches, mismatch)
+		}
+	}
+
+	for _, charge := range charges {
+		if matched[charge.ID] {
+			continue
+		}
+		mismatch := SettlementMismatch{
+			Kind:     MismatchCreditedNotPaid,
+			UID:      charge.UID.String(),
+			ChargeID: charge.ID.String(),
+		}
+		if charge.Currency != nil {
+			mismatch.Currency = *charge.Currency
+		}
+		if charge.Amount != nil {
+			mismatch.CreditedAmount = int64(*charge.Amount)
+		}
+		report.Mismatches = append(report.Mismatches, mismatch)
+	}
+
+	sort.SliceStable(report.Mismatches, func(i, j int) bool {
+		if report.Mismatches[i].Kind != report.Mismatches[j].Kind {
+			return report.Mismatches[i].Kind < report.Mismatches[j].Kind
+		}
+		return report.Mismatches[i].ChargeID < report.Mismatches[j].ChargeID
+	})
+	report.Taxes = settlementTaxes(charges)
+	return report, nil
+}
+
+// settlementTaxes sums the taxes of the charges by jurisdiction and currency.
+func settlementTaxes(charges []bll.ScanChargeOutput) []SettlementTax {
+	output := make([]SettlementTax, 0)
+	index := make(map[[2]string]int)
+	for _, charge := range charges {
+		if charge.AmountTax == nil || charge.Currency == nil || charge.Amount == nil {
+			continue
+		}
+
+		key := [2]string{"", *charge.Currency}
+		if charge.TaxJurisdiction != nil {
+			key[0] = *charge.TaxJurisdiction
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(output)
+			index[key] = i
+			output = append(output, SettlementTax{Jurisdiction: key[0], Currency: key[1]})
+		}
+		output[i].Charges += 1
+		output[i].Amount += int64(*charge.Amount)
+		output[i].Tax += int64(*charge.AmountTax)
+	}
+
+	sort.Slice(output, func(i, j int) bool {
+		if output[i].Jurisdiction != output[j].Jurisdiction {
+			return output[i].Jurisdiction < output[j].Jurisdiction
+		}
+		return output[i].Currency < output[j].Currency
+	})
+	return output
+}
+
+// findCharge finds the charge of the payment in the charges credited in the day,
+// or in Walletbase for the charges credited in the other days.
+func (a *Settlement) findCharge(ctx context.Context, tx *provider.Transaction,
+	byID map[util.ID]*bll.ScanChargeOutput, byPayment map[string]*bll.ScanChargeOutput) (*bll.ScanChargeOutput, error) {
+	if tx.InvoiceID != "" {
+		return byPayment[tx.InvoiceID], nil
+	}
+	if tx.ChargeID == util.ZeroID {
+		return nil, nil
+	}
+	if charge, ok := byID[tx.ChargeID]; ok {
+		return charge, nil
+	}
+
+	charge, err := a.blls.Walletbase.GetCharge(withSystemCtx(ctx, tx.UID), tx.UID, tx.ChargeID, nil)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &bll.ScanChargeOutput{UID: tx.UID, ChargeOutput: *charge}, nil
+}
+
+// creditedCharges lists the charges of the provider credited in the time range,
+// including the ones refunded or disputed later.
+func (a *Settlement) creditedCharges(ctx context.Context, name string, from, to time.Time) ([]bll.ScanChargeOutput, error) {
+	ctx = withSystemCtx(ctx, util.JARVIS)
+	output := make([]bll.ScanChargeOutput, 0)
+	for _, status := range []int8{bll.ChargeStatusCompleted, bll.ChargeStatusRefunded, bll.ChargeStatusDisputed} {
+		input := &bll.ScanChargesInput{
+			Status:        status,
+			Provider:      util.Ptr(name),
+			CreatedAfter:  util.Ptr(from.Add(-settlementLookback).UnixMilli()),
+			CreatedBefore: util.Ptr(to.UnixMilli()),
+			PageSize:      util.Ptr(uint16(100)),
+		}
+		for {
+			res, err := a.blls.Walletbase.ScanCharges(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			for _, charge := range res.Result {
+				if charge.Txn == nil {
+					continue
+				}
+				if at := charge.Txn.UnixMs(); at >= from.UnixMilli() && at < to.UnixMilli() {
+					output = append(output, charge)
+				}
+			}
+
+			if len(res.NextPageToken) == 0 {
+				break
+			}
+			input.PageToken = util.Ptr(res.NextPageToken)
+		}
+	}
+	return output, nil
+}
+
+// WriteCSV writes the mismatches as CSV with a header row.
+func (r *SettlementReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"kind", "transaction_id", "payment_id", "uid", "charge_id", "currency", "paid_amount", "credited_amount"})
+	for _, m := range r.Mismatches {
+		_ = cw.Write([]string{
+			m.Kind, m.TransactionID, m.PaymentID, m.UID, m.ChargeID, m.Currency,
+			strconv.FormatInt(m.PaidAmount, 10), strconv.FormatInt(m.CreditedAmount, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Write writes the report in the format, "json" or "csv".
+func (r *SettlementReport) Write(w io.Writer, format string) error {
+	switch format {
+	case "csv":
+		return r.WriteCSV(w)
+	case "json", "":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	default:
+		return gear.ErrBadRequest.WithMsgf("unsupported format %q", format)
+	}
+}
+
+type SettlementInput struct {
+	Date     string `json:"date" cbor:"date" query:"date" validate:"required,datetime=2006-01-02"`
+	Provider string `json:"provider" cbor:"provider" query:"provider"` // the default provider if not set
+	Format   string `json:"format" cbor:"format" query:"format" validate:"omitempty,oneof=json csv"`
+}
+
+func (i *SettlementInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+// Get returns the settlement report of the day, as JSON or CSV.
+func (a *Settlement) Get(ctx *gear.Context) error {
+	input := &SettlementInput{}
+	if err := ctx.ParseURL(input); err != nil {
+		return err
+	}
+	if input.Provider == "" {
+		input.Provider = a.providers.Default
+	}
+
+	day, _ := time.Parse(time.DateOnly, input.Date)
+	report, err := a.Report(ctx.Context(), input.Provider, day)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if input.Format == "csv" {
+		buf := &bytes.Buffer{}
+		if err = report.WriteCSV(buf); err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		ctx.Type("text/csv; charset=utf-8")
+		return ctx.End(200, buf.Bytes())
+	}
+	return ctx.OkSend(bll.SuccessResponse[*SettlementReport]{Result: report})
+}
+
+// Settle writes the settlement report of the day to w, for the settlement command.
+func Settle(date, name, format string, w io.Writer) error {
+	day, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		return err
+	}
+
+	return util.DigInvoke(func(apis *APIs) error {
+		if name == "" {
+			name = apis.Settlement.providers.Default
+		}
+		report, err := apis.Settlement.Report(context.Background(), name, day)
+		if err != nil {
+			return err
+		}
+		return report.Write(w, format)
+	})
+}
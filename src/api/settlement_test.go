@@ -0,0 +1,115 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func TestSettlement(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+	admin := util.NewID()
+	admins := conf.Config.Admin.UIDs
+	conf.Config.Admin.UIDs = []string{admin.String()}
+	defer func() { conf.Config.Admin.UIDs = admins }()
+
+	assert := assert.New(t)
+	pay := func(uid util.ID, quantity uint, query string) CheckoutOutput {
+		co := env.checkout(t, userCtx(uid), quantity)
+		res, err := http.Post(co.PaymentURL+query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return co
+	}
+
+	matched := util.NewID()
+	pay(matched, 100, "")
+	pay(matched, 200, "?country=DE")
+	pay(util.NewID(), 50, "?country=DE")
+	pay(util.NewID(), 100, "?country=US-CA")
+
+	notCredited := util.NewID()
+	co1 := pay(notCredited, 60, "?silent=1")
+
+	mismatched := util.NewID()
+	co2 := pay(mismatched, 70, "")
+
+	notPaid := util.NewID()
+	co3 := pay(notPaid, 80, "")
+
+	env.provider.mu.Lock()
+	txs := env.provider.transactions[:0]
+	for _, tx := range env.provider.transactions {
+		switch tx.ChargeID {
+		case co2.ID:
+			tx.Amount -= 1
+		case co3.ID:
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	env.provider.transactions = txs
+	env.provider.mu.Unlock()
+
+	date := time.Now().UTC().Format(time.DateOnly)
+	output := bll.SuccessResponse[*SettlementReport]{}
+	err := env.request(userCtx(matched), http.MethodGet, "/v1/admin/settlement?date="+date, nil, &output)
+	assert.Error(err)
+	err = env.request(userCtx(admin), http.MethodGet, "/v1/admin/settlement?date=20231001", nil, &output)
+	assert.Error(err)
+
+	assert.NoError(env.request(userCtx(admin), http.MethodGet, "/v1/admin/settlement?date="+date, nil, &output))
+	report := output.Result
+	assert.Equal(date, report.Date)
+	assert.Equal("fake", report.Provider)
+	assert.Equal(6, report.Transactions)
+	assert.Equal(6, report.Charges)
+	assert.Equal(3, len(report.Mismatches))
+
+	assert.Equal(MismatchAmount, report.Mismatches[0].Kind)
+	assert.Equal(co2.ID.String(), report.Mismatches[0].ChargeID)
+	assert.Equal(int64(699), report.Mismatches[0].PaidAmount)
+	assert.Equal(int64(700), report.Mismatches[0].CreditedAmount)
+
+	assert.Equal(MismatchCreditedNotPaid, report.Mismatches[1].Kind)
+	assert.Equal(co3.ID.String(), report.Mismatches[1].ChargeID)
+	assert.Equal(notPaid.String(), report.Mismatches[1].UID)
+	assert.Equal(int64(800), report.Mismatches[1].CreditedAmount)
+
+	assert.Equal(MismatchPaidNotCredited, report.Mismatches[2].Kind)
+	assert.Equal(co1.ID.String(), report.Mismatches[2].ChargeID)
+	assert.Equal(int64(600), report.Mismatches[2].PaidAmount)
+
+	assert.Equal([]SettlementTax{
+		{Jurisdiction: "DE", Currency: "usd", Charges: 2, Amount: 3000, Tax: 500},
+		{Jurisdiction: "US-CA", Currency: "usd", Charges: 1, Amount: 1200, Tax: 200},
+	}, report.Taxes)
+
+	// another day
+	assert.NoError(env.request(userCtx(admin), http.MethodGet, "/v1/admin/settlement?date=2023-10-01", nil, &output))
+	assert.Equal(0, output.Result.Transactions)
+	assert.Equal(0, len(output.Result.Mismatches))
+
+	req, _ := http.NewRequest(http.MethodGet, env.srv.URL+"/v1/admin/settlement?format=csv&date="+date, nil)
+	for k, v := range util.HeaderFromCtx(userCtx(admin)) {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(4, len(lines))
+	assert.Equal("kind,transaction_id,payment_id,uid,charge_id,currency,paid_amount,credited_amount", lines[0])
+	assert.True(strings.HasPrefix(lines[1], MismatchAmount+","))
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/provider"
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+type Subscription struct {
+	blls      *bll.Blls
+	redis     *service.Redis
+	providers *provider.Providers
+	plans     []conf.Plan
+}
+
+// subscriber returns the provider of the name, or the default provider,
+// it should support recurring subscriptions.
+func (a *Subscription) subscriber(name string) (provider.Provider, provider.Subscriber, error) {
+	if name == "" {
+		name = a.providers.Default
+	}
+	p, err := a.providers.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, ok := p.(provider.Subscriber)
+	if !ok {
+		return nil, nil, gear.ErrBadRequest.WithMsgf("provider %s does not support subscriptions", name)
+	}
+	return p, s, nil
+}
+
+func (a *Subscription) getPlan(id string) (*conf.Plan, error) {
+	for i := range a.plans {
+		if a.plans[i].ID == id {
+			return &a.plans[i], nil
+		}
+	}
+	return nil, gear.ErrNotFound.WithMsgf("plan %s not found", id)
+}
+
+type SubscriptionPlan struct {
+	ID       string `json:"id" cbor:"id"`
+	Quantity uint   `json:"quantity" cbor:"quantity"`
+	Amount   int64  `json:"amount" cbor:"amount"`
+	Currency string `json:"currency" cbor:"currency"`
+}
+
+// ListPlans lists the subscription plans available with the provider.
+func (a *Subscription) ListPlans(ctx *gear.Context) error {
+	p, _, err := a.subscriber(ctx.Query("provider"))
+	if err != nil {
+		return err
+	}
+
+	output := make([]SubscriptionPlan, 0, len(a.plans))
+	for _, plan := range a.plans {
+		id, ok := plan.Prices[p.Name()]
+		if !ok {
+			continue
+		}
+
+		price, err := getPrice(ctx, a.redis, p, id)
+		if err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+		output = append(output, SubscriptionPlan{
+			ID:       plan.ID,
+			Quantity: plan.Quantity,
+			Amount:   price.UnitAmount,
+			Currency: price.Currency,
+		})
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[[]SubscriptionPlan]{Result: output})
+}
+
+type SubscriptionInput struct {
+	Plan     string  `json:"plan" cbor:"plan" validate:"required"`
+	Provider *string `json:"provider,omitempty" cbor:"provider,omitempty"` // the default provider if not set
+}
+
+func (i *SubscriptionInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+func (a *Subscription) Create(ctx *gear.Context) error {
+	input := &SubscriptionInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	name := ""
+	if input.Provider != nil {
+		name = *input.Provider
+	}
+	p, s, err := a.subscriber(name)
+	if err != nil {
+		return err
+	}
+
+	plan, err := a.getPlan(input.Plan)
+	if err != nil {
+		return err
+	}
+	priceID, ok := plan.Prices[p.Name()]
+	if !ok {
+		return gear.ErrBadRequest.WithMsgf("plan %s not available with %s", plan.ID, p.Name())
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	logging.SetTo(ctx, "plan", plan.ID)
+	output, err := a.blls.Walletbase.CreateSubscription(ctx, &bll.SubscriptionInput{
+		UID:      sess.UserID,
+		Provider: p.Name(),
+		Plan:     plan.ID,
+		Quantity: plan.Quantity,
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "subscriptionId", output.ID.String())
+	sessionInput := &provider.SubscriptionInput{
+		UID:            sess.UserID,
+		SubscriptionID: output.ID,
+		PriceID:        priceID,
+	}
+	if customer, _ := a.blls.Walletbase.GetCustomer(ctx, sess.UserID, p.Name(), util.Ptr("customer")); customer != nil {
+		sessionInput.Customer = customer.Customer
+	}
+	cs, err := s.CreateSubscriptionSession(ctx, sessionInput)
+	if err != nil {
+		logging.SetTo(ctx, "createSessionError", err.Error())
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "checkoutId", cs.ID)
+	output, err = a.blls.Walletbase.UpdateSubscription(ctx, &bll.UpdateSubscriptionInput{
+		UID:        sess.UserID,
+		ID:         output.ID,
+		CheckoutID: util.Ptr(cs.ID),
+		Payload:    util.Ptr(cs.Payload),
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	output.Payload = nil
+	output.PaymentURL = util.Ptr(cs.URL)
+	return ctx.OkSend(bll.SuccessResponse[*bll.SubscriptionOutput]{Result: output})
+}
+
+func (a *Subscription) Get(ctx *gear.Context) error {
+	input := &bll.QueryId{}
+	if err := ctx.ParseURL(input); err != nil {
+		return err
+	}
+	sess := gear.CtxValue[middleware.Session](ctx)
+
+	output, err := a.blls.Walletbase.GetSubscription(ctx, sess.UserID, input.ID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	output.Payload = nil
+	return ctx.OkSend(bll.SuccessResponse[*bll.SubscriptionOutput]{Result: output})
+}
+
+func (a *Subscription) List(ctx *gear.Context) error {
+	input := &bll.UIDPagination{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+	sess := gear.CtxValue[middleware.Session](ctx)
+	input.UID = &sess.UserID
+
+	output, err := a.blls.Walletbase.ListSubscriptions(ctx, input)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	for i := range output.Result {
+		output.Result[i].Payload = nil
+	}
+	return ctx.OkSend(output)
+}
+
+// Cancel cancels the subscription immediately, the credits of the paid cycles are kept.
+func (a *Subscription) Cancel(ctx *gear.Context) error {
+	input := &bll.QueryId{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	logging.SetTo(ctx, "subscriptionId", input.ID.String())
+	output, err := a.blls.Walletbase.GetSubscription(ctx, sess.UserID, input.ID)
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	if output.Status != bll.SubscriptionStatusCanceled {
+		_, s, err := a.subscriber(output.Provider)
+		if err != nil {
+			return err
+		}
+
+		update := &bll.UpdateSubscriptionInput{
+			UID:    sess.UserID,
+			ID:     output.ID,
+			Status: util.Ptr(bll.SubscriptionStatusCanceled),
+		}
+		// a subscription without the provider subscription was never paid
+		if output.SubscriptionID != nil {
+			sub, err := s.CancelSubscription(ctx, *output.SubscriptionID)
+			if err != nil {
+				logging.SetTo(ctx, "cancelSubscriptionError", err.Error())
+				return gear.ErrInternalServerError.From(err)
+			}
+			update.Payload = util.Ptr(sub.Payload)
+		}
+
+		if output, err = a.blls.Walletbase.UpdateSubscription(ctx, update); err != nil {
+			return gear.ErrInternalServerError.From(err)
+		}
+
+		if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserCancelPlan, 1, sess.UserID, &bll.Payload{
+			Kind: "subscription",
+			ID:   output.ID,
+		}); err != nil {
+			logging.SetTo(ctx, "writeLogError", err.Error())
+		}
+	}
+
+	output.Payload = nil
+	return ctx.OkSend(bll.SuccessResponse[*bll.SubscriptionOutput]{Result: output})
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func TestSubscription(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+
+	subscribe := func(t *testing.T, uid util.ID) *bll.SubscriptionOutput {
+		output := bll.SuccessResponse[*bll.SubscriptionOutput]{}
+		err := env.request(userCtx(uid), http.MethodPost, "/v1/subscription", &SubscriptionInput{Plan: "m1000"}, &output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output.Result
+	}
+	get := func(t *testing.T, uid, id util.ID) *bll.SubscriptionOutput {
+		output := bll.SuccessResponse[*bll.SubscriptionOutput]{}
+		if err := env.request(userCtx(uid), http.MethodGet, "/v1/subscription?id="+id.String(), nil, &output); err != nil {
+			t.Fatal(err)
+		}
+		return output.Result
+	}
+	post := func(url string) *http.Response {
+		res, err := http.Post(url, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	t.Run("plans", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx := userCtx(util.NewID())
+
+		plans := bll.SuccessResponse[[]SubscriptionPlan]{}
+		assert.NoError(env.request(ctx, http.MethodGet, "/v1/subscription/plans", nil, &plans))
+		assert.Equal(1, len(plans.Result))
+		assert.Equal("m1000", plans.Result[0].ID)
+		assert.Equal(uint(1000), plans.Result[0].Quantity)
+		assert.Equal(int64(8000), plans.Result[0].Amount)
+
+		output := bll.SuccessResponse[*bll.SubscriptionOutput]{}
+		err := env.request(ctx, http.MethodPost, "/v1/subscription", &SubscriptionInput{Plan: "y12000"}, &output)
+		assert.Error(err)
+		err = env.request(ctx, http.MethodPost, "/v1/subscription", &SubscriptionInput{Plan: "none"}, &output)
+		assert.Error(err)
+	})
+
+	t.Run("subscribe, renew and cancel", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		ctx := userCtx(uid)
+
+		sub := subscribe(t, uid)
+		assert.Equal(bll.SubscriptionStatusCreated, sub.Status)
+		assert.Equal("m1000", sub.Plan)
+		assert.Contains(*sub.PaymentURL, env.provider.srv.URL)
+		assert.Nil(sub.Payload)
+
+		// the user completes the subscription session
+		res := post(*sub.PaymentURL)
+		assert.Equal(http.StatusOK, res.StatusCode)
+		sub = get(t, uid, sub.ID)
+		assert.Equal(bll.SubscriptionStatusActive, sub.Status)
+		assert.NotNil(sub.SubscriptionID)
+		assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+
+		// each paid billing cycle tops up the credits
+		res = post(env.provider.srv.URL + "/renew/" + *sub.SubscriptionID)
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(int64(1000), env.base.Wallet(uid).Topup)
+		sub = get(t, uid, sub.ID)
+		assert.NotNil(sub.CurrentPeriodEnd)
+
+		res = post(env.provider.srv.URL + "/renew/" + *sub.SubscriptionID)
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(int64(2000), env.base.Wallet(uid).Topup)
+
+		charges := bll.SuccessResponse[[]bll.ChargeOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/checkout/list", &bll.Pagination{}, &charges))
+		assert.Equal(2, len(charges.Result))
+		assert.Equal(bll.ChargeStatusCompleted, charges.Result[0].Status)
+		assert.Equal(uint(8000), *charges.Result[0].Amount)
+
+		list := bll.SuccessResponse[[]bll.SubscriptionOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/subscription/list", &bll.Pagination{}, &list))
+		assert.Equal(1, len(list.Result))
+		assert.Equal(sub.ID, list.Result[0].ID)
+
+		actions := map[string]int{}
+		for _, log := range env.base.Logs() {
+			if log.UID == uid {
+				actions[log.Action] += 1
+			}
+		}
+		assert.Equal(1, actions[bll.LogActionUserSubscribePlan])
+		assert.Equal(2, actions[bll.LogActionSysRenewPlan])
+
+		output := bll.SuccessResponse[*bll.SubscriptionOutput]{}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/subscription/cancel", &bll.QueryId{ID: sub.ID}, &output))
+		assert.Equal(bll.SubscriptionStatusCanceled, output.Result.Status)
+		assert.NotNil(output.Result.CanceledAt)
+
+		// canceling again is a no-op
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/subscription/cancel", &bll.QueryId{ID: sub.ID}, &output))
+		assert.Equal(bll.SubscriptionStatusCanceled, output.Result.Status)
+
+		// the provider notifies the cancellation
+		res = post(env.provider.srv.URL + "/delete/" + *sub.SubscriptionID)
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(int64(2000), env.base.Wallet(uid).Topup)
+
+		// other users can not see the subscription
+		err := env.request(userCtx(util.NewID()), http.MethodGet, "/v1/subscription?id="+sub.ID.String(), nil, &output)
+		assert.Error(err)
+	})
+
+	t.Run("deleted by provider", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+
+		sub := subscribe(t, uid)
+		post(*sub.PaymentURL)
+		sub = get(t, uid, sub.ID)
+
+		res := post(env.provider.srv.URL + "/delete/" + *sub.SubscriptionID)
+		assert.Equal(http.StatusOK, res.StatusCode)
+		sub = get(t, uid, sub.ID)
+		assert.Equal(bll.SubscriptionStatusCanceled, sub.Status)
+
+		// no more credits after canceled
+		res = post(env.provider.srv.URL + "/renew/" + *sub.SubscriptionID)
+		assert.NotEqual(http.StatusOK, res.StatusCode)
+		assert.Equal(int64(0), env.base.Wallet(uid).Topup)
+	})
+}
@@ -1,15 +1,23 @@
 package api
 
 import (
+	"math"
+	"time"
+
 	"github.com/teambition/gear"
 
 	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/conf"
 	"github.com/yiwen-ai/wallet-api/src/logging"
 	"github.com/yiwen-ai/wallet-api/src/middleware"
+	"github.com/yiwen-ai/wallet-api/src/util"
 )
 
 type Wallet struct {
-	blls *bll.Blls
+	blls      *bll.Blls
+	cfg       conf.Sponsor
+	transfer  conf.Transfer
+	billables []conf.Billable
 }
 
 func (a *Wallet) ListCurrencies(ctx *gear.Context) error {
@@ -35,21 +43,65 @@ func (a *Wallet) Get(ctx *gear.Context) error {
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
 	}
+	if err = a.blls.Holds.SetAvailable(ctx, sess.UserID, output); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
 
 	return ctx.OkSend(bll.SuccessResponse[*bll.WalletOutput]{Result: output})
 }
 
+// SponsorInput sponsors the payee, the translator of the sponsored publication shares the amount.
+type SponsorInput struct {
+	bll.ExpendInput
+	Publication *bll.PublicationRef `json:"publication,omitempty" cbor:"publication,omitempty"`
+}
+
+func (i *SponsorInput) Validate() error {
+	if err := i.ExpendInput.Validate(); err != nil {
+		return err
+	}
+	// the sub-payee is resolved from the publication, never chosen by the payer
+	if i.SubPayee != nil {
+		return gear.ErrBadRequest.WithMsg("sub_payee is not allowed, use publication")
+	}
+	if i.Publication != nil {
+		return i.Publication.Validate()
+	}
+
+	return nil
+}
+
 func (a *Wallet) Sponsor(ctx *gear.Context) error {
-	input := &bll.ExpendInput{}
+	input := &SponsorInput{}
 	if err := ctx.ParseBody(input); err != nil {
 		return err
 	}
 
 	sess := gear.CtxValue[middleware.Session](ctx)
 	input.UID = &sess.UserID
-	input.SubPayee = nil // TODO: not supported yet
+	input.SubShares = nil
+	input.Kind = ""
+	input.RequestID = nil
+	if input.Publication != nil {
+		subPayee, err := a.resolveSubPayee(ctx, sess.UserID, input.Payee, input.Publication)
+		if err != nil {
+			return err
+		}
 
-	output, err := a.blls.Walletbase.Sponsor(ctx, input)
+		// nothing is shared if the payer is the translator, or the amount is too small
+		shares := input.Amount * int64(a.cfg.SubShareRate) / 10000
+		if subPayee != nil && shares > 0 {
+			input.SubPayee = subPayee
+			input.SubShares = &shares
+			logging.SetTo(ctx, "subPayee", subPayee.String())
+		}
+	}
+
+	var output *bll.WalletOutput
+	err := a.blls.Holds.Spend(ctx, sess.UserID, input.Amount, func(_ *bll.WalletOutput) (err error) {
+		output, err = a.blls.Walletbase.Sponsor(ctx, &input.ExpendInput)
+		return err
+	})
 	if err != nil {
 		return gear.ErrInternalServerError.From(err)
 	}
@@ -59,7 +111,7 @@ func (a *Wallet) Sponsor(ctx *gear.Context) error {
 		ID:       output.Txn,
 		Payer:    *input.UID,
 		Payee:    &input.Payee,
-		SubPayee: nil,
+		SubPayee: input.SubPayee,
 		Amount:   input.Amount,
 	}); err != nil {
 		logging.SetTo(ctx, "writeLogError", err.Error())
@@ -68,6 +120,208 @@ func (a *Wallet) Sponsor(ctx *gear.Context) error {
 	return ctx.OkSend(bll.SuccessResponse[*bll.WalletOutput]{Result: output})
 }
 
+// resolveSubPayee returns the translator of the publication as the sub-payee of a sponsorship,
+// the payee should be the group of the publication. It returns nil if the payer is the translator.
+func (a *Wallet) resolveSubPayee(ctx *gear.Context, payer, payee util.ID, ref *bll.PublicationRef) (*util.ID, error) {
+	pub, err := a.blls.Writingbase.GetPublication(ctx, ref)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, gear.ErrNotFound.WithMsgf("publication %s:%s:%d not found", ref.CID.String(), ref.Language, ref.Version)
+		}
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	if pub.Status < 0 {
+		return nil, gear.ErrBadRequest.WithMsgf("publication %s:%s:%d is not active", ref.CID.String(), ref.Language, ref.Version)
+	}
+	if pub.GID != payee {
+		return nil, gear.ErrBadRequest.WithMsgf("payee %s is not the group of the publication", payee.String())
+	}
+	if pub.Creator == payer || pub.Creator == payee {
+		return nil, nil
+	}
+
+	info, err := a.getUserOrGroup(ctx, pub.Creator)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, gear.ErrNotFound.WithMsgf("sub_payee %s not found", pub.Creator.String())
+		}
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	if info.Status < 0 {
+		return nil, gear.ErrBadRequest.WithMsgf("sub_payee %s is not active", pub.Creator.String())
+	}
+	return &pub.Creator, nil
+}
+
+// getUserOrGroup returns the info of the user, or of the group if no user has the id.
+func (a *Wallet) getUserOrGroup(ctx *gear.Context, id util.ID) (*bll.UserInfo, error) {
+	info, err := a.blls.Userbase.Get(ctx, id)
+	if util.IsNotFoundErr(err) {
+		info, err = a.blls.Userbase.GetGroup(ctx, id)
+	}
+	return info, err
+}
+
+// Transfer moves the topup credits of the user to another user or a group, within the daily limits.
+func (a *Wallet) Transfer(ctx *gear.Context) error {
+	input := &bll.TransferInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+
+	sess := gear.CtxValue[middleware.Session](ctx)
+	input.UID = &sess.UserID
+	input.Kind = bll.TransactionKindTransfer
+	if err := a.checkPayee(ctx, sess.UserID, input.Payee); err != nil {
+		return err
+	}
+
+	var output *bll.WalletOutput
+	err := a.blls.Holds.Spend(ctx, sess.UserID, input.Amount, func(_ *bll.WalletOutput) (err error) {
+		now := time.Now()
+		if err = a.blls.Transfers.Reserve(ctx, sess.UserID, input.Amount, a.transfer, now); err != nil {
+			return err
+		}
+
+		if output, err = a.blls.Walletbase.Transfer(ctx, input); err != nil {
+			if er := a.blls.Transfers.Release(middleware.WithGlobalCtx(ctx), sess.UserID, input.Amount, now); er != nil {
+				logging.SetTo(ctx, "releaseTransferError", er.Error())
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "txn", output.Txn.String())
+	payload := &bll.Payload{
+		Kind:    "transaction",
+		ID:      output.Txn,
+		Payer:   sess.UserID,
+		Payee:   &input.Payee,
+		Amount:  input.Amount,
+		Message: input.Description,
+	}
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserTransfer, 1, input.Payee, payload); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+	if _, err = a.blls.Logbase.LogAs(ctx, input.Payee, bll.LogActionUserReceiveTransfer, 1, sess.UserID, payload); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[*bll.WalletOutput]{Result: output})
+}
+
+// checkPayee checks that the payee of a transfer is an active user or group other than the payer.
+func (a *Wallet) checkPayee(ctx *gear.Context, payer, payee util.ID) error {
+	if payee == payer {
+		return gear.ErrBadRequest.WithMsg("can not transfer to yourself")
+	}
+	if payee == util.ZeroID {
+		return gear.ErrBadRequest.WithMsg("can not transfer to the system")
+	}
+
+	info, err := a.getUserOrGroup(ctx, payee)
+	if err != nil {
+		if util.IsNotFoundErr(err) {
+			return gear.ErrNotFound.WithMsgf("payee %s not found", payee.String())
+		}
+		return gear.ErrInternalServerError.From(err)
+	}
+	if info.Status < 0 {
+		return gear.ErrBadRequest.WithMsgf("payee %s is not active", payee.String())
+	}
+	return nil
+}
+
+type SpendInput struct {
+	Kind        string `json:"kind" cbor:"kind" validate:"required,lte=32"`
+	Quantity    uint   `json:"quantity" cbor:"quantity" validate:"gte=1,lte=1000000000"`
+	Description string `json:"description,omitempty" cbor:"description,omitempty" validate:"lte=280"`
+}
+
+func (i *SpendInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+type SpendOutput struct {
+	Txn     util.ID `json:"txn" cbor:"txn"`
+	Amount  int64   `json:"amount" cbor:"amount"`
+	Balance int64   `json:"balance" cbor:"balance"` // the available credits after the spending
+}
+
+// Spend charges the user for the usage of another service, by the unit price of the billable kind.
+func (a *Wallet) Spend(ctx *gear.Context) error {
+	input := &SpendInput{}
+	if err := ctx.ParseBody(input); err != nil {
+		return err
+	}
+	sess := gear.CtxValue[middleware.Session](ctx)
+
+	billable := a.billable(input.Kind)
+	if billable == nil {
+		return gear.ErrBadRequest.WithMsgf("unknown billable kind %q", input.Kind)
+	}
+	size := uint64(max(billable.UnitSize, 1))
+	units := int64((uint64(input.Quantity) + size - 1) / size)
+	if billable.UnitPrice > 0 && units > math.MaxInt64/billable.UnitPrice {
+		return gear.ErrBadRequest.WithMsgf("quantity %d of kind %q is too large", input.Quantity, input.Kind)
+	}
+	amount := units * billable.UnitPrice
+	if amount <= 0 {
+		return gear.ErrBadRequest.WithMsgf("invalid amount %d of kind %q", amount, input.Kind)
+	}
+
+	var output *bll.WalletOutput
+	err := a.blls.Holds.Spend(ctx, sess.UserID, amount, func(_ *bll.WalletOutput) (err error) {
+		output, err = a.blls.Walletbase.Expend(ctx, &bll.ExpendInput{
+			UID:         &sess.UserID,
+			Payee:       util.ZeroID,
+			Amount:      amount,
+			Kind:        billable.Kind,
+			Description: input.Description,
+		})
+		return err
+	})
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	if err = a.blls.Holds.SetAvailable(ctx, sess.UserID, output); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+
+	logging.SetTo(ctx, "txn", output.Txn.String())
+	if _, err = a.blls.Logbase.Log(ctx, bll.LogActionUserSpend, 1, sess.AppID, &bll.Payload{
+		Kind:    "transaction",
+		ID:      output.Txn,
+		Payer:   sess.UserID,
+		Amount:  amount,
+		Message: billable.Kind,
+	}); err != nil {
+		logging.SetTo(ctx, "writeLogError", err.Error())
+	}
+
+	return ctx.OkSend(bll.SuccessResponse[*SpendOutput]{Result: &SpendOutput{
+		Txn:     output.Txn,
+		Amount:  amount,
+		Balance: output.Available,
+	}})
+}
+
+func (a *Wallet) billable(kind string) *conf.Billable {
+	for i := range a.billables {
+		if a.billables[i].Kind == kind {
+			return &a.billables[i]
+		}
+	}
+	return nil
+}
+
 func (a *Wallet) ListCredits(ctx *gear.Context) error {
 	input := &bll.UIDPagination{}
 	if err := ctx.ParseBody(input); err != nil {
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/wallet-api/src/bll"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func TestWallet(t *testing.T) {
+	env := newCheckoutTestEnv(t)
+
+	t.Run("sponsor with sub-payee", func(t *testing.T) {
+		assert := assert.New(t)
+		payer, payee, translator := util.NewID(), util.NewID(), util.NewID()
+		ctx := userCtx(payer)
+		env.base.AddTopup(payer, 1000)
+		pub := &bll.PublicationOutput{GID: payee, CID: util.NewID(), Language: "eng", Version: 1, Creator: translator}
+		env.base.SetPublication(pub)
+		ref := &bll.PublicationRef{GID: payee, CID: pub.CID, Language: "eng", Version: 1}
+
+		// the sub-payee is not client input
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		input := &SponsorInput{ExpendInput: bll.ExpendInput{Payee: payee, Amount: 100, SubPayee: util.Ptr(util.NewID())}}
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/sponsor", input, &output), "code: 400")
+
+		input = &SponsorInput{ExpendInput: bll.ExpendInput{Payee: payee, Amount: 100}}
+		input.Publication = &bll.PublicationRef{GID: payee, CID: util.NewID(), Language: "eng", Version: 1}
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/sponsor", input, &output), "code: 404")
+		// the payee should be the group of the publication
+		input.Payee = util.NewID()
+		input.Publication = ref
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/sponsor", input, &output), "code: 400")
+
+		env.base.SetUser(translator, &bll.UserInfo{ID: util.Ptr(translator), Status: -1})
+		input.Payee = payee
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/sponsor", input, &output), "code: 400")
+		env.base.SetUser(translator, &bll.UserInfo{ID: util.Ptr(translator), CN: "translator", Name: "Translator"})
+
+		// the share is not client input
+		input.SubShares = util.Ptr(int64(100))
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/sponsor", input, &output))
+		assert.Equal(int64(900), output.Result.Topup)
+		assert.Equal(int64(60), env.base.Wallet(payee).Income) // 100 - 10 fee - 30 shares
+		assert.Equal(int64(30), env.base.Wallet(translator).Income)
+
+		logs := env.base.Logs()
+		last := logs[len(logs)-1]
+		assert.Equal(bll.LogActionUserSponsor, last.Action)
+		payload := &bll.Payload{}
+		assert.NoError(cbor.Unmarshal(last.Payload, payload))
+		assert.Equal(translator, *payload.SubPayee)
+
+		income := bll.SuccessResponse[bll.Transactions]{}
+		assert.NoError(env.request(userCtx(payee), http.MethodPost, "/v1/transaction/list_income", &bll.UIDPagination{}, &income))
+		assert.Equal(1, len(income.Result))
+		assert.Equal(int8(1), income.Result[0].Role)
+		assert.Equal(int64(60), income.Result[0].Income)
+		assert.NotNil(income.Result[0].SubPayeeInfo)
+
+		assert.NoError(env.request(userCtx(translator), http.MethodPost, "/v1/transaction/list_income", &bll.UIDPagination{}, &income))
+		assert.Equal(1, len(income.Result))
+		assert.Equal(int8(2), income.Result[0].Role)
+		assert.Equal(int64(30), income.Result[0].Income)
+		assert.NotNil(income.Result[0].PayeeInfo)
+	})
+
+	t.Run("sponsor with group sub-payee", func(t *testing.T) {
+		assert := assert.New(t)
+		payer, payee, team := util.NewID(), util.NewID(), util.NewID()
+		env.base.AddTopup(payer, 1000)
+		env.base.SetUser(team, nil)
+		env.base.SetGroup(team, &bll.UserInfo{ID: util.Ptr(team), CN: "team", Name: "Team"})
+		pub := &bll.PublicationOutput{GID: payee, CID: util.NewID(), Language: "eng", Version: 1, Creator: team}
+		env.base.SetPublication(pub)
+
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		input := &SponsorInput{
+			ExpendInput: bll.ExpendInput{Payee: payee, Amount: 100},
+			Publication: &bll.PublicationRef{GID: payee, CID: pub.CID, Language: "eng", Version: 1},
+		}
+		assert.NoError(env.request(userCtx(payer), http.MethodPost, "/v1/wallet/sponsor", input, &output))
+		assert.Equal(int64(30), env.base.Wallet(team).Income)
+	})
+
+	t.Run("sponsor without sub-payee", func(t *testing.T) {
+		assert := assert.New(t)
+		payer, payee, translator := util.NewID(), util.NewID(), util.NewID()
+		env.base.AddTopup(payer, 1000)
+
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		input := &SponsorInput{ExpendInput: bll.ExpendInput{Payee: payee, Amount: 100}}
+		assert.NoError(env.request(userCtx(payer), http.MethodPost, "/v1/wallet/sponsor", input, &output))
+		assert.Equal(int64(90), env.base.Wallet(payee).Income)
+
+		// too small to share
+		pub := &bll.PublicationOutput{GID: payee, CID: util.NewID(), Language: "eng", Version: 1, Creator: translator}
+		env.base.SetPublication(pub)
+		input.Amount = 3
+		input.Publication = &bll.PublicationRef{GID: payee, CID: pub.CID, Language: "eng", Version: 1}
+		assert.NoError(env.request(userCtx(payer), http.MethodPost, "/v1/wallet/sponsor", input, &output))
+		assert.Equal(int64(93), env.base.Wallet(payee).Income)
+		assert.Equal(int64(0), env.base.Wallet(translator).Income)
+
+		// the translator sponsoring the group shares nothing with themselves
+		env.base.AddTopup(translator, 1000)
+		input.Amount = 100
+		assert.NoError(env.request(userCtx(translator), http.MethodPost, "/v1/wallet/sponsor", input, &output))
+		assert.Equal(int64(183), env.base.Wallet(payee).Income)
+		assert.Equal(int64(0), env.base.Wallet(translator).Income)
+	})
+
+	t.Run("transfer", func(t *testing.T) {
+		assert := assert.New(t)
+		payer, payee := util.NewID(), util.NewID()
+		ctx := userCtx(payer)
+		env.base.AddTopup(payer, 20000)
+
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		input := &bll.TransferInput{Payee: payer, Amount: 100}
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 400")
+		input.Payee = util.ZeroID
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 400")
+		missing := util.NewID()
+		env.base.SetUser(missing, nil)
+		input.Payee = missing
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 404")
+		env.base.Break("POST /v1/user/batch_get_info", true)
+		input.Payee = payee
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 503")
+		env.base.Break("POST /v1/user/batch_get_info", false)
+		input = &bll.TransferInput{Payee: payee, Amount: 30000}
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 400")
+
+		input = &bll.TransferInput{Payee: payee, Amount: 6000, Description: "for the team"}
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output))
+		assert.Equal(int64(14000), output.Result.Topup)
+		assert.Equal(int64(6000), env.base.Wallet(payee).Topup)
+
+		logs := env.base.Logs()
+		sent, received := logs[len(logs)-2], logs[len(logs)-1]
+		assert.Equal(bll.LogActionUserTransfer, sent.Action)
+		assert.Equal(payer, sent.UID)
+		assert.Equal(payee, sent.GID)
+		assert.Equal(bll.LogActionUserReceiveTransfer, received.Action)
+		assert.Equal(payee, received.UID)
+		assert.Equal(payer, received.GID)
+		payload := &bll.Payload{}
+		assert.NoError(cbor.Unmarshal(received.Payload, payload))
+		assert.Equal(output.Result.Txn, payload.ID)
+		assert.Equal("for the team", payload.Message)
+
+		income := bll.SuccessResponse[bll.Transactions]{}
+		assert.NoError(env.request(userCtx(payee), http.MethodPost, "/v1/transaction/list_income", &bll.UIDPagination{}, &income))
+		assert.Equal(1, len(income.Result))
+		assert.Equal(bll.TransactionKindTransfer, income.Result[0].Kind)
+
+		// the daily limit is 10000 credits
+		input.Amount = 5000
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 429")
+		input.Amount = 4000
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output))
+		assert.Equal(int64(10000), output.Result.Topup)
+		input.Amount = 1
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 429")
+	})
+
+	t.Run("transfer to group", func(t *testing.T) {
+		assert := assert.New(t)
+		payer, group, closed := util.NewID(), util.NewID(), util.NewID()
+		ctx := userCtx(payer)
+		env.base.AddTopup(payer, 1000)
+		env.base.SetUser(group, nil)
+		env.base.SetGroup(group, &bll.UserInfo{ID: util.Ptr(group), CN: "team", Name: "Team"})
+		env.base.SetUser(closed, nil)
+		env.base.SetGroup(closed, &bll.UserInfo{ID: util.Ptr(closed), Status: -1})
+
+		output := bll.SuccessResponse[*bll.WalletOutput]{}
+		input := &bll.TransferInput{Payee: closed, Amount: 100}
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output), "code: 400")
+		input.Payee = group
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/transfer", input, &output))
+		assert.Equal(int64(900), output.Result.Topup)
+		assert.Equal(int64(100), env.base.Wallet(group).Topup)
+	})
+
+	t.Run("spend", func(t *testing.T) {
+		assert := assert.New(t)
+		uid := util.NewID()
+		env.base.AddTopup(uid, 100)
+
+		// 2 credits per 1000 tokens
+		output := bll.SuccessResponse[*SpendOutput]{}
+		input := &SpendInput{Kind: "translation", Quantity: 2500}
+		assert.ErrorContains(env.request(userCtx(uid), http.MethodPost, "/v1/wallet/spend", input, &output), "code: 403")
+
+		ctx := userCtx(uid)
+		util.HeaderFromCtx(ctx).Set("x-auth-app-scope", scopeRead+","+scopeSpend)
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/spend", &SpendInput{Kind: "summarization", Quantity: 1}, &output), "code: 400")
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/spend", &SpendInput{Kind: "translation", Quantity: 0}, &output), "code: 400")
+
+		// the partial units are charged in full
+		assert.NoError(env.request(ctx, http.MethodPost, "/v1/wallet/spend", input, &output))
+		assert.Equal(int64(6), output.Result.Amount)
+		assert.Equal(int64(94), output.Result.Balance)
+		assert.Equal(int64(94), env.base.Wallet(uid).Topup)
+
+		logs := env.base.Logs()
+		last := logs[len(logs)-1]
+		assert.Equal(bll.LogActionUserSpend, last.Action)
+		assert.Equal(uid, last.UID)
+		assert.Equal(util.JARVIS, last.GID)
+		payload := &bll.Payload{}
+		assert.NoError(cbor.Unmarshal(last.Payload, payload))
+		assert.Equal(output.Result.Txn, payload.ID)
+
+		input.Quantity = 50000
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/spend", input, &output), "code: 400")
+		assert.Equal(int64(94), env.base.Wallet(uid).Topup)
+
+		// the amount that overflows is rejected before loading the wallet
+		input.Quantity = 1000000001
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/spend", input, &output), "code: 400")
+		calls := env.base.Calls("GET /v1/wallet")
+		input = &SpendInput{Kind: "rendering", Quantity: 1<<24 + 1}
+		assert.ErrorContains(env.request(ctx, http.MethodPost, "/v1/wallet/spend", input, &output), "code: 400")
+		assert.Equal(calls, env.base.Calls("GET /v1/wallet"))
+		assert.Equal(int64(94), env.base.Wallet(uid).Topup)
+	})
+}
@@ -17,22 +17,35 @@ func init() {
 
 // Blls ...
 type Blls struct {
-	ExternalAPI *ExternalAPI
-	Logbase     *Logbase
-	Taskbase    *Taskbase
-	Userbase    *Userbase
-	Walletbase  *Walletbase
+	ExternalAPI   *ExternalAPI
+	Logbase       *Logbase
+	Taskbase      *Taskbase
+	Userbase      *Userbase
+	Walletbase    *Walletbase
+	Writingbase   *Writingbase
+	Coupons       *Coupons
+	Receipts      *Receipts
+	Transfers     *Transfers
+	Holds         *Holds
+	WebhookEvents WebhookEventStore
 }
 
 // NewBlls ...
 func NewBlls(redis *service.Redis) *Blls {
 	cfg := conf.Config.Base
+	walletbase := &Walletbase{svc: service.APIHost(cfg.Walletbase)}
 	return &Blls{
-		ExternalAPI: &ExternalAPI{redis: redis},
-		Logbase:     &Logbase{svc: service.APIHost(cfg.Logbase)},
-		Taskbase:    &Taskbase{svc: service.APIHost(cfg.Taskbase)},
-		Userbase:    &Userbase{svc: service.APIHost(cfg.Userbase)},
-		Walletbase:  &Walletbase{svc: service.APIHost(cfg.Walletbase)},
+		ExternalAPI:   &ExternalAPI{redis: redis},
+		Logbase:       &Logbase{svc: service.APIHost(cfg.Logbase)},
+		Taskbase:      &Taskbase{svc: service.APIHost(cfg.Taskbase)},
+		Userbase:      &Userbase{svc: service.APIHost(cfg.Userbase)},
+		Walletbase:    walletbase,
+		Writingbase:   &Writingbase{svc: service.APIHost(cfg.Writingbase)},
+		Coupons:       &Coupons{redis: redis},
+		Receipts:      &Receipts{redis: redis},
+		Transfers:     &Transfers{redis: redis},
+		Holds:         &Holds{redis: redis, walletbase: walletbase},
+		WebhookEvents: &redisEventStore{redis: redis},
 	}
 }
 
@@ -95,6 +108,9 @@ type Payload struct {
 	Payee    *util.ID `json:"payee,omitempty" cbor:"payee,omitempty"`
 	SubPayee *util.ID `json:"sub_payee,omitempty" cbor:"sub_payee,omitempty"`
 	Amount   int64    `json:"amount" cbor:"amount"`
+	Coupon   string   `json:"coupon,omitempty" cbor:"coupon,omitempty"`
+	Discount int64    `json:"discount,omitempty" cbor:"discount,omitempty"` // the amount discounted
+	Message  string   `json:"message,omitempty" cbor:"message,omitempty"`
 }
 
 type QueryId struct {
@@ -126,3 +142,15 @@ func (cs Currencies) Validate(cur string) error {
 
 	return gear.ErrBadRequest.From(gear.ErrBadRequest.WithMsgf("currency %s not supported", cur))
 }
+
+// Get returns the currency of the alpha code, nil if not supported.
+func (cs Currencies) Get(cur string) *Currency {
+	cur = strings.ToUpper(cur)
+	for i := range cs {
+		if cs[i].Alpha == cur {
+			return &cs[i]
+		}
+	}
+
+	return nil
+}
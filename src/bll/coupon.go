@@ -0,0 +1,133 @@
+package bll
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Coupons is the Redis-backed coupon table, the discounts are applied by the providers.
+type Coupons struct {
+	redis *service.Redis
+}
+
+type Coupon struct {
+	Code           string            `json:"code" cbor:"code" validate:"required,alphanum,gte=3,lte=32"`
+	Discounts      map[string]string `json:"discounts" cbor:"discounts" validate:"required,gt=0"` // provider => provider coupon id
+	MaxRedemptions uint              `json:"max_redemptions" cbor:"max_redemptions"`              // 0 for unlimited
+	PerUser        uint              `json:"per_user" cbor:"per_user"`                            // redemptions per user, 0 for unlimited
+	ExpiresAt      int64             `json:"expires_at" cbor:"expires_at" validate:"gt=0"`        // unix timestamp in seconds
+	CreatedAt      int64             `json:"created_at" cbor:"created_at"`
+	Redeemed       uint              `json:"redeemed" cbor:"redeemed"`
+}
+
+func (i *Coupon) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+// the retention of coupons after expiry in seconds
+const couponRetention = 3600 * 24 * 30
+
+func couponKey(code string) string {
+	return "coupon:" + strings.ToUpper(code)
+}
+
+func (c *Coupon) ttl() uint {
+	ttl := c.ExpiresAt - time.Now().Unix() + couponRetention
+	if ttl <= 0 {
+		return 1
+	}
+	return uint(ttl)
+}
+
+// Save creates or updates the coupon, the redemptions are kept.
+func (b *Coupons) Save(ctx context.Context, coupon *Coupon) (*Coupon, error) {
+	coupon.Code = strings.ToUpper(coupon.Code)
+	if old, err := b.Get(ctx, coupon.Code); err == nil {
+		coupon.CreatedAt = old.CreatedAt
+	} else if !util.IsNotFoundErr(err) {
+		return nil, err
+	}
+	if coupon.CreatedAt == 0 {
+		coupon.CreatedAt = time.Now().Unix()
+	}
+
+	coupon.Redeemed = 0
+	if err := b.redis.SetCBOR(ctx, couponKey(coupon.Code), coupon, coupon.ttl()); err != nil {
+		return nil, err
+	}
+	return b.Get(ctx, coupon.Code)
+}
+
+func (b *Coupons) Get(ctx context.Context, code string) (*Coupon, error) {
+	output := &Coupon{}
+	if err := b.redis.GetCBOR(ctx, couponKey(code), output); err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, gear.ErrNotFound.WithMsgf("coupon %s not found", strings.ToUpper(code))
+		}
+		return nil, err
+	}
+
+	n, err := b.redis.GetInt(ctx, couponKey(code)+":redeemed")
+	if err != nil {
+		return nil, err
+	}
+	output.Redeemed = uint(n)
+	return output, nil
+}
+
+// Redeem validates the coupon for the user and the provider, and counts a redemption.
+// It returns the provider coupon id.
+func (b *Coupons) Redeem(ctx context.Context, code string, uid util.ID, provider string) (string, error) {
+	coupon, err := b.Get(ctx, code)
+	if err != nil {
+		return "", err
+	}
+	if coupon.ExpiresAt <= time.Now().Unix() {
+		return "", gear.ErrBadRequest.WithMsgf("coupon %s expired", coupon.Code)
+	}
+	id, ok := coupon.Discounts[provider]
+	if !ok {
+		return "", gear.ErrBadRequest.WithMsgf("coupon %s not available with %s", coupon.Code, provider)
+	}
+
+	key := couponKey(coupon.Code)
+	n, err := b.redis.IncrBy(ctx, key+":redeemed", 1, coupon.ttl())
+	if err != nil {
+		return "", err
+	}
+	if coupon.MaxRedemptions > 0 && n > int64(coupon.MaxRedemptions) {
+		_, _ = b.redis.IncrBy(ctx, key+":redeemed", -1, 0)
+		return "", gear.ErrBadRequest.WithMsgf("coupon %s exhausted", coupon.Code)
+	}
+
+	n, err = b.redis.IncrBy(ctx, key+":"+uid.String(), 1, coupon.ttl())
+	if err == nil && coupon.PerUser > 0 && n > int64(coupon.PerUser) {
+		_, _ = b.redis.IncrBy(ctx, key+":"+uid.String(), -1, 0)
+		err = gear.ErrBadRequest.WithMsgf("coupon %s redemption limit reached", coupon.Code)
+	}
+	if err != nil {
+		_, _ = b.redis.IncrBy(ctx, key+":redeemed", -1, 0)
+		return "", err
+	}
+	return id, nil
+}
+
+// Release gives back a redemption of the user, such as when the checkout expires.
+func (b *Coupons) Release(ctx context.Context, code string, uid util.ID) error {
+	key := couponKey(code)
+	if _, err := b.redis.IncrBy(ctx, key+":redeemed", -1, 0); err != nil {
+		return err
+	}
+	_, err := b.redis.IncrBy(ctx, key+":"+uid.String(), -1, 0)
+	return err
+}
@@ -0,0 +1,346 @@
+package bll
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/logging"
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Holds reserves the topup credits of the users before the long jobs, the holds are captured or voided later.
+// The holds are kept in Redis, the active holds of a user are indexed by their expiry in a sorted set.
+type Holds struct {
+	redis      *service.Redis
+	walletbase *Walletbase
+}
+
+const (
+	HoldStatusExpired  int8 = -2
+	HoldStatusVoided   int8 = -1
+	HoldStatusActive   int8 = 0
+	HoldStatusCaptured int8 = 1
+	// the expense of the hold is being made, it may have been made on a failure,
+	// the credits stay held until a retry of the capture resolves it
+	HoldStatusCapturing int8 = 2
+)
+
+const (
+	// the retention of the holds after they are settled or expired, in seconds
+	holdRetention = 3600 * 24 * 7
+	// the active holds a user can have at the same time
+	holdMaxActive = 100
+)
+
+type HoldInput struct {
+	UID         *util.ID `json:"uid" cbor:"uid"` // 非客户端参数
+	Kind        string   `json:"kind" cbor:"kind" validate:"required,lte=32"`
+	Amount      int64    `json:"amount" cbor:"amount" validate:"gte=1,lte=1000000"`
+	TTL         uint     `json:"ttl,omitempty" cbor:"ttl,omitempty"` // in seconds, 0 for the default TTL
+	Description string   `json:"description,omitempty" cbor:"description,omitempty" validate:"lte=280"`
+}
+
+func (i *HoldInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+type CaptureHoldInput struct {
+	UID    *util.ID `json:"uid" cbor:"uid"` // 非客户端参数
+	ID     util.ID  `json:"id" cbor:"id" validate:"required"`
+	Amount *int64   `json:"amount,omitempty" cbor:"amount,omitempty" validate:"omitempty,gte=1"` // the full amount of the hold if omitted
+}
+
+func (i *CaptureHoldInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+type HoldOutput struct {
+	ID          util.ID  `json:"id" cbor:"id"`
+	UID         util.ID  `json:"uid" cbor:"uid"`
+	Kind        string   `json:"kind" cbor:"kind"`
+	Status      int8     `json:"status" cbor:"status"`
+	Amount      int64    `json:"amount" cbor:"amount"`
+	Captured    int64    `json:"captured" cbor:"captured"`
+	Txn         *util.ID `json:"txn,omitempty" cbor:"txn,omitempty"`
+	Description string   `json:"description,omitempty" cbor:"description,omitempty"`
+	CreatedAt   int64    `json:"created_at" cbor:"created_at"` // unix timestamp in seconds
+	ExpiresAt   int64    `json:"expires_at" cbor:"expires_at"` // unix timestamp in seconds
+}
+
+func (o *HoldOutput) active(now int64) bool {
+	return o.Status == HoldStatusActive && o.ExpiresAt > now
+}
+
+func holdKey(uid, id util.ID) string {
+	return "hold:" + uid.String() + ":" + id.String()
+}
+
+func activeHoldsKey(uid util.ID) string {
+	return "holds:" + uid.String()
+}
+
+func (b *Holds) Get(ctx context.Context, uid, id util.ID) (*HoldOutput, error) {
+	output := &HoldOutput{}
+	if err := b.redis.GetCBOR(ctx, holdKey(uid, id), output); err != nil {
+		if util.IsNotFoundErr(err) {
+			return nil, gear.ErrNotFound.WithMsgf("hold %s not found", id.String())
+		}
+		return nil, err
+	}
+
+	if output.Status == HoldStatusActive && !output.active(time.Now().Unix()) {
+		output.Status = HoldStatusExpired
+	}
+	return output, nil
+}
+
+// Held returns the credits held by the active holds of the user, the settled and expired holds are removed from the index.
+func (b *Holds) Held(ctx context.Context, uid util.ID) (int64, error) {
+	held, _, err := b.held(ctx, uid)
+	return held, err
+}
+
+// SetAvailable sets the available credits of the user's wallet.
+func (b *Holds) SetAvailable(ctx context.Context, uid util.ID, wallet *WalletOutput) error {
+	held, err := b.Held(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	wallet.Available = max(wallet.Topup-held, 0)
+	return nil
+}
+
+func (b *Holds) held(ctx context.Context, uid util.ID) (int64, int, error) {
+	ids, err := b.redis.ZRevRange(ctx, activeHoldsKey(uid), 0, holdMaxActive*2)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now().Unix()
+	held, count := int64(0), 0
+	for _, s := range ids {
+		id, err := util.ParseID(s)
+		if err == nil {
+			hold, er := b.Get(ctx, uid, id)
+			if er == nil && (hold.active(now) || hold.Status == HoldStatusCapturing) {
+				held += hold.Amount
+				count++
+				continue
+			}
+			if er != nil && !util.IsNotFoundErr(er) {
+				return 0, 0, er
+			}
+		}
+		if err = b.redis.ZRem(ctx, activeHoldsKey(uid), s); err != nil {
+			return 0, 0, err
+		}
+	}
+	return held, count, nil
+}
+
+// Create holds the credits of the user for the ttl in seconds, the available credits should be enough.
+func (b *Holds) Create(ctx context.Context, input *HoldInput, ttl uint) (*HoldOutput, error) {
+	uid := *input.UID
+	if err := b.lock(ctx, uid); err != nil {
+		return nil, err
+	}
+	defer b.redis.Unlock(ctx, activeHoldsKey(uid))
+
+	wallet, err := b.walletbase.Get(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	held, count, err := b.held(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if count >= holdMaxActive {
+		return nil, gear.ErrTooManyRequests.WithMsgf("too many active holds, the limit is %d", holdMaxActive)
+	}
+	if available := wallet.Topup - held; available < input.Amount {
+		return nil, gear.ErrBadRequest.WithMsgf("insufficient available credits, expected %d, got %d", input.Amount, available)
+	}
+
+	now := time.Now().Unix()
+	hold := &HoldOutput{
+		ID:          util.NewID(),
+		UID:         uid,
+		Kind:        input.Kind,
+		Status:      HoldStatusActive,
+		Amount:      input.Amount,
+		Description: input.Description,
+		CreatedAt:   now,
+		ExpiresAt:   now + int64(ttl),
+	}
+	if err = b.redis.SetCBOR(ctx, holdKey(uid, hold.ID), hold, ttl+holdRetention); err != nil {
+		return nil, err
+	}
+	if err = b.redis.ZAdd(ctx, activeHoldsKey(uid), hold.ExpiresAt, hold.ID.String()); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// Capture spends the captured credits of the active hold, it can be less than the held amount,
+// the rest are released. A capture that failed with the hold capturing should be retried.
+func (b *Holds) Capture(ctx context.Context, input *CaptureHoldInput) (*HoldOutput, error) {
+	uid := *input.UID
+	if err := b.lock(ctx, uid); err != nil {
+		return nil, err
+	}
+	defer b.redis.Unlock(ctx, activeHoldsKey(uid))
+
+	hold, err := b.Get(ctx, uid, input.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch hold.Status {
+	case HoldStatusActive:
+		amount := hold.Amount
+		if input.Amount != nil {
+			amount = *input.Amount
+		}
+		if amount > hold.Amount {
+			return nil, gear.ErrBadRequest.WithMsgf("capture amount %d exceeds the held amount %d", amount, hold.Amount)
+		}
+
+		// the hold is capturing before the expense, so that a retry never spends twice
+		hold.Status = HoldStatusCapturing
+		hold.Captured = amount
+		if err = b.restore(ctx, hold); err != nil {
+			return nil, err
+		}
+
+	case HoldStatusCapturing:
+		if input.Amount != nil && *input.Amount != hold.Captured {
+			return nil, gear.ErrConflict.WithMsgf("hold %s is being captured with %d credits", hold.ID.String(), hold.Captured)
+		}
+		logging.Warningf("Holds.Capture: retry the capture of hold %s", hold.ID.String())
+
+	default:
+		return nil, gear.ErrConflict.WithMsgf("hold %s is not active, status %d", hold.ID.String(), hold.Status)
+	}
+
+	// Walletbase makes one expense for the hold id, the retries get the same transaction
+	wallet, err := b.walletbase.Expend(ctx, &ExpendInput{
+		UID:         &uid,
+		Payee:       util.ZeroID,
+		Amount:      hold.Captured,
+		Kind:        hold.Kind,
+		Description: hold.Description,
+		RequestID:   &hold.ID,
+	})
+	if err != nil {
+		// the hold stays capturing if the expense may have been made, such as on a timeout
+		if code := gear.Err.From(err).Code; code >= 400 && code < 500 && code != http.StatusConflict {
+			hold.Status = HoldStatusActive
+			hold.Captured = 0
+			if er := b.restore(ctx, hold); er != nil {
+				logging.Warningf("Holds.Capture: failed to restore hold %s: %v", hold.ID.String(), er)
+			}
+		}
+		return nil, err
+	}
+
+	hold.Status = HoldStatusCaptured
+	hold.Txn = &wallet.Txn
+	if err = b.settle(ctx, hold); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// Spend runs the expense of the topup credits of the user under the lock of the holds,
+// so that the credits being spent are not held at the same time. The credits that are not held
+// should cover the amount, the wallet with the available credits is passed to the expense.
+func (b *Holds) Spend(ctx context.Context, uid util.ID, amount int64, expend func(wallet *WalletOutput) error) error {
+	if err := b.lock(ctx, uid); err != nil {
+		return err
+	}
+	defer b.redis.Unlock(ctx, activeHoldsKey(uid))
+
+	wallet, err := b.walletbase.Get(ctx, uid)
+	if err != nil {
+		return err
+	}
+	held, _, err := b.held(ctx, uid)
+	if err != nil {
+		return err
+	}
+	wallet.Available = max(wallet.Topup-held, 0)
+	if wallet.Available < amount {
+		return gear.ErrBadRequest.WithMsgf("insufficient available credits, expected %d, got %d", amount, wallet.Available)
+	}
+
+	return expend(wallet)
+}
+
+// Void releases the held credits of the hold, voiding a voided or expired hold is a no-op.
+func (b *Holds) Void(ctx context.Context, uid, id util.ID) (*HoldOutput, error) {
+	if err := b.lock(ctx, uid); err != nil {
+		return nil, err
+	}
+	defer b.redis.Unlock(ctx, activeHoldsKey(uid))
+
+	hold, err := b.Get(ctx, uid, id)
+	if err != nil {
+		return nil, err
+	}
+	switch hold.Status {
+	case HoldStatusCaptured, HoldStatusCapturing:
+		return nil, gear.ErrConflict.WithMsgf("hold %s is captured", hold.ID.String())
+	case HoldStatusVoided, HoldStatusExpired:
+		return hold, nil
+	}
+
+	hold.Status = HoldStatusVoided
+	return hold, b.settle(ctx, hold)
+}
+
+func (b *Holds) settle(ctx context.Context, hold *HoldOutput) error {
+	if err := b.redis.SetCBOR(ctx, holdKey(hold.UID, hold.ID), hold, holdRetention); err != nil {
+		return err
+	}
+	return b.redis.ZRem(ctx, activeHoldsKey(hold.UID), hold.ID.String())
+}
+
+// restore makes the hold active again until it expires.
+func (b *Holds) restore(ctx context.Context, hold *HoldOutput) error {
+	ttl := max(hold.ExpiresAt-time.Now().Unix(), 1)
+	if err := b.redis.SetCBOR(ctx, holdKey(hold.UID, hold.ID), hold, uint(ttl)+holdRetention); err != nil {
+		return err
+	}
+	return b.redis.ZAdd(ctx, activeHoldsKey(hold.UID), hold.ExpiresAt, hold.ID.String())
+}
+
+// lock serializes the updates of the holds of the user, it waits a short time for the other updates.
+func (b *Holds) lock(ctx context.Context, uid util.ID) error {
+	for i := 0; i < 20; i++ {
+		ok, err := b.redis.Lock(ctx, activeHoldsKey(uid), 10)
+		if err != nil || ok {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return gear.ErrConflict.WithMsg("the holds of the user are being updated, please retry")
+}
@@ -17,6 +17,11 @@ const (
 	LogActionSysUpdateUser            = "sys.update.user"
 	LogActionSysUpdateGroup           = "sys.update.group"
 	LogActionSysUpdateCreation        = "sys.update.creation"
+	LogActionSysRefundCharge          = "sys.refund.charge"
+	LogActionSysDisputeCharge         = "sys.dispute.charge"
+	LogActionSysFreezeWallet          = "sys.freeze.wallet"
+	LogActionSysRenewPlan             = "sys.renew.plan"
+	LogActionSysPayout                = "sys.payout"
 	LogActionUserLogin                = "user.login"
 	LogActionUserAuthz                = "user.authz"
 	LogActionUserUpdate               = "user.update"
@@ -27,6 +32,15 @@ const (
 	LogActionUserSubscribe            = "user.subscribe"
 	LogActionUserSponsor              = "user.sponsor"
 	LogActionUserTopup                = "user.topup"
+	LogActionUserRefund               = "user.refund"
+	LogActionUserGift                 = "user.gift"
+	LogActionUserTransfer             = "user.transfer"
+	LogActionUserReceiveTransfer      = "user.receive.transfer"
+	LogActionUserPayout               = "user.payout"
+	LogActionUserCaptureHold          = "user.capture.hold"
+	LogActionUserSpend                = "user.spend"
+	LogActionUserSubscribePlan        = "user.subscribe.plan"
+	LogActionUserCancelPlan           = "user.cancel.plan"
 	LogActionGroupCreate              = "group.create"
 	LogActionGroupUpdate              = "group.update"
 	LogActionGroupUpdateCN            = "group.update.cn"
@@ -103,8 +117,13 @@ func (b *Logbase) Log(ctx *gear.Context, action string, status int8, gid util.ID
 		return nil, errors.New("no session")
 	}
 
+	return b.LogAs(ctx, sess.UserID, action, status, gid, payload)
+}
+
+// LogAs writes the log of the other user involved in the request, such as the recipient of a transfer.
+func (b *Logbase) LogAs(ctx *gear.Context, uid util.ID, action string, status int8, gid util.ID, payload any) (*LogOutput, error) {
 	input := CreateLogInput{
-		UID:     sess.UserID,
+		UID:     uid,
 		GID:     gid,
 		Action:  action,
 		Status:  status,
@@ -0,0 +1,52 @@
+package bll
+
+import (
+	"context"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Receipts numbers the receipts of the completed charges, the numbers are kept in Redis.
+type Receipts struct {
+	redis *service.Redis
+}
+
+const receiptSeqKey = "receipt:seq"
+
+func receiptKey(cid util.ID) string {
+	return "receipt:" + cid.String()
+}
+
+// Number returns the receipt number of the charge, the next number of the sequence
+// is assigned on the first call, so the numbers have no gaps.
+func (b *Receipts) Number(ctx context.Context, cid util.ID) (int64, error) {
+	key := receiptKey(cid)
+	n, err := b.redis.GetInt(ctx, key)
+	if err != nil || n > 0 {
+		return n, err
+	}
+
+	ok, err := b.redis.Lock(ctx, key, 10)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, gear.ErrConflict.WithMsgf("receipt of charge %s is being numbered", cid.String())
+	}
+	defer b.redis.Unlock(ctx, key)
+
+	if n, err = b.redis.GetInt(ctx, key); err != nil || n > 0 {
+		return n, err
+	}
+	if n, err = b.redis.IncrBy(ctx, receiptSeqKey, 1, 0); err != nil {
+		return 0, err
+	}
+	// the key does not exist, incrementing it by n sets it to n
+	if _, err = b.redis.IncrBy(ctx, key, n, 0); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
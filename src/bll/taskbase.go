@@ -23,6 +23,22 @@ type CreateTaskInput struct {
 	Message   string     `json:"message" cbor:"message"`
 	Payload   util.Bytes `json:"payload" cbor:"payload"`
 	GroupRole *int8      `json:"group_role,omitempty" cbor:"group_role,omitempty"`
+	Ref       *util.ID   `json:"ref,omitempty" cbor:"ref,omitempty"` // the object of the task, such as the payout under review
+}
+
+// task resolution
+const (
+	TaskRejected int8 = -1
+	TaskApproved int8 = 1
+)
+
+type ResolveTaskInput struct {
+	GID      util.ID `json:"gid" cbor:"gid"`
+	Kind     string  `json:"kind" cbor:"kind"`
+	Ref      util.ID `json:"ref" cbor:"ref"`
+	Resolver util.ID `json:"resolver" cbor:"resolver"`
+	Status   int8    `json:"status" cbor:"status"`
+	Message  string  `json:"message,omitempty" cbor:"message,omitempty"`
 }
 
 func (b *Taskbase) Create(ctx context.Context, input *CreateTaskInput, payload any) {
@@ -39,3 +55,11 @@ func (b *Taskbase) Create(ctx context.Context, input *CreateTaskInput, payload a
 		logging.Errf("failed to create task: %v", err)
 	}
 }
+
+// Resolve resolves the tasks of the object, the assignees do not need to act on them any more.
+func (b *Taskbase) Resolve(ctx context.Context, input *ResolveTaskInput) {
+	output := SuccessResponse[any]{}
+	if err := b.svc.Post(ctx, "/v1/task/resolve", input, &output); err != nil {
+		logging.Errf("failed to resolve task: %v", err)
+	}
+}
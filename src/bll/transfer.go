@@ -0,0 +1,58 @@
+package bll
+
+import (
+	"context"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Transfers counts the credit transfers of the users per UTC day, the counters are kept in Redis.
+type Transfers struct {
+	redis *service.Redis
+}
+
+// the counters are kept a little longer than a day
+const transferCounterTTL = 3600 * 25
+
+func transferKey(uid util.ID, at time.Time) string {
+	return "transfer:" + uid.String() + ":" + at.UTC().Format("20060102")
+}
+
+// Reserve counts the transfer in the day of the time, it returns an error if the daily limits are reached.
+func (b *Transfers) Reserve(ctx context.Context, uid util.ID, amount int64, limits conf.Transfer, at time.Time) error {
+	key := transferKey(uid, at)
+	n, err := b.redis.IncrBy(ctx, key+":count", 1, transferCounterTTL)
+	if err != nil {
+		return err
+	}
+	if limits.DailyCount > 0 && n > limits.DailyCount {
+		_, _ = b.redis.IncrBy(ctx, key+":count", -1, 0)
+		return gear.ErrTooManyRequests.WithMsgf("daily transfer count limit %d reached", limits.DailyCount)
+	}
+
+	n, err = b.redis.IncrBy(ctx, key+":amount", amount, transferCounterTTL)
+	if err == nil && limits.DailyAmount > 0 && n > limits.DailyAmount {
+		_, _ = b.redis.IncrBy(ctx, key+":amount", -amount, 0)
+		err = gear.ErrTooManyRequests.WithMsgf("daily transfer limit %d exceeded, %d transferred", limits.DailyAmount, n-amount)
+	}
+	if err != nil {
+		_, _ = b.redis.IncrBy(ctx, key+":count", -1, 0)
+		return err
+	}
+	return nil
+}
+
+// Release gives back the transfer reserved in the day of the time, such as when the transfer failed.
+func (b *Transfers) Release(ctx context.Context, uid util.ID, amount int64, at time.Time) error {
+	key := transferKey(uid, at)
+	if _, err := b.redis.IncrBy(ctx, key+":count", -1, 0); err != nil {
+		return err
+	}
+	_, err := b.redis.IncrBy(ctx, key+":amount", -amount, 0)
+	return err
+}
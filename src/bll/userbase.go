@@ -3,6 +3,8 @@ package bll
 import (
 	"context"
 
+	"github.com/teambition/gear"
+
 	"github.com/yiwen-ai/wallet-api/src/logging"
 	"github.com/yiwen-ai/wallet-api/src/service"
 	"github.com/yiwen-ai/wallet-api/src/util"
@@ -37,3 +39,28 @@ func (b *Userbase) LoadUserInfo(ctx context.Context, ids ...util.ID) []UserInfo
 
 	return output.Result
 }
+
+// Get returns the info of the user, or a not found error.
+func (b *Userbase) Get(ctx context.Context, id util.ID) (*UserInfo, error) {
+	return b.get(ctx, "/v1/user/batch_get_info", "user", id)
+}
+
+// GetGroup returns the info of the group, or a not found error.
+// The group info shares the fields of the user info.
+func (b *Userbase) GetGroup(ctx context.Context, id util.ID) (*UserInfo, error) {
+	return b.get(ctx, "/v1/group/batch_get_info", "group", id)
+}
+
+func (b *Userbase) get(ctx context.Context, path, kind string, id util.ID) (*UserInfo, error) {
+	output := SuccessResponse[[]UserInfo]{}
+	if err := b.svc.Post(ctx, path, IDs{[]util.ID{id}}, &output); err != nil {
+		return nil, err
+	}
+
+	for i := range output.Result {
+		if output.Result[i].ID != nil && *output.Result[i].ID == id {
+			return &output.Result[i], nil
+		}
+	}
+	return nil, gear.ErrNotFound.WithMsgf("%s %s not found", kind, id.String())
+}
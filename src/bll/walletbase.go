@@ -34,13 +34,14 @@ func (b *Walletbase) listCurrencies(ctx context.Context) ([]Currency, error) {
 }
 
 type WalletOutput struct {
-	Sequence uint64  `json:"sequence" cbor:"sequence"`
-	Award    int64   `json:"award" cbor:"award"`
-	Topup    int64   `json:"topup" cbor:"topup"`
-	Income   int64   `json:"income" cbor:"income"`
-	Credits  uint64  `json:"credits" cbor:"credits"`
-	Level    uint8   `json:"level" cbor:"level"`
-	Txn      util.ID `json:"txn" cbor:"txn"`
+	Sequence  uint64  `json:"sequence" cbor:"sequence"`
+	Award     int64   `json:"award" cbor:"award"`
+	Topup     int64   `json:"topup" cbor:"topup"`
+	Income    int64   `json:"income" cbor:"income"`
+	Credits   uint64  `json:"credits" cbor:"credits"`
+	Level     uint8   `json:"level" cbor:"level"`
+	Txn       util.ID `json:"txn" cbor:"txn"`
+	Available int64   `json:"available" cbor:"available"` // the topup credits that are not held, set by the Holds
 }
 
 func (w *WalletOutput) SetLevel() {
@@ -58,11 +59,31 @@ func (b *Walletbase) Get(ctx context.Context, uid util.ID) (*WalletOutput, error
 	return &output.Result, nil
 }
 
+type FreezeWalletInput struct {
+	UID    util.ID `json:"uid" cbor:"uid"`
+	Amount int64   `json:"amount" cbor:"amount"` // credits owed by the user
+	Reason string  `json:"reason" cbor:"reason"`
+}
+
+// Freeze freezes the wallet when the credits owed can not be debited.
+func (b *Walletbase) Freeze(ctx context.Context, input *FreezeWalletInput) (*WalletOutput, error) {
+	output := SuccessResponse[WalletOutput]{}
+	if err := b.svc.Post(ctx, "/v1/wallet/freeze", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.SetLevel()
+	return &output.Result, nil
+}
+
 type ExpendInput struct {
 	Payee       util.ID     `json:"payee" cbor:"payee"`
 	Amount      int64       `json:"amount" cbor:"amount" validate:"gte=1,lte=1000000"`
-	UID         *util.ID    `json:"uid" cbor:"uid"`                                 // 非客户端参数
-	SubPayee    *util.ID    `json:"sub_payee,omitempty" cbor:"sub_payee,omitempty"` // 非客户端参数
+	UID         *util.ID    `json:"uid" cbor:"uid"`                                   // 非客户端参数
+	SubPayee    *util.ID    `json:"sub_payee,omitempty" cbor:"sub_payee,omitempty"`   // 非客户端参数
+	SubShares   *int64      `json:"sub_shares,omitempty" cbor:"sub_shares,omitempty"` // 非客户端参数
+	Kind        string      `json:"kind,omitempty" cbor:"kind,omitempty"`             // 非客户端参数
+	RequestID   *util.ID    `json:"request_id,omitempty" cbor:"request_id,omitempty"` // 非客户端参数
 	Description string      `json:"description,omitempty" cbor:"description,omitempty"`
 	Payload     *util.Bytes `json:"payload,omitempty" cbor:"payload,omitempty"`
 }
@@ -72,6 +93,10 @@ func (i *ExpendInput) Validate() error {
 		return gear.ErrBadRequest.From(err)
 	}
 
+	if i.SubPayee != nil && *i.SubPayee == i.Payee {
+		return gear.ErrBadRequest.WithMsg("sub_payee should not be the payee")
+	}
+
 	return nil
 }
 
@@ -85,6 +110,48 @@ func (b *Walletbase) Sponsor(ctx context.Context, input *ExpendInput) (*WalletOu
 	return &output.Result, nil
 }
 
+// Expend spends the topup credits of the user on the services of the payee, usually the system.
+// The expenses with the same request id are made once, the retries get the same transaction.
+func (b *Walletbase) Expend(ctx context.Context, input *ExpendInput) (*WalletOutput, error) {
+	output := SuccessResponse[WalletOutput]{}
+	if err := b.svc.Post(ctx, "/v1/wallet/expend", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.SetLevel()
+	return &output.Result, nil
+}
+
+// the kind of the transactions between users that are not sponsorships
+const TransactionKindTransfer = "transfer"
+
+type TransferInput struct {
+	UID         *util.ID `json:"uid" cbor:"uid"` // 非客户端参数
+	Payee       util.ID  `json:"payee" cbor:"payee"`
+	Amount      int64    `json:"amount" cbor:"amount" validate:"gte=1,lte=1000000"`
+	Kind        string   `json:"kind" cbor:"kind"` // 非客户端参数
+	Description string   `json:"description,omitempty" cbor:"description,omitempty" validate:"lte=280"`
+}
+
+func (i *TransferInput) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+// Transfer moves the topup credits of the user to the topup of the payee.
+func (b *Walletbase) Transfer(ctx context.Context, input *TransferInput) (*WalletOutput, error) {
+	output := SuccessResponse[WalletOutput]{}
+	if err := b.svc.Post(ctx, "/v1/wallet/transfer", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.SetLevel()
+	return &output.Result, nil
+}
+
 type TransactionOutput struct {
 	ID           util.ID     `json:"id" cbor:"id"`
 	Sequence     int64       `json:"sequence" cbor:"sequence"`
@@ -234,27 +301,44 @@ func (b *Walletbase) UpsertCustomer(ctx context.Context, input *CustomerInput) (
 	return &output.Result, nil
 }
 
+// charge status, keep in sync with walletbase
+const (
+	ChargeStatusDisputed   int8 = -3 // disputed by the cardholder
+	ChargeStatusFailed     int8 = -2 // expired or failed
+	ChargeStatusRefunded   int8 = -1 // fully refunded
+	ChargeStatusCreated    int8 = 0
+	ChargeStatusPending    int8 = 1 // payment session created
+	ChargeStatusProcessing int8 = 2 // paid by a delayed payment method, waiting for the funds
+	ChargeStatusCompleted  int8 = 3
+)
+
 type ChargeInput struct {
 	UID           util.ID     `json:"uid" cbor:"uid"`
 	Provider      string      `json:"provider" cbor:"provider"`
 	Quantity      uint        `json:"quantity" cbor:"quantity"`
+	Award         *uint       `json:"award,omitempty" cbor:"award,omitempty"` // bonus credits awarded on completion
+	Coupon        *string     `json:"coupon,omitempty" cbor:"coupon,omitempty"`
 	Currency      *string     `json:"currency,omitempty" cbor:"currency,omitempty"`
 	Amount        *uint       `json:"amount,omitempty" cbor:"amount,omitempty"`
 	ChargeID      *string     `json:"charge_id,omitempty" cbor:"charge_id,omitempty"`
 	ChargePayload *util.Bytes `json:"charge_payload,omitempty" cbor:"charge_payload,omitempty"`
+	// the credits of a gift are credited to the recipient on completion
+	Recipient   *util.ID `json:"recipient,omitempty" cbor:"recipient,omitempty"`
+	GiftMessage *string  `json:"gift_message,omitempty" cbor:"gift_message,omitempty"`
 }
 
 type UpdateChargeInput struct {
-	UID           util.ID     `json:"uid" cbor:"uid"`
-	ID            util.ID     `json:"id" cbor:"id"`
-	CurrentStatus int8        `json:"current_status" cbor:"current_status"`
-	Status        int8        `json:"status" cbor:"status"`
-	Currency      *string     `json:"currency,omitempty" cbor:"currency,omitempty"`
-	Amount        *uint       `json:"amount,omitempty" cbor:"amount,omitempty"`
-	ChargeID      *string     `json:"charge_id,omitempty" cbor:"charge_id,omitempty"`
-	ChargePayload *util.Bytes `json:"charge_payload,omitempty" cbor:"charge_payload,omitempty"`
-	FailureCode   *string     `json:"failure_code,omitempty" cbor:"failure_code,omitempty"`
-	FailureMsg    *string     `json:"failure_msg,omitempty" cbor:"failure_msg,omitempty"`
+	UID            util.ID     `json:"uid" cbor:"uid"`
+	ID             util.ID     `json:"id" cbor:"id"`
+	CurrentStatus  int8        `json:"current_status" cbor:"current_status"`
+	Status         int8        `json:"status" cbor:"status"`
+	Currency       *string     `json:"currency,omitempty" cbor:"currency,omitempty"`
+	Amount         *uint       `json:"amount,omitempty" cbor:"amount,omitempty"`
+	AmountDiscount *uint       `json:"amount_discount,omitempty" cbor:"amount_discount,omitempty"`
+	ChargeID       *string     `json:"charge_id,omitempty" cbor:"charge_id,omitempty"`
+	ChargePayload  *util.Bytes `json:"charge_payload,omitempty" cbor:"charge_payload,omitempty"`
+	FailureCode    *string     `json:"failure_code,omitempty" cbor:"failure_code,omitempty"`
+	FailureMsg     *string     `json:"failure_msg,omitempty" cbor:"failure_msg,omitempty"`
 }
 
 type CompleteChargeInput struct {
@@ -264,27 +348,103 @@ type CompleteChargeInput struct {
 	Amount        uint       `json:"amount" cbor:"amount"`
 	ChargeID      string     `json:"charge_id" cbor:"charge_id"`
 	ChargePayload util.Bytes `json:"charge_payload" cbor:"charge_payload"`
+	// the tax included in the amount, and the jurisdiction of the tax
+	AmountTax       *uint   `json:"amount_tax,omitempty" cbor:"amount_tax,omitempty"`
+	TaxJurisdiction *string `json:"tax_jurisdiction,omitempty" cbor:"tax_jurisdiction,omitempty"`
 }
 
 type ChargeOutput struct {
 	// UID       util.ID    `json:"uid" cbor:"uid"` // should not return to client
-	ID             util.ID     `json:"id" cbor:"id"`
-	Provider       string      `json:"provider" cbor:"provider"`
-	Status         int8        `json:"status" cbor:"status"`
-	Quantity       uint        `json:"quantity" cbor:"quantity"`
-	CreatedAt      int64       `json:"created_at" cbor:"created_at"`
-	UpdatedAt      *int64      `json:"updated_at,omitempty" cbor:"updated_at,omitempty"`
-	ExpireAt       *int64      `json:"expire_at,omitempty" cbor:"expire_at,omitempty"`
-	Currency       *string     `json:"currency,omitempty" cbor:"currency,omitempty"`
-	Amount         *uint       `json:"amount,omitempty" cbor:"amount,omitempty"`
-	AmountRefunded *uint       `json:"amount_refunded,omitempty" cbor:"amount_refunded,omitempty"`
-	ChargeID       *string     `json:"charge_id,omitempty" cbor:"charge_id,omitempty"`
-	ChargePayload  *util.Bytes `json:"charge_payload,omitempty" cbor:"charge_payload,omitempty"`
-	Txn            *util.ID    `json:"txn,omitempty" cbor:"txn,omitempty"`
-	TxnRefunded    *util.ID    `json:"txn_refunded,omitempty" cbor:"txn_refunded,omitempty"`
-	FailureCode    *string     `json:"failure_code,omitempty" cbor:"failure_code,omitempty"`
-	FailureMsg     *string     `json:"failure_msg,omitempty" cbor:"failure_msg,omitempty"`
-	PaymentURL     *string     `json:"payment_url" cbor:"payment_url"`
+	ID              util.ID     `json:"id" cbor:"id"`
+	Provider        string      `json:"provider" cbor:"provider"`
+	Status          int8        `json:"status" cbor:"status"`
+	Quantity        uint        `json:"quantity" cbor:"quantity"`
+	Award           *uint       `json:"award,omitempty" cbor:"award,omitempty"`
+	CreatedAt       int64       `json:"created_at" cbor:"created_at"`
+	UpdatedAt       *int64      `json:"updated_at,omitempty" cbor:"updated_at,omitempty"`
+	ExpireAt        *int64      `json:"expire_at,omitempty" cbor:"expire_at,omitempty"`
+	Currency        *string     `json:"currency,omitempty" cbor:"currency,omitempty"`
+	Amount          *uint       `json:"amount,omitempty" cbor:"amount,omitempty"`
+	AmountDiscount  *uint       `json:"amount_discount,omitempty" cbor:"amount_discount,omitempty"`
+	AmountRefunded  *uint       `json:"amount_refunded,omitempty" cbor:"amount_refunded,omitempty"`
+	RefundedCredits *uint       `json:"refunded_credits,omitempty" cbor:"refunded_credits,omitempty"` // the credits refunded, including the owed ones
+	AmountTax       *uint       `json:"amount_tax,omitempty" cbor:"amount_tax,omitempty"`
+	TaxJurisdiction *string     `json:"tax_jurisdiction,omitempty" cbor:"tax_jurisdiction,omitempty"`
+	Coupon          *string     `json:"coupon,omitempty" cbor:"coupon,omitempty"`
+	ChargeID        *string     `json:"charge_id,omitempty" cbor:"charge_id,omitempty"`
+	ChargePayload   *util.Bytes `json:"charge_payload,omitempty" cbor:"charge_payload,omitempty"`
+	Txn             *util.ID    `json:"txn,omitempty" cbor:"txn,omitempty"`
+	TxnRefunded     *util.ID    `json:"txn_refunded,omitempty" cbor:"txn_refunded,omitempty"`
+	FailureCode     *string     `json:"failure_code,omitempty" cbor:"failure_code,omitempty"`
+	FailureMsg      *string     `json:"failure_msg,omitempty" cbor:"failure_msg,omitempty"`
+	Recipient       *util.ID    `json:"recipient,omitempty" cbor:"recipient,omitempty"`
+	GiftMessage     *string     `json:"gift_message,omitempty" cbor:"gift_message,omitempty"`
+	PaymentURL      *string     `json:"payment_url" cbor:"payment_url"`
+}
+
+// RefundedQuantity returns the credits already refunded.
+func (o *ChargeOutput) RefundedQuantity() uint {
+	if o.RefundedCredits == nil {
+		return 0
+	}
+	return min(*o.RefundedCredits, o.Quantity)
+}
+
+// RefundAmount returns the credits and the amount to refund.
+// It is a full refund of the remaining credits if quantity is nil.
+func (o *ChargeOutput) RefundAmount(quantity *uint) (uint, uint, error) {
+	if o.Status != ChargeStatusCompleted || o.Amount == nil {
+		return 0, 0, gear.ErrBadRequest.WithMsgf("charge %s is not refundable", o.ID.String())
+	}
+
+	remaining := o.Quantity - o.RefundedQuantity()
+	if remaining == 0 {
+		return 0, 0, gear.ErrBadRequest.WithMsgf("charge %s is fully refunded", o.ID.String())
+	}
+
+	credits := remaining
+	if quantity != nil {
+		credits = *quantity
+	}
+	if credits == 0 || credits > remaining {
+		return 0, 0, gear.ErrBadRequest.WithMsgf("invalid refund quantity %d, expected 1 to %d", credits, remaining)
+	}
+
+	if credits == remaining {
+		refunded := uint(0)
+		if o.AmountRefunded != nil {
+			refunded = *o.AmountRefunded
+		}
+		return credits, *o.Amount - refunded, nil
+	}
+
+	return credits, uint(uint64(*o.Amount) * uint64(credits) / uint64(o.Quantity)), nil
+}
+
+// RefundQuantity returns the credits to debit for the refunded amount, rounded up
+// and capped at the remaining credits.
+func (o *ChargeOutput) RefundQuantity(amount uint) uint {
+	remaining := o.Quantity - o.RefundedQuantity()
+	if o.Amount == nil || *o.Amount == 0 {
+		return 0
+	}
+
+	credits := (uint64(amount)*uint64(o.Quantity) + uint64(*o.Amount) - 1) / uint64(*o.Amount)
+	return uint(min(credits, uint64(remaining)))
+}
+
+// RefundAward returns the awarded credits to claw back for the refunded credits,
+// in proportion to the refunded quantity and rounded up.
+func (o *ChargeOutput) RefundAward(quantity uint) uint {
+	if o.Award == nil || *o.Award == 0 || o.Quantity == 0 {
+		return 0
+	}
+
+	awarded := func(credits uint) uint64 {
+		return (uint64(*o.Award)*uint64(credits) + uint64(o.Quantity) - 1) / uint64(o.Quantity)
+	}
+	refunded := o.RefundedQuantity()
+	return uint(awarded(min(refunded+quantity, o.Quantity)) - awarded(refunded))
 }
 
 func (b *Walletbase) GetCharge(ctx context.Context, uid, id util.ID, fields *string) (*ChargeOutput, error) {
@@ -343,6 +503,189 @@ func (b *Walletbase) ListCharges(ctx context.Context, input *UIDPagination) ([]C
 	return output.Result, nil
 }
 
+// GiftOutput is a gift charge received by the user, the UID is the buyer.
+type GiftOutput struct {
+	UID     util.ID   `json:"uid" cbor:"uid"`
+	UIDInfo *UserInfo `json:"uid_info,omitempty" cbor:"uid_info,omitempty"`
+	ChargeOutput
+}
+
+// ListGifts lists the gift charges received by the user.
+func (b *Walletbase) ListGifts(ctx context.Context, input *UIDPagination) (*SuccessResponse[[]GiftOutput], error) {
+	output := SuccessResponse[[]GiftOutput]{}
+	if err := b.svc.Post(ctx, "/v1/charge/list_gifts", input, &output); err != nil {
+		return nil, err
+	}
+
+	for i := range output.Result {
+		output.Result[i].CreatedAt = output.Result[i].ID.UnixMs()
+	}
+	return &output, nil
+}
+
+// the timestamps are unix timestamps in milliseconds
+type ScanChargesInput struct {
+	Status        int8        `json:"status" cbor:"status"`
+	Provider      *string     `json:"provider,omitempty" cbor:"provider,omitempty"`
+	UpdatedBefore *int64      `json:"updated_before,omitempty" cbor:"updated_before,omitempty"`
+	CreatedAfter  *int64      `json:"created_after,omitempty" cbor:"created_after,omitempty"`
+	CreatedBefore *int64      `json:"created_before,omitempty" cbor:"created_before,omitempty"`
+	PageToken     *util.Bytes `json:"page_token,omitempty" cbor:"page_token,omitempty"`
+	PageSize      *uint16     `json:"page_size,omitempty" cbor:"page_size,omitempty"`
+}
+
+type ScanChargeOutput struct {
+	UID util.ID `json:"uid" cbor:"uid"`
+	ChargeOutput
+}
+
+// ScanCharges lists the charges of all users in the status that were not updated since the time,
+// for background jobs only.
+func (b *Walletbase) ScanCharges(ctx context.Context, input *ScanChargesInput) (*SuccessResponse[[]ScanChargeOutput], error) {
+	output := SuccessResponse[[]ScanChargeOutput]{}
+	if err := b.svc.Post(ctx, "/v1/charge/scan", input, &output); err != nil {
+		return nil, err
+	}
+
+	for i := range output.Result {
+		output.Result[i].CreatedAt = output.Result[i].ID.UnixMs()
+	}
+	return &output, nil
+}
+
+type RefundChargeInput struct {
+	UID           util.ID    `json:"uid" cbor:"uid"`
+	ID            util.ID    `json:"id" cbor:"id"`
+	Recipient     *util.ID   `json:"recipient,omitempty" cbor:"recipient,omitempty"` // the credits of a gift are debited from the recipient
+	Quantity      uint       `json:"quantity" cbor:"quantity"`                       // credits to debit from the wallet
+	Owed          uint       `json:"owed" cbor:"owed"`                               // refunded credits that can not be debited, the wallet is frozen for them
+	Award         uint       `json:"award" cbor:"award"`                             // awarded credits to debit from the wallet
+	Amount        uint       `json:"amount" cbor:"amount"`                           // amount refunded by the provider
+	RefundID      string     `json:"refund_id" cbor:"refund_id"`                     // refunds with the same id are recorded once
+	RefundPayload util.Bytes `json:"refund_payload" cbor:"refund_payload"`
+}
+
+// RefundCharge debits the refunded credits from the wallet and records the refund on the charge,
+// the refunded credits of the charge grow by Quantity and Owed.
+func (b *Walletbase) RefundCharge(ctx context.Context, input *RefundChargeInput) (*ChargeOutput, error) {
+	output := SuccessResponse[ChargeOutput]{}
+	if err := b.svc.Post(ctx, "/v1/charge/refund", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
+// subscription status
+const (
+	SubscriptionStatusCanceled int8 = -1
+	SubscriptionStatusCreated  int8 = 0 // waiting for the checkout
+	SubscriptionStatusActive   int8 = 1
+)
+
+type SubscriptionInput struct {
+	UID      util.ID `json:"uid" cbor:"uid"`
+	Provider string  `json:"provider" cbor:"provider"`
+	Plan     string  `json:"plan" cbor:"plan"`
+	Quantity uint    `json:"quantity" cbor:"quantity"` // credits topped up each cycle
+}
+
+type UpdateSubscriptionInput struct {
+	UID              util.ID     `json:"uid" cbor:"uid"`
+	ID               util.ID     `json:"id" cbor:"id"`
+	Status           *int8       `json:"status,omitempty" cbor:"status,omitempty"`
+	CheckoutID       *string     `json:"checkout_id,omitempty" cbor:"checkout_id,omitempty"`
+	SubscriptionID   *string     `json:"subscription_id,omitempty" cbor:"subscription_id,omitempty"`
+	CurrentPeriodEnd *int64      `json:"current_period_end,omitempty" cbor:"current_period_end,omitempty"`
+	Payload          *util.Bytes `json:"payload,omitempty" cbor:"payload,omitempty"`
+}
+
+type SubscriptionOutput struct {
+	ID               util.ID     `json:"id" cbor:"id"`
+	Provider         string      `json:"provider" cbor:"provider"`
+	Plan             string      `json:"plan" cbor:"plan"`
+	Quantity         uint        `json:"quantity" cbor:"quantity"`
+	Status           int8        `json:"status" cbor:"status"`
+	CreatedAt        int64       `json:"created_at" cbor:"created_at"`
+	UpdatedAt        *int64      `json:"updated_at,omitempty" cbor:"updated_at,omitempty"`
+	CurrentPeriodEnd *int64      `json:"current_period_end,omitempty" cbor:"current_period_end,omitempty"`
+	CanceledAt       *int64      `json:"canceled_at,omitempty" cbor:"canceled_at,omitempty"`
+	CheckoutID       *string     `json:"checkout_id,omitempty" cbor:"checkout_id,omitempty"`
+	SubscriptionID   *string     `json:"subscription_id,omitempty" cbor:"subscription_id,omitempty"`
+	Payload          *util.Bytes `json:"payload,omitempty" cbor:"payload,omitempty"`
+	PaymentURL       *string     `json:"payment_url,omitempty" cbor:"payment_url,omitempty"`
+}
+
+func (b *Walletbase) GetSubscription(ctx context.Context, uid, id util.ID) (*SubscriptionOutput, error) {
+	output := SuccessResponse[SubscriptionOutput]{}
+
+	query := url.Values{}
+	query.Add("uid", uid.String())
+	query.Add("id", id.String())
+	if err := b.svc.Get(ctx, "/v1/subscription?"+query.Encode(), &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
+func (b *Walletbase) CreateSubscription(ctx context.Context, input *SubscriptionInput) (*SubscriptionOutput, error) {
+	output := SuccessResponse[SubscriptionOutput]{}
+	if err := b.svc.Post(ctx, "/v1/subscription", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
+func (b *Walletbase) UpdateSubscription(ctx context.Context, input *UpdateSubscriptionInput) (*SubscriptionOutput, error) {
+	output := SuccessResponse[SubscriptionOutput]{}
+	if err := b.svc.Patch(ctx, "/v1/subscription", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
+func (b *Walletbase) ListSubscriptions(ctx context.Context, input *UIDPagination) (*SuccessResponse[[]SubscriptionOutput], error) {
+	output := SuccessResponse[[]SubscriptionOutput]{}
+	if err := b.svc.Post(ctx, "/v1/subscription/list", input, &output); err != nil {
+		return nil, err
+	}
+
+	for i := range output.Result {
+		output.Result[i].CreatedAt = output.Result[i].ID.UnixMs()
+	}
+	return &output, nil
+}
+
+type CreditSubscriptionInput struct {
+	UID             util.ID    `json:"uid" cbor:"uid"`
+	ID              util.ID    `json:"id" cbor:"id"`
+	Currency        string     `json:"currency" cbor:"currency"`
+	Amount          uint       `json:"amount" cbor:"amount"`
+	ChargeID        string     `json:"charge_id" cbor:"charge_id"` // the provider invoice, credited once
+	ChargePayload   util.Bytes `json:"charge_payload" cbor:"charge_payload"`
+	AmountTax       *uint      `json:"amount_tax,omitempty" cbor:"amount_tax,omitempty"`
+	TaxJurisdiction *string    `json:"tax_jurisdiction,omitempty" cbor:"tax_jurisdiction,omitempty"`
+}
+
+// CreditSubscription records a completed charge of the paid billing cycle,
+// and tops up the credits of the subscription.
+func (b *Walletbase) CreditSubscription(ctx context.Context, input *CreditSubscriptionInput) (*ChargeOutput, error) {
+	output := SuccessResponse[ChargeOutput]{}
+	if err := b.svc.Post(ctx, "/v1/subscription/credit", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
 type CreditOutput struct {
 	Txn         util.ID `json:"txn" cbor:"txn"`
 	Kind        string  `json:"kind" cbor:"kind"`
@@ -362,3 +705,121 @@ func (b *Walletbase) ListCredits(ctx context.Context, input *UIDPagination) (*Su
 	}
 	return &output, nil
 }
+
+// payout status, keep in sync with walletbase
+const (
+	PayoutStatusFailed     int8 = -2 // the transfer or the payout failed
+	PayoutStatusRejected   int8 = -1 // rejected by the review
+	PayoutStatusPending    int8 = 0  // waiting for the review
+	PayoutStatusApproved   int8 = 1
+	PayoutStatusProcessing int8 = 2 // transferred to the connected account, paying out to the bank account
+	PayoutStatusCompleted  int8 = 3
+)
+
+type PayoutInput struct {
+	UID       util.ID `json:"uid" cbor:"uid"`
+	Provider  string  `json:"provider" cbor:"provider"`
+	Account   string  `json:"account" cbor:"account"` // the connected account
+	Amount    int64   `json:"amount" cbor:"amount"`   // income credits to debit, including the fee
+	Fee       int64   `json:"fee" cbor:"fee"`
+	Currency  string  `json:"currency" cbor:"currency"`
+	PayAmount int64   `json:"pay_amount" cbor:"pay_amount"` // the amount paid out, in the smallest currency unit
+}
+
+type UpdatePayoutInput struct {
+	UID              util.ID     `json:"uid" cbor:"uid"`
+	ID               util.ID     `json:"id" cbor:"id"`
+	CurrentStatus    int8        `json:"current_status" cbor:"current_status"`
+	Status           int8        `json:"status" cbor:"status"`
+	Reviewer         *util.ID    `json:"reviewer,omitempty" cbor:"reviewer,omitempty"`
+	TransferID       *string     `json:"transfer_id,omitempty" cbor:"transfer_id,omitempty"`
+	ProviderPayoutID *string     `json:"provider_payout_id,omitempty" cbor:"provider_payout_id,omitempty"`
+	Payload          *util.Bytes `json:"payload,omitempty" cbor:"payload,omitempty"`
+	FailureCode      *string     `json:"failure_code,omitempty" cbor:"failure_code,omitempty"`
+	FailureMsg       *string     `json:"failure_msg,omitempty" cbor:"failure_msg,omitempty"`
+}
+
+type CompletePayoutInput struct {
+	UID     util.ID    `json:"uid" cbor:"uid"`
+	ID      util.ID    `json:"id" cbor:"id"`
+	Payload util.Bytes `json:"payload" cbor:"payload"`
+}
+
+type PayoutOutput struct {
+	ID               util.ID     `json:"id" cbor:"id"`
+	Provider         string      `json:"provider" cbor:"provider"`
+	Status           int8        `json:"status" cbor:"status"`
+	Amount           int64       `json:"amount" cbor:"amount"`
+	Fee              int64       `json:"fee" cbor:"fee"`
+	Currency         string      `json:"currency" cbor:"currency"`
+	PayAmount        int64       `json:"pay_amount" cbor:"pay_amount"`
+	CreatedAt        int64       `json:"created_at" cbor:"created_at"`
+	UpdatedAt        *int64      `json:"updated_at,omitempty" cbor:"updated_at,omitempty"`
+	Account          *string     `json:"account,omitempty" cbor:"account,omitempty"`
+	Reviewer         *util.ID    `json:"reviewer,omitempty" cbor:"reviewer,omitempty"`
+	TransferID       *string     `json:"transfer_id,omitempty" cbor:"transfer_id,omitempty"`
+	ProviderPayoutID *string     `json:"provider_payout_id,omitempty" cbor:"provider_payout_id,omitempty"`
+	Payload          *util.Bytes `json:"payload,omitempty" cbor:"payload,omitempty"`
+	FailureCode      *string     `json:"failure_code,omitempty" cbor:"failure_code,omitempty"`
+	FailureMsg       *string     `json:"failure_msg,omitempty" cbor:"failure_msg,omitempty"`
+	Txn              *util.ID    `json:"txn,omitempty" cbor:"txn,omitempty"`
+}
+
+func (b *Walletbase) GetPayout(ctx context.Context, uid, id util.ID) (*PayoutOutput, error) {
+	output := SuccessResponse[PayoutOutput]{}
+
+	query := url.Values{}
+	query.Add("uid", uid.String())
+	query.Add("id", id.String())
+	if err := b.svc.Get(ctx, "/v1/payout?"+query.Encode(), &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
+// CreatePayout creates a payout request, the income credits of the pending payouts
+// are not available to other payouts.
+func (b *Walletbase) CreatePayout(ctx context.Context, input *PayoutInput) (*PayoutOutput, error) {
+	output := SuccessResponse[PayoutOutput]{}
+	if err := b.svc.Post(ctx, "/v1/payout", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
+func (b *Walletbase) UpdatePayout(ctx context.Context, input *UpdatePayoutInput) (*PayoutOutput, error) {
+	output := SuccessResponse[PayoutOutput]{}
+	if err := b.svc.Patch(ctx, "/v1/payout", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
+// CompletePayout debits the income credits of the paid out payout.
+func (b *Walletbase) CompletePayout(ctx context.Context, input *CompletePayoutInput) (*PayoutOutput, error) {
+	output := SuccessResponse[PayoutOutput]{}
+	if err := b.svc.Post(ctx, "/v1/payout/complete", input, &output); err != nil {
+		return nil, err
+	}
+
+	output.Result.CreatedAt = output.Result.ID.UnixMs()
+	return &output.Result, nil
+}
+
+func (b *Walletbase) ListPayouts(ctx context.Context, input *UIDPagination) (*SuccessResponse[[]PayoutOutput], error) {
+	output := SuccessResponse[[]PayoutOutput]{}
+	if err := b.svc.Post(ctx, "/v1/payout/list", input, &output); err != nil {
+		return nil, err
+	}
+
+	for i := range output.Result {
+		output.Result[i].CreatedAt = output.Result[i].ID.UnixMs()
+	}
+	return &output, nil
+}
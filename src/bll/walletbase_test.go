@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/yiwen-ai/wallet-api/src/util"
 )
 
 func TestWalletOutputSetLevel(t *testing.T) {
@@ -24,3 +25,100 @@ func TestWalletOutputSetLevel(t *testing.T) {
 		assert.Equal(t, c.level, w.Level)
 	}
 }
+
+func TestChargeOutputRefundAmount(t *testing.T) {
+	assert := assert.New(t)
+
+	charge := &ChargeOutput{
+		Status:   ChargeStatusCompleted,
+		Quantity: 300,
+		Amount:   util.Ptr(uint(1000)),
+	}
+	assert.Equal(uint(0), charge.RefundedQuantity())
+
+	credits, amount, err := charge.RefundAmount(nil)
+	assert.NoError(err)
+	assert.Equal(uint(300), credits)
+	assert.Equal(uint(1000), amount)
+
+	credits, amount, err = charge.RefundAmount(util.Ptr(uint(100)))
+	assert.NoError(err)
+	assert.Equal(uint(100), credits)
+	assert.Equal(uint(333), amount)
+
+	charge.AmountRefunded = util.Ptr(uint(333))
+	charge.RefundedCredits = util.Ptr(uint(100))
+	assert.Equal(uint(100), charge.RefundedQuantity())
+
+	_, _, err = charge.RefundAmount(util.Ptr(uint(201)))
+	assert.Error(err)
+	_, _, err = charge.RefundAmount(util.Ptr(uint(0)))
+	assert.Error(err)
+
+	credits, amount, err = charge.RefundAmount(nil)
+	assert.NoError(err)
+	assert.Equal(uint(200), credits)
+	assert.Equal(uint(667), amount)
+
+	charge.AmountRefunded = util.Ptr(uint(1000))
+	charge.RefundedCredits = util.Ptr(uint(300))
+	_, _, err = charge.RefundAmount(nil)
+	assert.Error(err)
+
+	// the credits of a sub-cent unit price are refunded for nothing
+	charge = &ChargeOutput{
+		Status:   ChargeStatusCompleted,
+		Quantity: 300,
+		Amount:   util.Ptr(uint(100)),
+	}
+	credits, amount, err = charge.RefundAmount(util.Ptr(uint(2)))
+	assert.NoError(err)
+	assert.Equal(uint(2), credits)
+	assert.Equal(uint(0), amount)
+
+	charge.Status = ChargeStatusPending
+	charge.AmountRefunded = nil
+	_, _, err = charge.RefundAmount(nil)
+	assert.Error(err)
+}
+
+func TestChargeOutputRefundQuantity(t *testing.T) {
+	assert := assert.New(t)
+
+	charge := &ChargeOutput{
+		Status:   ChargeStatusCompleted,
+		Quantity: 300,
+		Amount:   util.Ptr(uint(1000)),
+	}
+	assert.Equal(uint(100), charge.RefundQuantity(333))
+	assert.Equal(uint(1), charge.RefundQuantity(1))
+	assert.Equal(uint(300), charge.RefundQuantity(1000))
+	assert.Equal(uint(300), charge.RefundQuantity(2000))
+
+	charge.AmountRefunded = util.Ptr(uint(333))
+	charge.RefundedCredits = util.Ptr(uint(100))
+	assert.Equal(uint(200), charge.RefundQuantity(667))
+	assert.Equal(uint(200), charge.RefundQuantity(1000))
+}
+
+func TestChargeOutputRefundAward(t *testing.T) {
+	assert := assert.New(t)
+
+	charge := &ChargeOutput{
+		Status:   ChargeStatusCompleted,
+		Quantity: 300,
+		Amount:   util.Ptr(uint(3000)),
+	}
+	assert.Equal(uint(0), charge.RefundAward(100))
+
+	charge.Award = util.Ptr(uint(50))
+	assert.Equal(uint(17), charge.RefundAward(100))
+	assert.Equal(uint(1), charge.RefundAward(1))
+	assert.Equal(uint(50), charge.RefundAward(300))
+
+	// the partial refunds add up to the award
+	charge.AmountRefunded = util.Ptr(uint(1000))
+	charge.RefundedCredits = util.Ptr(uint(100))
+	assert.Equal(uint(17), charge.RefundAward(100))
+	assert.Equal(uint(33), charge.RefundAward(200))
+}
@@ -0,0 +1,110 @@
+package bll
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// webhook event status
+const (
+	WebhookEventFailed     int8 = -1
+	WebhookEventProcessing int8 = 0
+	WebhookEventSucceeded  int8 = 1
+)
+
+type WebhookEvent struct {
+	ID        string     `json:"id" cbor:"id"`
+	Provider  string     `json:"provider" cbor:"provider"`
+	Type      string     `json:"type" cbor:"type"`
+	Status    int8       `json:"status" cbor:"status"`
+	Attempts  uint       `json:"attempts" cbor:"attempts"`
+	Error     string     `json:"error,omitempty" cbor:"error,omitempty"`
+	CreatedAt int64      `json:"created_at" cbor:"created_at"`
+	UpdatedAt int64      `json:"updated_at" cbor:"updated_at"`
+	Payload   util.Bytes `json:"payload" cbor:"payload"` // raw webhook body
+}
+
+// WebhookEventStore persists the verified webhook events for replaying.
+type WebhookEventStore interface {
+	// Get returns the event of the provider, the event ids are unique within a provider.
+	Get(ctx context.Context, provider, id string) (*WebhookEvent, error)
+	Save(ctx context.Context, event *WebhookEvent) error
+	// ListFailed returns the failed events, the latest first.
+	ListFailed(ctx context.Context, input *Pagination) (*SuccessResponse[[]*WebhookEvent], error)
+}
+
+type redisEventStore struct {
+	redis *service.Redis
+}
+
+// the retention of webhook events in seconds
+const webhookEventTTL = 3600 * 24 * 30
+
+// webhookEventMember returns the member of the event in the failed events index.
+func webhookEventMember(provider, id string) string {
+	return provider + ":" + id
+}
+
+func (s *redisEventStore) Get(ctx context.Context, provider, id string) (*WebhookEvent, error) {
+	output := &WebhookEvent{}
+	if err := s.redis.GetCBOR(ctx, "webhook_event:"+webhookEventMember(provider, id), output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (s *redisEventStore) Save(ctx context.Context, event *WebhookEvent) error {
+	member := webhookEventMember(event.Provider, event.ID)
+	if err := s.redis.SetCBOR(ctx, "webhook_event:"+member, event, webhookEventTTL); err != nil {
+		return err
+	}
+
+	if event.Status == WebhookEventFailed {
+		return s.redis.ZAdd(ctx, "webhook_events:failed", event.UpdatedAt, member)
+	}
+	return s.redis.ZRem(ctx, "webhook_events:failed", member)
+}
+
+func (s *redisEventStore) ListFailed(ctx context.Context, input *Pagination) (*SuccessResponse[[]*WebhookEvent], error) {
+	offset := int64(0)
+	if input.PageToken != nil {
+		if err := cbor.Unmarshal(*input.PageToken, &offset); err != nil {
+			return nil, gear.ErrBadRequest.WithMsgf("invalid page token: %v", err)
+		}
+	}
+	size := int64(10)
+	if input.PageSize != nil {
+		size = int64(*input.PageSize)
+	}
+
+	ids, err := s.redis.ZRevRange(ctx, "webhook_events:failed", offset, size)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &SuccessResponse[[]*WebhookEvent]{Result: make([]*WebhookEvent, 0, len(ids))}
+	for _, member := range ids {
+		provider, id, _ := strings.Cut(member, ":")
+		event, err := s.Get(ctx, provider, id)
+		switch {
+		case util.IsNotFoundErr(err):
+			// expired
+			_ = s.redis.ZRem(ctx, "webhook_events:failed", member)
+		case err != nil:
+			return nil, err
+		default:
+			output.Result = append(output.Result, event)
+		}
+	}
+
+	if int64(len(ids)) == size {
+		output.NextPageToken, _ = cbor.Marshal(offset + size)
+	}
+	return output, nil
+}
@@ -0,0 +1,58 @@
+package bll
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/service"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+type Writingbase struct {
+	svc service.APIHost
+}
+
+// PublicationRef identifies the publication of a creation in a language.
+type PublicationRef struct {
+	GID      util.ID `json:"gid" cbor:"gid"`
+	CID      util.ID `json:"cid" cbor:"cid"`
+	Language string  `json:"language" cbor:"language" validate:"required,lte=16"`
+	Version  uint16  `json:"version" cbor:"version" validate:"gte=1"`
+}
+
+func (i *PublicationRef) Validate() error {
+	if err := util.Validator.Struct(i); err != nil {
+		return gear.ErrBadRequest.From(err)
+	}
+
+	return nil
+}
+
+type PublicationOutput struct {
+	GID      util.ID `json:"gid" cbor:"gid"`
+	CID      util.ID `json:"cid" cbor:"cid"`
+	Language string  `json:"language" cbor:"language"`
+	Version  uint16  `json:"version" cbor:"version"`
+	Status   int8    `json:"status" cbor:"status"`
+	Creator  util.ID `json:"creator" cbor:"creator"` // the translator of the publication
+}
+
+// GetPublication returns the publication, or a not found error.
+func (b *Writingbase) GetPublication(ctx context.Context, input *PublicationRef) (*PublicationOutput, error) {
+	output := SuccessResponse[PublicationOutput]{}
+
+	query := url.Values{}
+	query.Add("gid", input.GID.String())
+	query.Add("cid", input.CID.String())
+	query.Add("language", input.Language)
+	query.Add("version", strconv.Itoa(int(input.Version)))
+	query.Add("fields", "status,creator")
+	if err := b.svc.Get(ctx, "/v1/publication?"+query.Encode(), &output); err != nil {
+		return nil, err
+	}
+
+	return &output.Result, nil
+}
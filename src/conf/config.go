@@ -57,10 +57,11 @@ type Server struct {
 }
 
 type Base struct {
-	Userbase   string `json:"userbase" toml:"userbase"`
-	Logbase    string `json:"logbase" toml:"logbase"`
-	Taskbase   string `json:"taskbase" toml:"taskbase"`
-	Walletbase string `json:"walletbase" toml:"walletbase"`
+	Userbase    string `json:"userbase" toml:"userbase"`
+	Logbase     string `json:"logbase" toml:"logbase"`
+	Taskbase    string `json:"taskbase" toml:"taskbase"`
+	Walletbase  string `json:"walletbase" toml:"walletbase"`
+	Writingbase string `json:"writingbase" toml:"writingbase"`
 }
 
 type Redis struct {
@@ -68,12 +69,83 @@ type Redis struct {
 	Node   string `json:"node" toml:"node"`
 }
 
+type Admin struct {
+	UIDs []string `json:"uids" toml:"uids"`
+}
+
 type Stripe struct {
-	PubKey     string `json:"pub_key" toml:"pub_key"`
-	PriceID    string `json:"price_id" toml:"price_id"`
-	SuccessUrl string `json:"success_url" toml:"success_url"`
-	SecretKey  string
-	WebhookKey string
+	PubKey          string `json:"pub_key" toml:"pub_key"`
+	PriceID         string `json:"price_id" toml:"price_id"`
+	SuccessUrl      string `json:"success_url" toml:"success_url"`
+	PortalReturnUrl string `json:"portal_return_url" toml:"portal_return_url"` // the success_url if empty
+	AutomaticTax    bool   `json:"automatic_tax" toml:"automatic_tax"`         // calculates the taxes by the billing address
+	ConnectUrl      string `json:"connect_url" toml:"connect_url"`             // returned to after the onboarding of connected accounts
+	SecretKey       string
+	WebhookKey      string
+	ConnectKey      string // the webhook key of the connected accounts, for the payout events
+}
+
+type Alipay struct {
+	AppID      string `json:"app_id" toml:"app_id"`
+	Gateway    string `json:"gateway" toml:"gateway"`
+	NotifyUrl  string `json:"notify_url" toml:"notify_url"`
+	Subject    string `json:"subject" toml:"subject"`
+	UnitAmount int64  `json:"unit_amount" toml:"unit_amount"` // the price of one credit in fen
+	PrivateKey string // the app private key, PEM or base64 encoded DER
+	PublicKey  string // the alipay public key, PEM or base64 encoded DER
+}
+
+type Reconciler struct {
+	Interval   uint `json:"interval" toml:"interval"`       // seconds between the sweeps, 0 to disable
+	StaleAfter uint `json:"stale_after" toml:"stale_after"` // seconds since the last update of a pending charge
+}
+
+type Receipt struct {
+	Issuer  string   `json:"issuer" toml:"issuer"`
+	Address []string `json:"address" toml:"address"`
+	Prefix  string   `json:"prefix" toml:"prefix"` // the prefix of the receipt numbers
+}
+
+type Sponsor struct {
+	SubShareRate uint `json:"sub_share_rate" toml:"sub_share_rate"` // the share of the sub-payee in basis points of the amount
+}
+
+type Transfer struct {
+	DailyAmount int64 `json:"daily_amount" toml:"daily_amount"` // the credits a user can transfer per day, 0 for unlimited
+	DailyCount  int64 `json:"daily_count" toml:"daily_count"`   // the transfers a user can make per day, 0 for unlimited
+}
+
+type Hold struct {
+	TTL    uint `json:"ttl" toml:"ttl"`         // the default TTL of the holds in seconds
+	MaxTTL uint `json:"max_ttl" toml:"max_ttl"` // the maximum TTL of the holds in seconds
+}
+
+type Payout struct {
+	Provider   string `json:"provider" toml:"provider"`
+	Currency   string `json:"currency" toml:"currency"`
+	UnitAmount int64  `json:"unit_amount" toml:"unit_amount"` // the amount paid out for one credit, in the smallest currency unit
+	MinAmount  int64  `json:"min_amount" toml:"min_amount"`   // the minimum credits of a payout
+	FeeRate    uint   `json:"fee_rate" toml:"fee_rate"`       // the fee in basis points of the credits
+	FeeFixed   int64  `json:"fee_fixed" toml:"fee_fixed"`     // the fixed fee in credits
+}
+
+type Package struct {
+	ID       string            `json:"id" toml:"id"`
+	Quantity uint              `json:"quantity" toml:"quantity"` // credits topped up
+	Bonus    uint              `json:"bonus" toml:"bonus"`       // credits awarded
+	Prices   map[string]string `json:"prices" toml:"prices"`     // provider => price id
+}
+
+type Plan struct {
+	ID       string            `json:"id" toml:"id"`
+	Quantity uint              `json:"quantity" toml:"quantity"` // credits topped up each billing cycle
+	Prices   map[string]string `json:"prices" toml:"prices"`     // provider => recurring price id
+}
+
+type Billable struct {
+	Kind      string `json:"kind" toml:"kind"`
+	UnitSize  uint   `json:"unit_size" toml:"unit_size"`   // the usage quantity of one unit, such as 1000 tokens
+	UnitPrice int64  `json:"unit_price" toml:"unit_price"` // the credits of one unit, the partial units are charged in full
 }
 
 // ConfigTpl ...
@@ -81,12 +153,23 @@ type ConfigTpl struct {
 	Rand           *rand.Rand
 	GlobalSignal   context.Context
 	GlobalShutdown context.Context
-	Env            string `json:"env" toml:"env"`
-	Logger         Logger `json:"log" toml:"log"`
-	Server         Server `json:"server" toml:"server"`
-	Redis          Redis  `json:"redis" toml:"redis"`
-	Base           Base   `json:"base" toml:"base"`
-	Stripe         Stripe `json:"stripe" toml:"stripe"`
+	Env            string     `json:"env" toml:"env"`
+	Logger         Logger     `json:"log" toml:"log"`
+	Server         Server     `json:"server" toml:"server"`
+	Redis          Redis      `json:"redis" toml:"redis"`
+	Base           Base       `json:"base" toml:"base"`
+	Admin          Admin      `json:"admin" toml:"admin"`
+	Stripe         Stripe     `json:"stripe" toml:"stripe"`
+	Alipay         Alipay     `json:"alipay" toml:"alipay"`
+	Reconciler     Reconciler `json:"reconciler" toml:"reconciler"`
+	Receipt        Receipt    `json:"receipt" toml:"receipt"`
+	Sponsor        Sponsor    `json:"sponsor" toml:"sponsor"`
+	Transfer       Transfer   `json:"transfer" toml:"transfer"`
+	Hold           Hold       `json:"hold" toml:"hold"`
+	Payout         Payout     `json:"payout" toml:"payout"`
+	Packages       []Package  `json:"packages" toml:"packages"`
+	Plans          []Plan     `json:"plans" toml:"plans"`
+	Billables      []Billable `json:"billables" toml:"billables"`
 
 	globalJobs int64 // global async jobs counter for graceful shutdown
 }
@@ -94,9 +177,12 @@ type ConfigTpl struct {
 func (c *ConfigTpl) Validate() error {
 	c.Stripe.SecretKey = os.Getenv("STRIPE_SECRET_KEY")
 	c.Stripe.WebhookKey = os.Getenv("STRIPE_WEBHOOK_SECRET")
+	c.Stripe.ConnectKey = os.Getenv("STRIPE_CONNECT_WEBHOOK_SECRET")
 	if c.Stripe.SecretKey == "" {
 		log.Println("STRIPE_SECRET_KEY is not set")
 	}
+	c.Alipay.PrivateKey = os.Getenv("ALIPAY_PRIVATE_KEY")
+	c.Alipay.PublicKey = os.Getenv("ALIPAY_PUBLIC_KEY")
 	return nil
 }
 
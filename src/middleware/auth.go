@@ -100,6 +100,27 @@ func CheckUserStatus(status int8) gear.Middleware {
 	}
 }
 
+// RequireScope checks that the access token is granted the scope by the user.
+func RequireScope(scope string) gear.Middleware {
+	return func(ctx *gear.Context) error {
+		sess := gear.CtxValue[Session](ctx)
+		if sess == nil || !sess.HasScope(scope) {
+			return gear.ErrForbidden.WithMsgf("scope %q required", scope)
+		}
+
+		return nil
+	}
+}
+
+func CheckAdmin(ctx *gear.Context) error {
+	sess := gear.CtxValue[Session](ctx)
+	if sess == nil || !util.SliceHas(conf.Config.Admin.UIDs, sess.UserID.String()) {
+		return gear.ErrForbidden.WithMsg("admin only")
+	}
+
+	return nil
+}
+
 func extractAuth(ctx *gear.Context) (*Session, error) {
 	var err error
 	sess := &Session{}
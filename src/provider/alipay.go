@@ -0,0 +1,470 @@
+package provider
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// Alipay accepts payments by scanning the QR code of Alipay precreated trades.
+// The out_trade_no of a trade is "<uid>_<cid>", it is the session id.
+type Alipay struct {
+	cfg        conf.Alipay
+	cli        *http.Client
+	privateKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+}
+
+func NewAlipay(cfg conf.Alipay) (*Alipay, error) {
+	privateKey, err := parsePrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alipay private key: %w", err)
+	}
+	publicKey, err := parsePublicKey(cfg.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alipay public key: %w", err)
+	}
+
+	return &Alipay{
+		cfg:        cfg,
+		cli:        util.ExternalHTTPClient,
+		privateKey: privateKey,
+		publicKey:  publicKey,
+	}, nil
+}
+
+func (p *Alipay) Name() string {
+	return "alipay"
+}
+
+func (p *Alipay) Config() Config {
+	return Config{PriceID: "cny"}
+}
+
+// WebhookAck implements WebhookAcker, Alipay keeps notifying until it receives "success".
+func (p *Alipay) WebhookAck() string {
+	return "success"
+}
+
+// alipay trade status
+const (
+	alipayWaitBuyerPay  = "WAIT_BUYER_PAY"
+	alipayTradeClosed   = "TRADE_CLOSED"
+	alipayTradeSuccess  = "TRADE_SUCCESS"
+	alipayTradeFinished = "TRADE_FINISHED"
+)
+
+type alipayTrade struct {
+	Code        string `json:"code"`
+	Msg         string `json:"msg"`
+	SubCode     string `json:"sub_code"`
+	SubMsg      string `json:"sub_msg"`
+	OutTradeNo  string `json:"out_trade_no"`
+	TradeNo     string `json:"trade_no"`
+	TradeStatus string `json:"trade_status"`
+	TotalAmount string `json:"total_amount"`
+	QRCode      string `json:"qr_code"`
+	RefundFee   string `json:"refund_fee"`
+}
+
+func (p *Alipay) CreateSession(ctx context.Context, input *SessionInput) (*Session, error) {
+	if input.Currency != nil && *input.Currency != "cny" {
+		return nil, gear.ErrBadRequest.WithMsgf("currency %s not supported by alipay", *input.Currency)
+	}
+
+	if input.Coupon != "" {
+		return nil, gear.ErrBadRequest.WithMsg("coupons not supported by alipay")
+	}
+
+	unit, err := p.unitAmount(input.PriceID)
+	if err != nil {
+		return nil, err
+	}
+
+	id := input.UID.String() + "_" + input.ChargeID.String()
+	amount := int64(input.Quantity) * unit
+	trade := &alipayTrade{}
+	raw, err := p.call(ctx, "alipay.trade.precreate", map[string]any{
+		"out_trade_no":    id,
+		"total_amount":    formatYuan(amount),
+		"subject":         p.cfg.Subject,
+		"timeout_express": "2h",
+	}, trade)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		ID:          id,
+		URL:         trade.QRCode,
+		Status:      alipayWaitBuyerPay,
+		Currency:    "cny",
+		AmountTotal: amount,
+		ExpiresAt:   time.Now().Add(2 * time.Hour).Unix(),
+		UID:         input.UID,
+		ChargeID:    input.ChargeID,
+		Payload:     util.Bytes(raw),
+	}, nil
+}
+
+// GetSession queries the trade. The QR code is not returned by the query.
+func (p *Alipay) GetSession(ctx context.Context, id string) (*Session, error) {
+	trade := &alipayTrade{}
+	raw, err := p.call(ctx, "alipay.trade.query", map[string]any{
+		"out_trade_no": id,
+	}, trade)
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := parseYuan(trade.TotalAmount)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	output := &Session{
+		ID:          id,
+		Status:      trade.TradeStatus,
+		Paid:        trade.TradeStatus == alipayTradeSuccess || trade.TradeStatus == alipayTradeFinished,
+		Closed:      trade.TradeStatus == alipayTradeClosed,
+		Currency:    "cny",
+		AmountTotal: amount,
+		PaymentID:   trade.TradeNo,
+		Payload:     util.Bytes(raw),
+	}
+	output.UID, output.ChargeID = parseAlipayTradeNo(id)
+	return output, nil
+}
+
+// VerifyWebhook verifies the async notification, a form-urlencoded request signed by Alipay.
+func (p *Alipay) VerifyWebhook(ctx context.Context, payload []byte, header http.Header) (*Event, error) {
+	form, err := url.ParseQuery(string(payload))
+	if err != nil {
+		return nil, gear.ErrBadRequest.WithMsgf("parse notification failed: %v", err)
+	}
+
+	if form.Get("app_id") != p.cfg.AppID {
+		return nil, gear.ErrBadRequest.WithMsgf("invalid app_id %q", form.Get("app_id"))
+	}
+	if err = p.verify(signContent(form), form.Get("sign")); err != nil {
+		return nil, gear.ErrBadRequest.WithMsgf("verify notification failed: %v", err)
+	}
+
+	return p.ParseEvent(ctx, payload)
+}
+
+func (p *Alipay) ParseEvent(ctx context.Context, payload []byte) (*Event, error) {
+	form, err := url.ParseQuery(string(payload))
+	if err != nil {
+		return nil, gear.ErrBadRequest.WithMsgf("parse notification failed: %v", err)
+	}
+
+	status := form.Get("trade_status")
+	output := &Event{
+		ID:         form.Get("notify_id"),
+		Type:       form.Get("notify_type") + "." + status,
+		ObjectType: "trade",
+		ObjectID:   form.Get("trade_no"),
+		Payload:    util.Bytes(payload),
+	}
+	output.UID, output.ChargeID = parseAlipayTradeNo(form.Get("out_trade_no"))
+	if output.UID == util.ZeroID || output.ChargeID == util.ZeroID {
+		return nil, gear.ErrBadRequest.WithMsg("parse uid or cid failed")
+	}
+
+	amount, err := parseYuan(form.Get("total_amount"))
+	if err != nil {
+		return nil, gear.ErrBadRequest.WithMsgf("invalid total_amount: %v", err)
+	}
+	refunded, err := parseYuan(form.Get("refund_fee"))
+	if err != nil {
+		return nil, gear.ErrBadRequest.WithMsgf("invalid refund_fee: %v", err)
+	}
+
+	switch {
+	// refunds are notified with the total refund_fee of the trade
+	case refunded > 0:
+		output.Kind = EventChargeRefunded
+		output.Refund = &Refund{
+			ID:             form.Get("out_biz_no"),
+			AmountRefunded: refunded,
+			Status:         status,
+			Payload:        util.Bytes(payload),
+		}
+		if output.Refund.ID == "" {
+			output.Refund.ID = output.ID
+		}
+		return output, nil
+
+	case status == alipayTradeSuccess || status == alipayTradeFinished:
+		output.Kind = EventSessionCompleted
+	case status == alipayTradeClosed:
+		output.Kind = EventSessionExpired
+	default:
+		return output, nil
+	}
+
+	output.Session = &Session{
+		ID:          form.Get("out_trade_no"),
+		Status:      status,
+		Paid:        output.Kind == EventSessionCompleted,
+		Closed:      output.Kind == EventSessionExpired,
+		Currency:    "cny",
+		AmountTotal: amount,
+		PaymentID:   form.Get("trade_no"),
+		UID:         output.UID,
+		ChargeID:    output.ChargeID,
+		Payload:     util.Bytes(payload),
+	}
+	return output, nil
+}
+
+func (p *Alipay) Refund(ctx context.Context, input *RefundInput) (*Refund, error) {
+	trade := &alipayTrade{}
+	raw, err := p.call(ctx, "alipay.trade.refund", map[string]any{
+		"out_trade_no":   input.SessionID,
+		"refund_amount":  formatYuan(input.Amount),
+		"out_request_no": input.IdempotencyKey,
+	}, trade)
+	if err != nil {
+		return nil, err
+	}
+
+	refunded, err := parseYuan(trade.RefundFee)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	return &Refund{
+		ID:             input.IdempotencyKey,
+		Amount:         input.Amount,
+		AmountRefunded: refunded,
+		Status:         "succeeded",
+		Payload:        util.Bytes(raw),
+	}, nil
+}
+
+// GetPrice returns the price of the id, see unitAmount.
+func (p *Alipay) GetPrice(ctx context.Context, id string) (*Price, error) {
+	unit, err := p.unitAmount(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Price{
+		ID:         id,
+		UnitAmount: unit,
+		Currency:   "cny",
+	}, nil
+}
+
+// unitAmount returns the configured price of one credit for "cny",
+// other price ids are the amounts in fen, such as the prices of packages.
+func (p *Alipay) unitAmount(id string) (int64, error) {
+	if id == "cny" {
+		return p.cfg.UnitAmount, nil
+	}
+
+	amount, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || amount <= 0 {
+		return 0, gear.ErrBadRequest.WithMsgf("invalid alipay price %q", id)
+	}
+	return amount, nil
+}
+
+// call calls the Alipay open API, and verifies the signature of the response.
+func (p *Alipay) call(ctx context.Context, method string, biz map[string]any, output *alipayTrade) ([]byte, error) {
+	content, err := json.Marshal(biz)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+
+	form := url.Values{}
+	form.Set("app_id", p.cfg.AppID)
+	form.Set("method", method)
+	form.Set("format", "JSON")
+	form.Set("charset", "utf-8")
+	form.Set("sign_type", "RSA2")
+	form.Set("timestamp", time.Now().In(alipayTimezone).Format("2006-01-02 15:04:05"))
+	form.Set("version", "1.0")
+	form.Set("notify_url", p.cfg.NotifyUrl)
+	form.Set("biz_content", string(content))
+	sign, err := p.sign(signContent(form))
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	form.Set("sign", sign)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.Gateway, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	req.Header.Set(gear.HeaderContentType, "application/x-www-form-urlencoded;charset=utf-8")
+	resp, err := p.cli.Do(req)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		return nil, gear.ErrInternalServerError.WithMsgf("%s failed, code: %d, error: %v", method, resp.StatusCode, err)
+	}
+
+	res := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &res); err != nil {
+		return nil, gear.ErrInternalServerError.WithMsgf("%s failed, error: %v", method, err)
+	}
+	raw, ok := res[strings.ReplaceAll(method, ".", "_")+"_response"]
+	if !ok {
+		raw = res["error_response"]
+	}
+	if err = json.Unmarshal(raw, output); err != nil {
+		return nil, gear.ErrInternalServerError.WithMsgf("%s failed, error: %v", method, err)
+	}
+
+	if output.Code != "10000" {
+		code := http.StatusInternalServerError
+		if output.SubCode == "ACQ.TRADE_NOT_EXIST" {
+			code = http.StatusNotFound
+		}
+		return nil, gear.Err.WithCode(code).WithMsgf("%s failed, %s: %s", method, output.SubCode, output.SubMsg)
+	}
+
+	sign = ""
+	_ = json.Unmarshal(res["sign"], &sign)
+	if err = p.verify(string(raw), sign); err != nil {
+		return nil, gear.ErrInternalServerError.WithMsgf("%s failed, verify response: %v", method, err)
+	}
+	return raw, nil
+}
+
+func (p *Alipay) sign(content string) (string, error) {
+	hashed := sha256.Sum256([]byte(content))
+	sig, err := rsa.SignPKCS1v15(nil, p.privateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func (p *Alipay) verify(content, sign string) error {
+	sig, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(content))
+	return rsa.VerifyPKCS1v15(p.publicKey, crypto.SHA256, hashed[:], sig)
+}
+
+var alipayTimezone = time.FixedZone("CST", 8*3600)
+
+// signContent returns the sorted "k=v" pairs joined by "&", without sign, sign_type and empty values.
+func signContent(form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		if k != "sign" && k != "sign_type" && form.Get(k) != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	b := strings.Builder{}
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(k + "=" + form.Get(k))
+	}
+	return b.String()
+}
+
+func parseAlipayTradeNo(id string) (uid, cid util.ID) {
+	u, c, _ := strings.Cut(id, "_")
+	uid, _ = util.ParseID(u)
+	cid, _ = util.ParseID(c)
+	return uid, cid
+}
+
+// formatYuan formats the amount in fen, such as 1234 => "12.34".
+func formatYuan(amount int64) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
+
+// parseYuan parses the amount in fen, such as "12.34" => 1234, "" => 0.
+func parseYuan(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	yuan, fen, _ := strings.Cut(s, ".")
+	if len(fen) > 2 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	fen = (fen + "00")[:2]
+	y, err := strconv.ParseInt(yuan, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	f, err := strconv.ParseInt(fen, 10, 64)
+	if err != nil || y < 0 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return y*100 + f, nil
+}
+
+func decodeKey(key string) ([]byte, error) {
+	if block, _ := pem.Decode([]byte(key)); block != nil {
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+}
+
+func parsePrivateKey(key string) (*rsa.PrivateKey, error) {
+	der, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if rk, ok := k.(*rsa.PrivateKey); ok {
+		return rk, nil
+	}
+	return nil, fmt.Errorf("not a RSA private key")
+}
+
+func parsePublicKey(key string) (*rsa.PublicKey, error) {
+	der, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if rk, ok := k.(*rsa.PublicKey); ok {
+		return rk, nil
+	}
+	return nil, fmt.Errorf("not a RSA public key")
+}
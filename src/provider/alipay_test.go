@@ -0,0 +1,253 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// alipayGateway is a local stand-in of the Alipay open API gateway.
+type alipayGateway struct {
+	srv    *httptest.Server
+	app    *Alipay // signs as Alipay with the alipay private key
+	client *rsa.PublicKey
+
+	mu     sync.Mutex
+	trades map[string]*alipayTrade
+}
+
+func newAlipayTestEnv(t *testing.T) (*Alipay, *alipayGateway) {
+	appKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	alipayKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	encodePub := func(k *rsa.PrivateKey) string {
+		der, _ := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		return base64.StdEncoding.EncodeToString(der)
+	}
+	encodePriv := func(k *rsa.PrivateKey) string {
+		der, _ := x509.MarshalPKCS8PrivateKey(k)
+		return base64.StdEncoding.EncodeToString(der)
+	}
+
+	gw := &alipayGateway{client: &appKey.PublicKey, trades: make(map[string]*alipayTrade)}
+	gw.app = &Alipay{privateKey: alipayKey, publicKey: &appKey.PublicKey}
+	gw.srv = httptest.NewServer(http.HandlerFunc(gw.serve))
+	t.Cleanup(gw.srv.Close)
+
+	p, err := NewAlipay(conf.Alipay{
+		AppID:      "2021000000000000",
+		Gateway:    gw.srv.URL + "/gateway.do",
+		NotifyUrl:  "http://127.0.0.1/v1/webhook/alipay",
+		Subject:    "test",
+		UnitAmount: 70,
+		PrivateKey: encodePriv(appKey),
+		PublicKey:  encodePub(alipayKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, gw
+}
+
+func (gw *alipayGateway) serve(w http.ResponseWriter, r *http.Request) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	data, _ := io.ReadAll(r.Body)
+	form, _ := url.ParseQuery(string(data))
+	biz := map[string]string{}
+	_ = json.Unmarshal([]byte(form.Get("biz_content")), &biz)
+
+	method := form.Get("method")
+	res := &alipayTrade{Code: "10000", Msg: "Success"}
+	verifier := &Alipay{publicKey: gw.client}
+	if err := verifier.verify(signContent(form), form.Get("sign")); err != nil {
+		res = &alipayTrade{Code: "40002", SubCode: "isv.invalid-signature", SubMsg: err.Error()}
+	} else {
+		trade := gw.trades[biz["out_trade_no"]]
+		switch {
+		case method == "alipay.trade.precreate":
+			trade = &alipayTrade{
+				OutTradeNo:  biz["out_trade_no"],
+				TradeNo:     "2023" + biz["out_trade_no"],
+				TradeStatus: alipayWaitBuyerPay,
+				TotalAmount: biz["total_amount"],
+				QRCode:      "https://qr.alipay.com/" + biz["out_trade_no"],
+			}
+			gw.trades[trade.OutTradeNo] = trade
+			res.OutTradeNo = trade.OutTradeNo
+			res.QRCode = trade.QRCode
+		case trade == nil:
+			res = &alipayTrade{Code: "40004", SubCode: "ACQ.TRADE_NOT_EXIST", SubMsg: "trade not exist"}
+		case method == "alipay.trade.query":
+			v := *trade
+			v.Code, v.Msg = res.Code, res.Msg
+			res = &v
+		case method == "alipay.trade.refund":
+			refunded, _ := parseYuan(trade.RefundFee)
+			amount, _ := parseYuan(biz["refund_amount"])
+			trade.RefundFee = formatYuan(refunded + amount)
+			res.OutTradeNo = trade.OutTradeNo
+			res.TradeNo = trade.TradeNo
+			res.RefundFee = trade.RefundFee
+		}
+	}
+
+	raw, _ := json.Marshal(res)
+	sign, _ := gw.app.sign(string(raw))
+	out, _ := json.Marshal(map[string]any{
+		strings.ReplaceAll(method, ".", "_") + "_response": json.RawMessage(raw),
+		"sign": sign,
+	})
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Write(out)
+}
+
+// pay pays the trade and returns the signed notification.
+func (gw *alipayGateway) pay(id string) []byte {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	trade := gw.trades[id]
+	trade.TradeStatus = alipayTradeSuccess
+	return gw.notify(trade, "")
+}
+
+func (gw *alipayGateway) notify(trade *alipayTrade, refundNo string) []byte {
+	form := url.Values{}
+	form.Set("notify_id", "notify_"+util.NewUUID().Base64())
+	form.Set("notify_type", "trade_status_sync")
+	form.Set("notify_time", "2023-10-01 12:00:00")
+	form.Set("app_id", "2021000000000000")
+	form.Set("charset", "utf-8")
+	form.Set("version", "1.0")
+	form.Set("trade_no", trade.TradeNo)
+	form.Set("out_trade_no", trade.OutTradeNo)
+	form.Set("trade_status", trade.TradeStatus)
+	form.Set("total_amount", trade.TotalAmount)
+	form.Set("refund_fee", trade.RefundFee)
+	form.Set("out_biz_no", refundNo)
+	sign, _ := gw.app.sign(signContent(form))
+	form.Set("sign", sign)
+	form.Set("sign_type", "RSA2")
+	return []byte(form.Encode())
+}
+
+func TestAlipay(t *testing.T) {
+	p, gw := newAlipayTestEnv(t)
+	ctx := context.Background()
+	uid := util.NewID()
+	cid := util.NewID()
+
+	t.Run("CreateSession and GetSession", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := p.CreateSession(ctx, &SessionInput{UID: uid, ChargeID: cid, Currency: util.Ptr("usd"), PriceID: "cny", Quantity: 100})
+		assert.Error(err)
+
+		_, err = p.CreateSession(ctx, &SessionInput{UID: uid, ChargeID: cid, PriceID: "price_xxx", Quantity: 100})
+		assert.Error(err)
+
+		cs, err := p.CreateSession(ctx, &SessionInput{UID: uid, ChargeID: cid, PriceID: "cny", Quantity: 100})
+		assert.NoError(err)
+		assert.Equal(uid.String()+"_"+cid.String(), cs.ID)
+		assert.Equal("https://qr.alipay.com/"+cs.ID, cs.URL)
+		assert.Equal(int64(7000), cs.AmountTotal)
+		assert.Equal("cny", cs.Currency)
+
+		cs, err = p.GetSession(ctx, cs.ID)
+		assert.NoError(err)
+		assert.False(cs.Paid)
+		assert.Equal(uid, cs.UID)
+		assert.Equal(cid, cs.ChargeID)
+		assert.Equal(int64(7000), cs.AmountTotal)
+
+		other := util.NewID()
+		_, err = p.GetSession(ctx, uid.String()+"_"+other.String())
+		assert.True(util.IsNotFoundErr(err))
+
+		// a package
+		cs, err = p.CreateSession(ctx, &SessionInput{UID: uid, ChargeID: other, PriceID: "31500", Quantity: 1})
+		assert.NoError(err)
+		assert.Equal(int64(31500), cs.AmountTotal)
+
+		price, err := p.GetPrice(ctx, "31500")
+		assert.NoError(err)
+		assert.Equal(int64(31500), price.UnitAmount)
+	})
+
+	t.Run("VerifyWebhook", func(t *testing.T) {
+		assert := assert.New(t)
+
+		id := uid.String() + "_" + cid.String()
+		payload := gw.pay(id)
+		event, err := p.VerifyWebhook(ctx, payload, http.Header{})
+		assert.NoError(err)
+		assert.Equal(EventSessionCompleted, event.Kind)
+		assert.Equal(uid, event.UID)
+		assert.Equal(cid, event.ChargeID)
+		assert.True(event.Session.Paid)
+		assert.Equal(int64(7000), event.Session.AmountTotal)
+
+		form, _ := url.ParseQuery(string(payload))
+		form.Set("total_amount", "0.01")
+		_, err = p.VerifyWebhook(ctx, []byte(form.Encode()), http.Header{})
+		assert.Error(err)
+
+		ev, err := p.ParseEvent(ctx, payload)
+		assert.NoError(err)
+		assert.Equal(event.ID, ev.ID)
+	})
+
+	t.Run("Refund", func(t *testing.T) {
+		assert := assert.New(t)
+
+		id := uid.String() + "_" + cid.String()
+		rf, err := p.Refund(ctx, &RefundInput{UID: uid, ChargeID: cid, SessionID: id, Amount: 1400, IdempotencyKey: "refund_1"})
+		assert.NoError(err)
+		assert.Equal(int64(1400), rf.AmountRefunded)
+
+		rf, err = p.Refund(ctx, &RefundInput{UID: uid, ChargeID: cid, SessionID: id, Amount: 700, IdempotencyKey: "refund_2"})
+		assert.NoError(err)
+		assert.Equal(int64(2100), rf.AmountRefunded)
+
+		event, err := p.VerifyWebhook(ctx, gw.notify(gw.trades[id], "refund_2"), http.Header{})
+		assert.NoError(err)
+		assert.Equal(EventChargeRefunded, event.Kind)
+		assert.Equal("refund_2", event.Refund.ID)
+		assert.Equal(int64(2100), event.Refund.AmountRefunded)
+	})
+}
+
+func TestYuan(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("0.01", formatYuan(1))
+	assert.Equal("12.34", formatYuan(1234))
+	assert.Equal("70.00", formatYuan(7000))
+
+	for s, v := range map[string]int64{"": 0, "0.01": 1, "12.3": 1230, "12.34": 1234, "70": 7000} {
+		n, err := parseYuan(s)
+		assert.NoError(err)
+		assert.Equal(v, n, s)
+	}
+
+	for _, s := range []string{"1.234", "abc", "-1.00", "1.x"} {
+		_, err := parseYuan(s)
+		assert.Error(err, s)
+	}
+}
@@ -0,0 +1,296 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+func init() {
+	util.DigProvide(NewProviders)
+}
+
+// Provider is a payment provider, such as Stripe.
+type Provider interface {
+	Name() string
+	Config() Config
+	// CreateSession creates a payment session for the charge.
+	CreateSession(ctx context.Context, input *SessionInput) (*Session, error)
+	GetSession(ctx context.Context, id string) (*Session, error)
+	// VerifyWebhook verifies the signature of a webhook request and parses the event.
+	VerifyWebhook(ctx context.Context, payload []byte, header http.Header) (*Event, error)
+	// ParseEvent parses a verified event, such as a journaled one.
+	ParseEvent(ctx context.Context, payload []byte) (*Event, error)
+	Refund(ctx context.Context, input *RefundInput) (*Refund, error)
+	GetPrice(ctx context.Context, id string) (*Price, error)
+}
+
+// Subscriber is implemented by providers that support recurring subscriptions.
+type Subscriber interface {
+	// CreateSubscriptionSession creates a payment session that starts the subscription.
+	CreateSubscriptionSession(ctx context.Context, input *SubscriptionInput) (*Session, error)
+	CancelSubscription(ctx context.Context, id string) (*Subscription, error)
+}
+
+// CustomerManager is implemented by providers that keep the payment methods of the saved customers.
+type CustomerManager interface {
+	// CreatePortalSession creates a session of the hosted page where the customer
+	// manages the payment methods and views the invoices.
+	CreatePortalSession(ctx context.Context, customer string) (*PortalSession, error)
+	ListPaymentMethods(ctx context.Context, customer string) ([]PaymentMethod, error)
+}
+
+// Settler is implemented by providers that list the settled payments for the settlement reports.
+type Settler interface {
+	// ListTransactions lists the payments settled in the time range [from, to), in unix timestamps in seconds.
+	ListTransactions(ctx context.Context, from, to int64) ([]Transaction, error)
+}
+
+// Payouter is implemented by providers that pay out to the connected accounts of the users.
+type Payouter interface {
+	// CreateAccount creates a connected account for the user, the user should complete the onboarding.
+	CreateAccount(ctx context.Context, uid util.ID) (*Account, error)
+	GetAccount(ctx context.Context, id string) (*Account, error)
+	// CreateAccountLink returns the URL of the hosted onboarding page of the connected account.
+	CreateAccountLink(ctx context.Context, id string) (string, error)
+	// CreatePayout transfers the amount to the connected account, and pays it out to the bank account of the user.
+	CreatePayout(ctx context.Context, input *PayoutInput) (*Payout, error)
+	// ReverseTransfer reverses the transfer of the payout back to the platform,
+	// it is a no-op if the transfer was not made or has been reversed.
+	ReverseTransfer(ctx context.Context, payoutID util.ID) error
+}
+
+// ReceiptDetailer is implemented by providers that collect the billing details in the payment sessions.
+type ReceiptDetailer interface {
+	// ReceiptDetails parses the billing details from the raw object of a completed session.
+	ReceiptDetails(payload []byte) (*ReceiptDetails, error)
+}
+
+// WebhookAcker is implemented by providers that expect a specific response body
+// to acknowledge webhooks, other providers are acknowledged with any 2xx response.
+type WebhookAcker interface {
+	WebhookAck() string
+}
+
+type Config struct {
+	PublicKey string
+	PriceID   string // the price of one credit
+}
+
+type SessionInput struct {
+	UID      util.ID
+	ChargeID util.ID
+	Customer string  // the saved customer of the user, optional
+	Currency *string // the presentment currency, optional
+	PriceID  string
+	Quantity uint
+	Coupon   string // the provider coupon id, optional
+}
+
+type Session struct {
+	ID              string
+	URL             string
+	Status          string
+	Paid            bool // false for delayed payment methods that are not settled
+	Closed          bool // expired or closed, the session can not be paid any more
+	Currency        string
+	AmountTotal     int64
+	AmountDiscount  int64
+	AmountTax       int64
+	TaxJurisdiction string // the country of the billing address, such as "DE", or "US-CA" with the state
+	ExpiresAt       int64  // unix timestamp in seconds
+	PaymentID       string
+	Customer        string
+	CustomerDetails util.Bytes // CBOR encoded
+	UID             util.ID
+	ChargeID        util.ID
+	Payload         util.Bytes // the raw provider object
+}
+
+type EventKind string
+
+// The provider events are normalized to the kinds, other events are ignored.
+const (
+	EventUnknown          EventKind = ""
+	EventSessionCompleted EventKind = "session.completed" // paid, or waiting for a delayed payment
+	EventSessionFailed    EventKind = "session.failed"    // the delayed payment failed
+	EventSessionExpired   EventKind = "session.expired"
+	EventChargeRefunded   EventKind = "charge.refunded"
+	EventDisputeCreated   EventKind = "dispute.created"
+	EventDisputeClosed    EventKind = "dispute.closed"
+
+	EventSubscriptionCreated EventKind = "subscription.created" // the subscription session completed
+	EventSubscriptionDeleted EventKind = "subscription.deleted" // canceled, or the subscription session expired
+	EventInvoicePaid         EventKind = "invoice.paid"         // a billing cycle is paid
+
+	EventPayoutPaid   EventKind = "payout.paid"   // arrived at the bank account of the user
+	EventPayoutFailed EventKind = "payout.failed" // failed, canceled, or the transfer was reversed
+)
+
+type Event struct {
+	ID         string
+	Type       string // the provider event type
+	Kind       EventKind
+	ObjectType string
+	ObjectID   string
+	UID        util.ID
+	ChargeID   util.ID
+	Session    *Session // for session events
+	Refund     *Refund  // for charge.refunded, the latest refund
+	Dispute    *Dispute // for dispute events
+
+	SubscriptionID util.ID       // the subscription id in Walletbase, for subscription events
+	Subscription   *Subscription // for subscription events
+
+	PayoutID util.ID // the payout id in Walletbase, for payout events
+	Payout   *Payout // for payout events
+	Payload  util.Bytes
+}
+
+type SubscriptionInput struct {
+	UID            util.ID
+	SubscriptionID util.ID // the subscription id in Walletbase
+	Customer       string  // the saved customer of the user, optional
+	PriceID        string  // the recurring price of the plan
+}
+
+type Subscription struct {
+	ID               string // the provider subscription id
+	Status           string
+	CurrentPeriodEnd int64  // unix timestamp in seconds
+	InvoiceID        string // for invoice.paid
+	Currency         string // for invoice.paid
+	AmountPaid       int64  // for invoice.paid
+	AmountTax        int64  // for invoice.paid
+	TaxJurisdiction  string // for invoice.paid
+	Payload          util.Bytes
+}
+
+type PortalSession struct {
+	ID  string
+	URL string
+}
+
+type PaymentMethod struct {
+	ID       string
+	Type     string // "card", "link", ...
+	Brand    string // for cards
+	Last4    string // for cards
+	ExpMonth int64  // for cards
+	ExpYear  int64  // for cards
+}
+
+type Transaction struct {
+	ID        string  // the provider transaction id
+	PaymentID string  // the provider payment id
+	InvoiceID string  // for the payments of subscription invoices
+	UID       util.ID // zero if not resolved
+	ChargeID  util.ID // the charge id in Walletbase, zero if not resolved
+	Currency  string
+	Amount    int64
+	CreatedAt int64 // unix timestamp in seconds
+}
+
+type Account struct {
+	ID               string
+	DetailsSubmitted bool
+	PayoutsEnabled   bool
+	Payload          util.Bytes
+}
+
+type PayoutInput struct {
+	UID      util.ID
+	PayoutID util.ID // the payout id in Walletbase, as the idempotency key
+	Account  string  // the connected account
+	Currency string
+	Amount   int64
+}
+
+type Payout struct {
+	ID          string // the provider payout id
+	TransferID  string
+	Status      string
+	FailureCode string
+	FailureMsg  string
+	Payload     util.Bytes
+}
+
+type ReceiptDetails struct {
+	Name           string
+	Email          string
+	Address        []string // the address lines
+	TaxID          string
+	AmountSubtotal int64 // before discounts and taxes
+	AmountTax      int64
+}
+
+type RefundInput struct {
+	UID            util.ID
+	ChargeID       util.ID
+	SessionID      string
+	Amount         int64
+	IdempotencyKey string
+}
+
+type Refund struct {
+	ID             string
+	Amount         int64
+	AmountRefunded int64 // the total amount refunded of the payment
+	Status         string
+	Payload        util.Bytes
+}
+
+type Dispute struct {
+	ID      string
+	Amount  int64
+	Reason  string
+	Status  string
+	Payload util.Bytes
+}
+
+type Price struct {
+	ID         string
+	UnitAmount int64
+	Currency   string
+}
+
+// Providers is the registry of payment providers keyed by name.
+type Providers struct {
+	mu      sync.RWMutex
+	m       map[string]Provider
+	Default string
+}
+
+func NewProviders() (*Providers, error) {
+	ps := &Providers{m: make(map[string]Provider), Default: "stripe"}
+	ps.Register(NewStripe(conf.Config.Stripe))
+	if conf.Config.Alipay.AppID != "" {
+		p, err := NewAlipay(conf.Config.Alipay)
+		if err != nil {
+			return nil, err
+		}
+		ps.Register(p)
+	}
+	return ps, nil
+}
+
+// Register adds or replaces the provider with the same name.
+func (ps *Providers) Register(p Provider) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.m[p.Name()] = p
+}
+
+func (ps *Providers) Get(name string) (Provider, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	if p, ok := ps.m[name]; ok {
+		return p, nil
+	}
+	return nil, gear.ErrBadRequest.WithMsgf("payment provider %q not supported", name)
+}
@@ -0,0 +1,877 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/client"
+	"github.com/stripe/stripe-go/v75/webhook"
+	"github.com/teambition/gear"
+
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+type Stripe struct {
+	cfg conf.Stripe
+	sc  *client.API
+}
+
+func NewStripe(cfg conf.Stripe) *Stripe {
+	return &Stripe{cfg: cfg, sc: client.New(cfg.SecretKey, nil)}
+}
+
+func (p *Stripe) Name() string {
+	return "stripe"
+}
+
+func (p *Stripe) Config() Config {
+	return Config{
+		PublicKey: p.cfg.PubKey,
+		PriceID:   p.cfg.PriceID,
+	}
+}
+
+func (p *Stripe) CreateSession(ctx context.Context, input *SessionInput) (*Session, error) {
+	metadata := map[string]string{
+		"uid": input.UID.String(),
+		"cid": input.ChargeID.String(),
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		Params:           stripe.Params{Context: ctx},
+		SuccessURL:       stripe.String(p.cfg.SuccessUrl),
+		Mode:             stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Currency:         input.Currency,
+		CustomerCreation: stripe.String("always"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Quantity: stripe.Int64(int64(input.Quantity)),
+				Price:    stripe.String(input.PriceID),
+			},
+		},
+		Metadata: metadata,
+		// charges and disputes carry the metadata of the payment intent
+		PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{
+			Metadata: metadata,
+			// save the payment method to the customer for the next top up
+			SetupFutureUsage: stripe.String(string(stripe.PaymentIntentSetupFutureUsageOnSession)),
+		},
+	}
+	if input.Coupon != "" {
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{
+			{Coupon: stripe.String(input.Coupon)},
+		}
+	}
+	if input.Customer != "" {
+		params.Customer = stripe.String(input.Customer)
+		params.CustomerCreation = nil
+	}
+	p.withAutomaticTax(params)
+
+	cs, err := p.sc.CheckoutSessions.New(params)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	return stripeSession(cs, nil)
+}
+
+func (p *Stripe) CreateSubscriptionSession(ctx context.Context, input *SubscriptionInput) (*Session, error) {
+	metadata := map[string]string{
+		"uid": input.UID.String(),
+		"sid": input.SubscriptionID.String(),
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		Params:     stripe.Params{Context: ctx},
+		SuccessURL: stripe.String(p.cfg.SuccessUrl),
+		Mode:       stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Quantity: stripe.Int64(1),
+				Price:    stripe.String(input.PriceID),
+			},
+		},
+		Metadata: metadata,
+		// invoices carry the metadata of the subscription
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+			Metadata: metadata,
+		},
+	}
+	if input.Customer != "" {
+		params.Customer = stripe.String(input.Customer)
+	}
+	p.withAutomaticTax(params)
+
+	cs, err := p.sc.CheckoutSessions.New(params)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	return stripeSession(cs, nil)
+}
+
+// withAutomaticTax collects the billing address and the tax ids for the automatic tax if enabled.
+func (p *Stripe) withAutomaticTax(params *stripe.CheckoutSessionParams) {
+	if !p.cfg.AutomaticTax {
+		return
+	}
+
+	params.AutomaticTax = &stripe.CheckoutSessionAutomaticTaxParams{Enabled: stripe.Bool(true)}
+	params.BillingAddressCollection = stripe.String("required")
+	params.TaxIDCollection = &stripe.CheckoutSessionTaxIDCollectionParams{Enabled: stripe.Bool(true)}
+	if params.Customer != nil {
+		// the saved customer should keep the collected address for the tax
+		params.CustomerUpdate = &stripe.CheckoutSessionCustomerUpdateParams{
+			Address: stripe.String("auto"),
+			Name:    stripe.String("auto"),
+		}
+	}
+}
+
+func (p *Stripe) CancelSubscription(ctx context.Context, id string) (*Subscription, error) {
+	sub, err := p.sc.Subscriptions.Cancel(id, &stripe.SubscriptionCancelParams{
+		Params: stripe.Params{Context: ctx},
+	})
+	if err != nil {
+		return nil, stripeError(err)
+	}
+
+	payload, err := json.Marshal(sub)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	return &Subscription{
+		ID:               sub.ID,
+		Status:           string(sub.Status),
+		CurrentPeriodEnd: sub.CurrentPeriodEnd,
+		Payload:          util.Bytes(payload),
+	}, nil
+}
+
+func (p *Stripe) CreatePortalSession(ctx context.Context, customer string) (*PortalSession, error) {
+	returnURL := p.cfg.PortalReturnUrl
+	if returnURL == "" {
+		returnURL = p.cfg.SuccessUrl
+	}
+
+	ps, err := p.sc.BillingPortalSessions.New(&stripe.BillingPortalSessionParams{
+		Params:    stripe.Params{Context: ctx},
+		Customer:  stripe.String(customer),
+		ReturnURL: stripe.String(returnURL),
+	})
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return &PortalSession{ID: ps.ID, URL: ps.URL}, nil
+}
+
+func (p *Stripe) ListPaymentMethods(ctx context.Context, customer string) ([]PaymentMethod, error) {
+	params := &stripe.CustomerListPaymentMethodsParams{
+		Customer: stripe.String(customer),
+	}
+	params.Context = ctx
+
+	output := make([]PaymentMethod, 0)
+	iter := p.sc.Customers.ListPaymentMethods(params)
+	for iter.Next() {
+		pm := iter.PaymentMethod()
+		method := PaymentMethod{ID: pm.ID, Type: string(pm.Type)}
+		if pm.Card != nil {
+			method.Brand = string(pm.Card.Brand)
+			method.Last4 = pm.Card.Last4
+			method.ExpMonth = pm.Card.ExpMonth
+			method.ExpYear = pm.Card.ExpYear
+		}
+		output = append(output, method)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, stripeError(err)
+	}
+	return output, nil
+}
+
+func (p *Stripe) ListTransactions(ctx context.Context, from, to int64) ([]Transaction, error) {
+	params := &stripe.BalanceTransactionListParams{
+		CreatedRange: &stripe.RangeQueryParams{GreaterThanOrEqual: from, LesserThan: to},
+	}
+	params.Context = ctx
+	params.AddExpand("data.source")
+
+	output := make([]Transaction, 0)
+	iter := p.sc.BalanceTransactions.List(params)
+	for iter.Next() {
+		bt := iter.BalanceTransaction()
+		if bt.Source == nil || bt.Source.Charge == nil {
+			continue // refunds, payouts, fees...
+		}
+
+		ch := bt.Source.Charge
+		tx := Transaction{
+			ID:        bt.ID,
+			PaymentID: ch.ID,
+			Currency:  string(ch.Currency),
+			Amount:    ch.Amount,
+			CreatedAt: bt.Created,
+		}
+		if ch.Invoice != nil {
+			tx.InvoiceID = ch.Invoice.ID
+		} else {
+			// unresolved payments are reported as not credited
+			tx.UID, tx.ChargeID, _ = p.resolveCharge(ctx, ch.Metadata, ch.PaymentIntent)
+		}
+		output = append(output, tx)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, stripeError(err)
+	}
+	return output, nil
+}
+
+func (p *Stripe) CreateAccount(ctx context.Context, uid util.ID) (*Account, error) {
+	params := &stripe.AccountParams{
+		Type: stripe.String(string(stripe.AccountTypeExpress)),
+		Capabilities: &stripe.AccountCapabilitiesParams{
+			Transfers: &stripe.AccountCapabilitiesTransfersParams{Requested: stripe.Bool(true)},
+		},
+		// the payouts are created by us after the review
+		Settings: &stripe.AccountSettingsParams{
+			Payouts: &stripe.AccountSettingsPayoutsParams{
+				Schedule: &stripe.AccountSettingsPayoutsScheduleParams{Interval: stripe.String("manual")},
+			},
+		},
+		Metadata: map[string]string{"uid": uid.String()},
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey("account_" + uid.String())
+
+	acct, err := p.sc.Accounts.New(params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return stripeAccount(acct)
+}
+
+func (p *Stripe) GetAccount(ctx context.Context, id string) (*Account, error) {
+	acct, err := p.sc.Accounts.GetByID(id, &stripe.AccountParams{
+		Params: stripe.Params{Context: ctx},
+	})
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return stripeAccount(acct)
+}
+
+func (p *Stripe) CreateAccountLink(ctx context.Context, id string) (string, error) {
+	link, err := p.sc.AccountLinks.New(&stripe.AccountLinkParams{
+		Params:     stripe.Params{Context: ctx},
+		Account:    stripe.String(id),
+		RefreshURL: stripe.String(p.cfg.ConnectUrl),
+		ReturnURL:  stripe.String(p.cfg.ConnectUrl),
+		Type:       stripe.String("account_onboarding"),
+	})
+	if err != nil {
+		return "", stripeError(err)
+	}
+	return link.URL, nil
+}
+
+func (p *Stripe) CreatePayout(ctx context.Context, input *PayoutInput) (*Payout, error) {
+	metadata := map[string]string{
+		"uid": input.UID.String(),
+		"pid": input.PayoutID.String(),
+	}
+
+	params := &stripe.TransferParams{
+		Amount:        stripe.Int64(input.Amount),
+		Currency:      stripe.String(input.Currency),
+		Destination:   stripe.String(input.Account),
+		TransferGroup: stripe.String(input.PayoutID.String()),
+		Metadata:      metadata,
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey("transfer_" + input.PayoutID.String())
+	tr, err := p.sc.Transfers.New(params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+
+	payoutParams := &stripe.PayoutParams{
+		Amount:   stripe.Int64(input.Amount),
+		Currency: stripe.String(input.Currency),
+		Metadata: metadata,
+	}
+	payoutParams.Context = ctx
+	payoutParams.SetStripeAccount(input.Account)
+	payoutParams.SetIdempotencyKey("payout_" + input.PayoutID.String())
+	po, err := p.sc.Payouts.New(payoutParams)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+
+	output, err := stripePayout(po, nil)
+	if err != nil {
+		return nil, err
+	}
+	output.TransferID = tr.ID
+	return output, nil
+}
+
+func (p *Stripe) ReverseTransfer(ctx context.Context, payoutID util.ID) error {
+	params := &stripe.TransferListParams{TransferGroup: stripe.String(payoutID.String())}
+	params.Context = ctx
+	iter := p.sc.Transfers.List(params)
+	for iter.Next() {
+		tr := iter.Transfer()
+		if tr.Reversed {
+			continue
+		}
+
+		reversal := &stripe.TransferReversalParams{ID: stripe.String(tr.ID)}
+		reversal.Context = ctx
+		reversal.SetIdempotencyKey("reversal_" + tr.ID)
+		if _, err := p.sc.TransferReversals.New(reversal); err != nil {
+			return stripeError(err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return stripeError(err)
+	}
+	return nil
+}
+
+func (p *Stripe) ReceiptDetails(payload []byte) (*ReceiptDetails, error) {
+	cs := &stripe.CheckoutSession{}
+	if err := json.Unmarshal(payload, cs); err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+
+	output := &ReceiptDetails{AmountSubtotal: cs.AmountSubtotal}
+	if cs.TotalDetails != nil {
+		output.AmountTax = cs.TotalDetails.AmountTax
+	}
+	if cd := cs.CustomerDetails; cd != nil {
+		output.Name = cd.Name
+		output.Email = cd.Email
+		if len(cd.TaxIDs) > 0 {
+			output.TaxID = cd.TaxIDs[0].Value
+		}
+		if addr := cd.Address; addr != nil {
+			region := strings.Join(strings.Fields(addr.City+" "+addr.State+" "+addr.PostalCode), " ")
+			for _, line := range []string{addr.Line1, addr.Line2, region, addr.Country} {
+				if line != "" {
+					output.Address = append(output.Address, line)
+				}
+			}
+		}
+	}
+	return output, nil
+}
+
+func (p *Stripe) GetSession(ctx context.Context, id string) (*Session, error) {
+	cs, err := p.sc.CheckoutSessions.Get(id, &stripe.CheckoutSessionParams{
+		Params: stripe.Params{Context: ctx},
+	})
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return stripeSession(cs, nil)
+}
+
+func (p *Stripe) VerifyWebhook(ctx context.Context, payload []byte, header http.Header) (*Event, error) {
+	event, err := webhook.ConstructEvent(payload, header.Get("Stripe-Signature"), p.cfg.WebhookKey)
+	if err != nil && p.cfg.ConnectKey != "" {
+		// the events of the connected accounts are delivered by the connect endpoint
+		event, err = webhook.ConstructEvent(payload, header.Get("Stripe-Signature"), p.cfg.ConnectKey)
+	}
+	if err != nil {
+		return nil, gear.ErrBadRequest.WithMsgf("webhook.ConstructEvent failed: %v", err)
+	}
+
+	return p.parseEvent(ctx, &event)
+}
+
+func (p *Stripe) ParseEvent(ctx context.Context, payload []byte) (*Event, error) {
+	event := &stripe.Event{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+	}
+
+	return p.parseEvent(ctx, event)
+}
+
+func (p *Stripe) Refund(ctx context.Context, input *RefundInput) (*Refund, error) {
+	cs, err := p.GetSession(ctx, input.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if cs.PaymentID == "" {
+		return nil, gear.ErrInternalServerError.WithMsg("payment intent not found")
+	}
+
+	params := &stripe.RefundParams{
+		Params:        stripe.Params{Context: ctx},
+		PaymentIntent: stripe.String(cs.PaymentID),
+		Amount:        stripe.Int64(input.Amount),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+		Metadata: map[string]string{
+			"uid": input.UID.String(),
+			"cid": input.ChargeID.String(),
+		},
+	}
+	if input.IdempotencyKey != "" {
+		params.SetIdempotencyKey(input.IdempotencyKey)
+	}
+
+	rf, err := p.sc.Refunds.New(params)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+
+	payload, err := cbor.Marshal(rf)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+
+	return &Refund{
+		ID:      rf.ID,
+		Amount:  rf.Amount,
+		Status:  string(rf.Status),
+		Payload: util.Bytes(payload),
+	}, nil
+}
+
+func (p *Stripe) GetPrice(ctx context.Context, id string) (*Price, error) {
+	pr, err := p.sc.Prices.Get(id, &stripe.PriceParams{
+		Params: stripe.Params{Context: ctx},
+	})
+	if err != nil {
+		return nil, stripeError(err)
+	}
+
+	return &Price{
+		ID:         pr.ID,
+		UnitAmount: pr.UnitAmount,
+		Currency:   string(pr.Currency),
+	}, nil
+}
+
+func (p *Stripe) parseEvent(ctx context.Context, event *stripe.Event) (*Event, error) {
+	output := &Event{
+		ID:   event.ID,
+		Type: string(event.Type),
+	}
+	if event.Data == nil {
+		return output, nil
+	}
+
+	data := event.Data.Raw
+	output.Payload = util.Bytes(data)
+	if obj := event.Data.Object; obj != nil {
+		output.ObjectType, _ = obj["object"].(string)
+		output.ObjectID, _ = obj["id"].(string)
+	}
+
+	var err error
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		output.Kind = EventSessionCompleted
+	case "checkout.session.async_payment_failed":
+		output.Kind = EventSessionFailed
+	case "checkout.session.expired":
+		output.Kind = EventSessionExpired
+	case "charge.refunded":
+		output.Kind = EventChargeRefunded
+	case "charge.dispute.created":
+		output.Kind = EventDisputeCreated
+	case "charge.dispute.closed":
+		output.Kind = EventDisputeClosed
+	case "invoice.paid":
+		output.Kind = EventInvoicePaid
+	case "customer.subscription.deleted":
+		output.Kind = EventSubscriptionDeleted
+	case "payout.paid":
+		output.Kind = EventPayoutPaid
+	case "payout.failed", "payout.canceled", "transfer.reversed":
+		output.Kind = EventPayoutFailed
+	default:
+		return output, nil
+	}
+
+	switch output.Kind {
+	case EventSessionCompleted, EventSessionFailed, EventSessionExpired:
+		cs := &stripe.CheckoutSession{}
+		if err = json.Unmarshal(data, cs); err != nil {
+			return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+		}
+		if cs.Mode == stripe.CheckoutSessionModeSubscription {
+			return parseSubscriptionSession(output, cs, data)
+		}
+		if output.Session, err = stripeSession(cs, data); err != nil {
+			return nil, err
+		}
+		output.UID = output.Session.UID
+		output.ChargeID = output.Session.ChargeID
+		if output.UID == util.ZeroID || output.ChargeID == util.ZeroID {
+			return nil, gear.ErrBadRequest.WithMsg("parse uid or cid failed")
+		}
+
+	case EventChargeRefunded:
+		ch := &stripe.Charge{}
+		if err = json.Unmarshal(data, ch); err != nil {
+			return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+		}
+		output.Refund = &Refund{
+			// the refunds of the same charge are told apart by the total amount refunded
+			ID:             fmt.Sprintf("%s:%d", ch.ID, ch.AmountRefunded),
+			AmountRefunded: ch.AmountRefunded,
+			Payload:        util.Bytes(data),
+		}
+		var rf *stripe.Refund
+		if rf, err = p.resolveRefund(ctx, ch); err != nil {
+			return nil, err
+		}
+		if rf != nil {
+			output.Refund.ID = rf.ID
+			output.Refund.Amount = rf.Amount
+			output.Refund.Status = string(rf.Status)
+		}
+		output.UID, output.ChargeID, err = p.resolveCharge(ctx, ch.Metadata, ch.PaymentIntent)
+		// charges without checkout sessions are not ours, such as the charges of subscription invoices
+		if err == nil && output.ChargeID == util.ZeroID {
+			output.Kind = EventUnknown
+		}
+
+	case EventDisputeCreated, EventDisputeClosed:
+		dp := &stripe.Dispute{}
+		if err = json.Unmarshal(data, dp); err != nil {
+			return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+		}
+		output.Dispute = &Dispute{
+			ID:      dp.ID,
+			Amount:  dp.Amount,
+			Reason:  string(dp.Reason),
+			Status:  string(dp.Status),
+			Payload: util.Bytes(data),
+		}
+		output.UID, output.ChargeID, err = p.resolveDispute(ctx, dp)
+		if err == nil && output.ChargeID == util.ZeroID {
+			output.Kind = EventUnknown
+		}
+
+	case EventInvoicePaid:
+		inv := &stripe.Invoice{}
+		if err = json.Unmarshal(data, inv); err != nil {
+			return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+		}
+		// one-off invoices are not ours
+		if inv.Subscription == nil {
+			output.Kind = EventUnknown
+			return output, nil
+		}
+
+		output.Subscription = &Subscription{
+			ID:              inv.Subscription.ID,
+			Status:          string(inv.Status),
+			InvoiceID:       inv.ID,
+			Currency:        string(inv.Currency),
+			AmountPaid:      inv.AmountPaid,
+			AmountTax:       inv.Tax,
+			TaxJurisdiction: taxJurisdiction(inv.CustomerAddress),
+			Payload:         util.Bytes(data),
+		}
+		if inv.Lines != nil && len(inv.Lines.Data) > 0 && inv.Lines.Data[0].Period != nil {
+			output.Subscription.CurrentPeriodEnd = inv.Lines.Data[0].Period.End
+		}
+		var metadata map[string]string
+		if inv.SubscriptionDetails != nil {
+			metadata = inv.SubscriptionDetails.Metadata
+		}
+		output.UID, output.SubscriptionID, err = p.resolveSubscription(ctx, metadata, inv.Subscription.ID)
+
+	case EventSubscriptionDeleted:
+		sub := &stripe.Subscription{}
+		if err = json.Unmarshal(data, sub); err != nil {
+			return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+		}
+		output.Subscription = &Subscription{
+			ID:               sub.ID,
+			Status:           string(sub.Status),
+			CurrentPeriodEnd: sub.CurrentPeriodEnd,
+			Payload:          util.Bytes(data),
+		}
+		output.UID, output.SubscriptionID, err = p.resolveSubscription(ctx, sub.Metadata, sub.ID)
+
+	case EventPayoutPaid, EventPayoutFailed:
+		var metadata map[string]string
+		if event.Type == "transfer.reversed" {
+			tr := &stripe.Transfer{}
+			if err = json.Unmarshal(data, tr); err != nil {
+				return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+			}
+			output.Payout = &Payout{
+				TransferID:  tr.ID,
+				Status:      "reversed",
+				FailureCode: "transfer_reversed",
+				FailureMsg:  "the transfer was reversed",
+				Payload:     util.Bytes(data),
+			}
+			metadata = tr.Metadata
+		} else {
+			po := &stripe.Payout{}
+			if err = json.Unmarshal(data, po); err != nil {
+				return nil, gear.ErrBadRequest.WithMsgf("json.Unmarshal failed: %v", err)
+			}
+			if output.Payout, err = stripePayout(po, data); err != nil {
+				return nil, err
+			}
+			metadata = po.Metadata
+		}
+
+		// payouts created by others have no metadata
+		if output.UID, err = util.ParseID(metadata["uid"]); err != nil {
+			output.Kind = EventUnknown
+			return output, nil
+		}
+		if output.PayoutID, err = util.ParseID(metadata["pid"]); err != nil {
+			return nil, gear.ErrBadRequest.WithMsgf("parse pid failed: %v", err)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// resolveCharge finds the uid and charge id from the metadata of a stripe object,
+// or from the checkout session of the payment intent for charges created
+// before the metadata was attached to payment intents.
+// The ids are zero for the charges without checkout sessions.
+func (p *Stripe) resolveCharge(ctx context.Context, metadata map[string]string, pi *stripe.PaymentIntent) (uid, cid util.ID, err error) {
+	if metadata["uid"] == "" {
+		if pi == nil {
+			return uid, cid, nil
+		}
+
+		params := &stripe.CheckoutSessionListParams{PaymentIntent: stripe.String(pi.ID)}
+		params.Context = ctx
+		iter := p.sc.CheckoutSessions.List(params)
+		if !iter.Next() {
+			if err = iter.Err(); err != nil {
+				return uid, cid, gear.ErrInternalServerError.From(err)
+			}
+			// no checkout session of the payment intent
+			return uid, cid, nil
+		}
+		metadata = iter.CheckoutSession().Metadata
+	}
+
+	if uid, err = util.ParseID(metadata["uid"]); err != nil {
+		return uid, cid, gear.ErrBadRequest.WithMsgf("parse uid failed: %v", err)
+	}
+	if cid, err = util.ParseID(metadata["cid"]); err != nil {
+		return uid, cid, gear.ErrBadRequest.WithMsgf("parse cid failed: %v", err)
+	}
+	return uid, cid, nil
+}
+
+// resolveRefund finds the refund that brought the amount refunded of the charge to the amount in the event,
+// the refunds of the charge are not expanded in the webhook payloads of the pinned API version.
+func (p *Stripe) resolveRefund(ctx context.Context, ch *stripe.Charge) (*stripe.Refund, error) {
+	var refunds []*stripe.Refund
+	if ch.Refunds != nil && !ch.Refunds.HasMore {
+		refunds = ch.Refunds.Data
+	}
+	if len(refunds) == 0 {
+		params := &stripe.RefundListParams{Charge: stripe.String(ch.ID)}
+		params.Context = ctx
+		iter := p.sc.Refunds.List(params)
+		for iter.Next() {
+			refunds = append(refunds, iter.Refund())
+		}
+		if err := iter.Err(); err != nil {
+			return nil, gear.ErrInternalServerError.From(err)
+		}
+	}
+
+	// the refunds are listed from the newest
+	total := int64(0)
+	for i := len(refunds) - 1; i >= 0; i-- {
+		rf := refunds[i]
+		if rf.Status == stripe.RefundStatusFailed || rf.Status == stripe.RefundStatusCanceled {
+			continue
+		}
+		total += rf.Amount
+		if total == ch.AmountRefunded {
+			return rf, nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *Stripe) resolveDispute(ctx context.Context, dp *stripe.Dispute) (util.ID, util.ID, error) {
+	if dp.Charge != nil && dp.Charge.Metadata == nil {
+		ch, err := p.sc.Charges.Get(dp.Charge.ID, &stripe.ChargeParams{
+			Params: stripe.Params{Context: ctx},
+		})
+		if err != nil {
+			return util.ZeroID, util.ZeroID, gear.ErrInternalServerError.From(err)
+		}
+		dp.Charge = ch
+	}
+
+	var metadata map[string]string
+	if dp.Charge != nil {
+		metadata = dp.Charge.Metadata
+	}
+	return p.resolveCharge(ctx, metadata, dp.PaymentIntent)
+}
+
+// resolveSubscription finds the uid and the Walletbase subscription id from the metadata,
+// or from the stripe subscription.
+func (p *Stripe) resolveSubscription(ctx context.Context, metadata map[string]string, id string) (uid, sid util.ID, err error) {
+	if metadata["uid"] == "" {
+		sub, err := p.sc.Subscriptions.Get(id, &stripe.SubscriptionParams{
+			Params: stripe.Params{Context: ctx},
+		})
+		if err != nil {
+			return uid, sid, gear.ErrInternalServerError.From(err)
+		}
+		metadata = sub.Metadata
+	}
+
+	if uid, err = util.ParseID(metadata["uid"]); err != nil {
+		return uid, sid, gear.ErrBadRequest.WithMsgf("parse uid failed: %v", err)
+	}
+	if sid, err = util.ParseID(metadata["sid"]); err != nil {
+		return uid, sid, gear.ErrBadRequest.WithMsgf("parse sid failed: %v", err)
+	}
+	return uid, sid, nil
+}
+
+// parseSubscriptionSession parses the events of checkout sessions in subscription mode.
+func parseSubscriptionSession(output *Event, cs *stripe.CheckoutSession, data []byte) (*Event, error) {
+	switch output.Kind {
+	case EventSessionCompleted:
+		output.Kind = EventSubscriptionCreated
+	case EventSessionExpired:
+		output.Kind = EventSubscriptionDeleted
+	default:
+		output.Kind = EventUnknown
+		return output, nil
+	}
+
+	output.UID, _ = util.ParseID(cs.Metadata["uid"])
+	output.SubscriptionID, _ = util.ParseID(cs.Metadata["sid"])
+	if output.UID == util.ZeroID || output.SubscriptionID == util.ZeroID {
+		return nil, gear.ErrBadRequest.WithMsg("parse uid or sid failed")
+	}
+
+	output.Subscription = &Subscription{
+		Status:  string(cs.Status),
+		Payload: util.Bytes(data),
+	}
+	if cs.Subscription != nil {
+		output.Subscription.ID = cs.Subscription.ID
+	}
+	return output, nil
+}
+
+func stripeAccount(acct *stripe.Account) (*Account, error) {
+	payload, err := json.Marshal(acct)
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	return &Account{
+		ID:               acct.ID,
+		DetailsSubmitted: acct.DetailsSubmitted,
+		PayoutsEnabled:   acct.PayoutsEnabled,
+		Payload:          util.Bytes(payload),
+	}, nil
+}
+
+func stripePayout(po *stripe.Payout, raw []byte) (*Payout, error) {
+	var err error
+	if raw == nil {
+		if raw, err = json.Marshal(po); err != nil {
+			return nil, gear.ErrInternalServerError.From(err)
+		}
+	}
+
+	return &Payout{
+		ID:          po.ID,
+		Status:      string(po.Status),
+		FailureCode: string(po.FailureCode),
+		FailureMsg:  po.FailureMessage,
+		Payload:     util.Bytes(raw),
+	}, nil
+}
+
+// taxJurisdiction returns the country of the address, with the state in US and CA
+// where the sales taxes are levied by the states or provinces.
+func taxJurisdiction(addr *stripe.Address) string {
+	if addr == nil || addr.Country == "" {
+		return ""
+	}
+	if (addr.Country == "US" || addr.Country == "CA") && addr.State != "" {
+		return addr.Country + "-" + addr.State
+	}
+	return addr.Country
+}
+
+func stripeSession(cs *stripe.CheckoutSession, raw []byte) (*Session, error) {
+	var err error
+	if raw == nil {
+		if raw, err = json.Marshal(cs); err != nil {
+			return nil, gear.ErrInternalServerError.From(err)
+		}
+	}
+
+	output := &Session{
+		ID:          cs.ID,
+		URL:         cs.URL,
+		Status:      string(cs.Status),
+		Paid:        cs.PaymentStatus != stripe.CheckoutSessionPaymentStatusUnpaid,
+		Closed:      cs.Status == stripe.CheckoutSessionStatusExpired,
+		Currency:    string(cs.Currency),
+		AmountTotal: cs.AmountTotal,
+		ExpiresAt:   cs.ExpiresAt,
+		Payload:     util.Bytes(raw),
+	}
+	if cs.PaymentIntent != nil {
+		output.PaymentID = cs.PaymentIntent.ID
+	}
+	if cs.Customer != nil {
+		output.Customer = cs.Customer.ID
+	}
+	if cs.TotalDetails != nil {
+		output.AmountDiscount = cs.TotalDetails.AmountDiscount
+		output.AmountTax = cs.TotalDetails.AmountTax
+	}
+	if cs.CustomerDetails != nil {
+		if output.AmountTax > 0 {
+			output.TaxJurisdiction = taxJurisdiction(cs.CustomerDetails.Address)
+		}
+		if output.CustomerDetails, err = cbor.Marshal(cs.CustomerDetails); err != nil {
+			return nil, gear.ErrInternalServerError.From(err)
+		}
+	}
+
+	// sessions created by others have no metadata
+	output.UID, _ = util.ParseID(cs.Metadata["uid"])
+	output.ChargeID, _ = util.ParseID(cs.Metadata["cid"])
+	return output, nil
+}
+
+// stripeError keeps the status code of stripe errors, such as 404 for missing objects.
+func stripeError(err error) error {
+	if se, ok := err.(*stripe.Error); ok && se.HTTPStatusCode > 0 {
+		return gear.Err.WithCode(se.HTTPStatusCode).WithMsg(se.Msg)
+	}
+	return gear.ErrInternalServerError.From(err)
+}
@@ -0,0 +1,98 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/client"
+
+	"github.com/yiwen-ai/wallet-api/src/conf"
+	"github.com/yiwen-ai/wallet-api/src/util"
+)
+
+// newStripeTestEnv returns a Stripe provider whose API calls are answered by the routes,
+// "METHOD /path" => JSON response.
+func newStripeTestEnv(t *testing.T, routes map[string]string) *Stripe {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, ok := routes[r.Method+" "+r.URL.Path]
+		if !ok {
+			http.Error(w, `{"error":{"message":"not found"}}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(res))
+	}))
+	t.Cleanup(srv.Close)
+
+	backend := stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(srv.URL),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelError},
+		MaxNetworkRetries: stripe.Int64(0),
+	})
+	return &Stripe{cfg: conf.Stripe{}, sc: client.New("sk_test", &stripe.Backends{API: backend})}
+}
+
+func TestStripeChargeRefunded(t *testing.T) {
+	uid, cid := util.NewID(), util.NewID()
+	event := `{"id":"evt_1","object":"event","type":"charge.refunded","data":{"object":{
+		"id":"ch_1","object":"charge","amount_refunded":500,"payment_intent":"pi_1",
+		"refunds":{"object":"list","data":[],"has_more":false}}}}`
+	refunds := `{"object":"list","url":"/v1/refunds","has_more":false,"data":[
+		{"id":"re_2","object":"refund","amount":200,"status":"succeeded"},
+		{"id":"re_1","object":"refund","amount":300,"status":"succeeded"}]}`
+
+	t.Run("checkout charge", func(t *testing.T) {
+		assert := assert.New(t)
+		p := newStripeTestEnv(t, map[string]string{
+			"GET /v1/refunds": refunds,
+			"GET /v1/checkout/sessions": `{"object":"list","url":"/v1/checkout/sessions","has_more":false,"data":[
+				{"id":"cs_1","object":"checkout.session","metadata":{"uid":"` + uid.String() + `","cid":"` + cid.String() + `"}}]}`,
+		})
+
+		output, err := p.ParseEvent(context.Background(), []byte(event))
+		assert.NoError(err)
+		assert.Equal(EventChargeRefunded, output.Kind)
+		assert.Equal(uid, output.UID)
+		assert.Equal(cid, output.ChargeID)
+		assert.Equal("re_2", output.Refund.ID)
+		assert.Equal(int64(200), output.Refund.Amount)
+		assert.Equal(int64(500), output.Refund.AmountRefunded)
+	})
+
+	t.Run("invoice charge", func(t *testing.T) {
+		assert := assert.New(t)
+		p := newStripeTestEnv(t, map[string]string{
+			"GET /v1/refunds":           refunds,
+			"GET /v1/checkout/sessions": `{"object":"list","url":"/v1/checkout/sessions","has_more":false,"data":[]}`,
+		})
+
+		// the charges of subscription invoices have no checkout sessions, the event is acknowledged
+		output, err := p.ParseEvent(context.Background(), []byte(event))
+		assert.NoError(err)
+		assert.Equal(EventUnknown, output.Kind)
+		assert.Equal("charge.refunded", output.Type)
+		assert.Equal(util.ZeroID, output.ChargeID)
+	})
+}
+
+func TestStripeReverseTransfer(t *testing.T) {
+	assert := assert.New(t)
+	p := newStripeTestEnv(t, map[string]string{
+		"GET /v1/transfers": `{"object":"list","url":"/v1/transfers","has_more":false,"data":[
+			{"id":"tr_1","object":"transfer","amount":500,"reversed":true},
+			{"id":"tr_2","object":"transfer","amount":500,"reversed":false}]}`,
+		"POST /v1/transfers/tr_2/reversals": `{"id":"trr_2","object":"transfer_reversal","amount":500,"transfer":"tr_2"}`,
+	})
+
+	// only the transfer not reversed is reversed
+	assert.NoError(p.ReverseTransfer(context.Background(), util.NewID()))
+
+	p = newStripeTestEnv(t, map[string]string{
+		"GET /v1/transfers": `{"object":"list","url":"/v1/transfers","has_more":false,"data":[]}`,
+	})
+	assert.NoError(p.ReverseTransfer(context.Background(), util.NewID()))
+}
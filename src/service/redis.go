@@ -62,3 +62,80 @@ func (s *Redis) SetCBOR(ctx context.Context, key string, val any, ttl uint) erro
 	}
 	return nil
 }
+
+func (s *Redis) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := s.cli.Exists(ctx, s.prefix+key).Result()
+	if err != nil {
+		return false, gear.ErrInternalServerError.From(err)
+	}
+	return n > 0, nil
+}
+
+func (s *Redis) Delete(ctx context.Context, key string) error {
+	if err := s.cli.Del(ctx, s.prefix+key).Err(); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return nil
+}
+
+// IncrBy increments the counter of the key by n, and sets the ttl in seconds if the ttl > 0.
+func (s *Redis) IncrBy(ctx context.Context, key string, n int64, ttl uint) (int64, error) {
+	pipe := s.cli.TxPipeline()
+	incr := pipe.IncrBy(ctx, s.prefix+key, n)
+	if ttl > 0 {
+		pipe.Expire(ctx, s.prefix+key, time.Duration(ttl)*time.Second)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, gear.ErrInternalServerError.From(err)
+	}
+	return incr.Val(), nil
+}
+
+// GetInt returns the counter of the key, 0 if not exists.
+func (s *Redis) GetInt(ctx context.Context, key string) (int64, error) {
+	n, err := s.cli.Get(ctx, s.prefix+key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, gear.ErrInternalServerError.From(err)
+	}
+	return n, nil
+}
+
+// Lock acquires a lock on the key with the ttl in seconds,
+// it returns false if the lock is held by others.
+func (s *Redis) Lock(ctx context.Context, key string, ttl uint) (bool, error) {
+	ok, err := s.cli.SetNX(ctx, s.prefix+"lock:"+key, 1, time.Duration(ttl)*time.Second).Result()
+	if err != nil {
+		return false, gear.ErrInternalServerError.From(err)
+	}
+	return ok, nil
+}
+
+func (s *Redis) Unlock(ctx context.Context, key string) error {
+	return s.Delete(ctx, "lock:"+key)
+}
+
+func (s *Redis) ZAdd(ctx context.Context, key string, score int64, member string) error {
+	err := s.cli.ZAdd(ctx, s.prefix+key, redis.Z{Score: float64(score), Member: member}).Err()
+	if err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return nil
+}
+
+func (s *Redis) ZRem(ctx context.Context, key string, member string) error {
+	if err := s.cli.ZRem(ctx, s.prefix+key, member).Err(); err != nil {
+		return gear.ErrInternalServerError.From(err)
+	}
+	return nil
+}
+
+// ZRevRange returns the members ordered from the highest to the lowest score.
+func (s *Redis) ZRevRange(ctx context.Context, key string, offset, count int64) ([]string, error) {
+	members, err := s.cli.ZRevRange(ctx, s.prefix+key, offset, offset+count-1).Result()
+	if err != nil {
+		return nil, gear.ErrInternalServerError.From(err)
+	}
+	return members, nil
+}
@@ -44,4 +44,92 @@ func TestRedis(t *testing.T) {
 		err = cli.GetCBOR(ctx, "test", &user2)
 		assert.True(util.IsNotFoundErr(err))
 	})
+	t.Run("Lock and Unlock", func(t *testing.T) {
+		assert := assert.New(t)
+
+		ctx := context.Background()
+		key := "test_lock"
+		ok, err := cli.Lock(ctx, key, 1)
+		assert.NoError(err)
+		assert.True(ok)
+
+		ok, err = cli.Lock(ctx, key, 1)
+		assert.NoError(err)
+		assert.False(ok)
+
+		assert.NoError(cli.Unlock(ctx, key))
+		ok, err = cli.Lock(ctx, key, 1)
+		assert.NoError(err)
+		assert.True(ok)
+
+		time.Sleep(1100 * time.Millisecond)
+		ok, err = cli.Lock(ctx, key, 1)
+		assert.NoError(err)
+		assert.True(ok)
+		assert.NoError(cli.Unlock(ctx, key))
+	})
+
+	t.Run("IncrBy and GetInt", func(t *testing.T) {
+		assert := assert.New(t)
+
+		ctx := context.Background()
+		key := "test_counter"
+		assert.NoError(cli.Delete(ctx, key))
+		n, err := cli.GetInt(ctx, key)
+		assert.NoError(err)
+		assert.Equal(int64(0), n)
+
+		n, err = cli.IncrBy(ctx, key, 2, 10)
+		assert.NoError(err)
+		assert.Equal(int64(2), n)
+		n, err = cli.IncrBy(ctx, key, -1, 0)
+		assert.NoError(err)
+		assert.Equal(int64(1), n)
+
+		n, err = cli.GetInt(ctx, key)
+		assert.NoError(err)
+		assert.Equal(int64(1), n)
+		assert.NoError(cli.Delete(ctx, key))
+	})
+
+	t.Run("Exists and Delete", func(t *testing.T) {
+		assert := assert.New(t)
+
+		ctx := context.Background()
+		ok, err := cli.Exists(ctx, "test_exists")
+		assert.NoError(err)
+		assert.False(ok)
+
+		assert.NoError(cli.SetCBOR(ctx, "test_exists", true, 10))
+		ok, err = cli.Exists(ctx, "test_exists")
+		assert.NoError(err)
+		assert.True(ok)
+
+		assert.NoError(cli.Delete(ctx, "test_exists"))
+		ok, err = cli.Exists(ctx, "test_exists")
+		assert.NoError(err)
+		assert.False(ok)
+	})
+	t.Run("ZAdd and ZRevRange", func(t *testing.T) {
+		assert := assert.New(t)
+
+		ctx := context.Background()
+		key := "test_zset"
+		assert.NoError(cli.ZAdd(ctx, key, 1, "a"))
+		assert.NoError(cli.ZAdd(ctx, key, 3, "c"))
+		assert.NoError(cli.ZAdd(ctx, key, 2, "b"))
+
+		members, err := cli.ZRevRange(ctx, key, 0, 2)
+		assert.NoError(err)
+		assert.Equal([]string{"c", "b"}, members)
+		members, err = cli.ZRevRange(ctx, key, 2, 2)
+		assert.NoError(err)
+		assert.Equal([]string{"a"}, members)
+
+		assert.NoError(cli.ZRem(ctx, key, "b"))
+		members, err = cli.ZRevRange(ctx, key, 0, 10)
+		assert.NoError(err)
+		assert.Equal([]string{"c", "a"}, members)
+		assert.NoError(cli.Delete(ctx, key))
+	})
 }